@@ -0,0 +1,77 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 请求耗时类直方图的默认分桶(秒)
+var DefaultLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// MetricsRegistry 中转服务的指标注册表，不使用全局默认注册表，避免第三方库的指标混入
+var MetricsRegistry = prometheus.NewRegistry()
+
+var metricsFactory = promauto.With(MetricsRegistry)
+
+// 中转服务的监控指标，通过 /metrics 以Prometheus文本格式输出
+var (
+	RelayRequestsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_requests_total",
+		Help: "中转请求次数，每次账号尝试计一次",
+	}, []string{"platform", "account_id", "group_id", "model", "status"})
+	RelayRequestDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_request_duration_seconds",
+		Help:    "单次账号尝试的耗时",
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"platform", "account_id", "model"})
+	RelayFirstTokenDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_first_token_seconds",
+		Help:    "流式请求首个内容增量的耗时",
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"platform", "account_id", "model"})
+	RelayTokensTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_tokens_total",
+		Help: "成功请求消耗的tokens",
+	}, []string{"platform", "account_id", "group_id", "model", "type"})
+	RelayCostTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_cost_usd_total",
+		Help: "成功请求的费用(USD)",
+	}, []string{"platform", "account_id", "group_id", "model"})
+	RelayStreamsInFlight = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_streams_in_flight",
+		Help: "进行中的流式请求数",
+	}, []string{"platform", "account_id"})
+	AccountStatus = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_account_current_status",
+		Help: "账号当前状态：1正常 2异常 3限流 4token刷新失败",
+	}, []string{"platform", "account_id", "account_name"})
+	OAuthRefreshTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_oauth_refresh_total",
+		Help: "OAuth token刷新次数",
+	}, []string{"account_id", "result"})
+	CronJobRunsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_cron_job_runs_total",
+		Help: "定时任务执行次数",
+	}, []string{"job", "result"})
+	CronJobDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_cron_job_duration_seconds",
+		Help:    "定时任务执行耗时",
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"job"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler 输出注册表中所有指标的HTTP处理器，采集出错时返回已成功采集的部分
+var MetricsHandler http.Handler = promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{
+	ErrorHandling: promhttp.ContinueOnError,
+})
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 模型规则写法，均不区分大小写：
+//   claude-sonnet-4-20250514   精确匹配
+//   claude-sonnet-*、*haiku*    通配符，*匹配任意字符，?匹配单个字符
+//   /^claude-(opus|sonnet)-4/  两个/之间为正则表达式
+//   !claude-opus-*             排除规则，仅用于模型限制和模型映射
+// 多条规则用逗号分隔，因此正则中不能包含逗号
+
+// ErrInvalidModelPattern 模型规则格式错误
+var ErrInvalidModelPattern = errors.New("模型规则格式错误")
+
+// modelPatternCache 已编译的通配符和正则规则
+var modelPatternCache sync.Map
+
+// isRegexModelPattern 是否为 /正则/ 形式的规则
+func isRegexModelPattern(pattern string) bool {
+	return len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// isWildcardModelPattern 是否为通配符或正则规则
+func isWildcardModelPattern(pattern string) bool {
+	return isRegexModelPattern(pattern) || strings.ContainsAny(pattern, "*?")
+}
+
+// compileModelPattern 将通配符或正则规则编译为不区分大小写的正则表达式
+func compileModelPattern(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := modelPatternCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	var expr string
+	if isRegexModelPattern(pattern) {
+		expr = "(?i)" + pattern[1:len(pattern)-1]
+	} else {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		expr = "(?i)^" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	modelPatternCache.Store(pattern, re)
+	return re, nil
+}
+
+// MatchModelPattern 模型名称是否匹配规则，格式错误的规则不匹配任何模型
+func MatchModelPattern(pattern, modelName string) bool {
+	if !isWildcardModelPattern(pattern) {
+		return strings.EqualFold(pattern, modelName)
+	}
+	re, err := compileModelPattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(modelName)
+}
+
+// splitModelPatterns 拆分逗号分隔的规则，忽略空项
+func splitModelPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// IsModelAllowed 模型是否满足模型限制，为空表示不限制
+// 命中任一排除规则时不允许；只有排除规则时其余模型均允许；否则需要命中任一允许规则
+func IsModelAllowed(restriction, modelName string) bool {
+	hasAllowRule := false
+	allowed := false
+	for _, pattern := range splitModelPatterns(restriction) {
+		if deny, ok := strings.CutPrefix(pattern, "!"); ok {
+			if MatchModelPattern(strings.TrimSpace(deny), modelName) {
+				return false
+			}
+			continue
+		}
+		hasAllowRule = true
+		if !allowed && MatchModelPattern(pattern, modelName) {
+			allowed = true
+		}
+	}
+	return allowed || !hasAllowRule
+}
+
+// ModelMappingRule 一条模型映射规则，Exclude为true时匹配的模型不做映射
+type ModelMappingRule struct {
+	Source  string
+	Target  string
+	Exclude bool
+}
+
+// ParseModelMapping 解析模型映射配置
+// 格式: 规则:目标模型，多个用逗号分隔，正则规则写作 /正则/:目标模型；!规则 表示匹配的模型不做映射
+func ParseModelMapping(modelMapping string) []ModelMappingRule {
+	var rules []ModelMappingRule
+	for _, entry := range splitModelPatterns(modelMapping) {
+		if exclude, ok := strings.CutPrefix(entry, "!"); ok {
+			rules = append(rules, ModelMappingRule{Source: strings.TrimSpace(exclude), Exclude: true})
+			continue
+		}
+
+		// 正则中可能包含冒号，以结尾的 "/:" 分隔规则和目标模型
+		var source, target string
+		var ok bool
+		if strings.HasPrefix(entry, "/") {
+			var rest string
+			source, rest, ok = strings.Cut(entry[1:], "/:")
+			source = "/" + source + "/"
+			target = rest
+		} else {
+			source, target, ok = strings.Cut(entry, ":")
+		}
+
+		source, target = strings.TrimSpace(source), strings.TrimSpace(target)
+		if !ok || source == "" || target == "" {
+			continue
+		}
+		rules = append(rules, ModelMappingRule{Source: source, Target: target})
+	}
+	return rules
+}
+
+// MatchModelMapping 查找第一条匹配的映射规则，返回目标模型，命中排除规则时不做映射
+// 普通规则沿用包含关键字即匹配的方式，通配符和正则规则需完整匹配
+func MatchModelMapping(modelMapping, modelName string) (string, bool) {
+	rules := ParseModelMapping(modelMapping)
+	for _, rule := range rules {
+		if rule.Exclude && matchModelMappingSource(rule.Source, modelName) {
+			return "", false
+		}
+	}
+	for _, rule := range rules {
+		if !rule.Exclude && matchModelMappingSource(rule.Source, modelName) {
+			return rule.Target, true
+		}
+	}
+	return "", false
+}
+
+func matchModelMappingSource(source, modelName string) bool {
+	if isWildcardModelPattern(source) {
+		return MatchModelPattern(source, modelName)
+	}
+	return strings.Contains(modelName, source)
+}
+
+// ValidateModelPatterns 校验逗号分隔的模型规则中的正则表达式
+func ValidateModelPatterns(value string) error {
+	for _, pattern := range splitModelPatterns(value) {
+		pattern = strings.TrimSpace(strings.TrimPrefix(pattern, "!"))
+		if !isWildcardModelPattern(pattern) {
+			continue
+		}
+		if _, err := compileModelPattern(pattern); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidModelPattern, pattern)
+		}
+	}
+	return nil
+}
+
+// ValidateModelMapping 校验模型映射配置中的规则
+func ValidateModelMapping(modelMapping string) error {
+	for _, rule := range ParseModelMapping(modelMapping) {
+		if err := ValidateModelPatterns(rule.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
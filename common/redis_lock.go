@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 锁等待期间的重试间隔
+const lockRetryInterval = 200 * time.Millisecond
+
+// ErrLockNotAcquired 等待超时仍未获取到锁
+var ErrLockNotAcquired = errors.New("lock not acquired")
+
+// 仅在锁仍由自己持有时删除，避免锁过期后误删其他持有者的锁
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// DistributedLock 基于Redis的互斥锁，Redis未配置时退化为进程内锁
+// 锁在ttl后自动过期，持有者崩溃时不会永久阻塞其他实例
+type DistributedLock struct {
+	key   string
+	token string
+}
+
+// localLocks Redis未配置时的进程内锁，值为持有者token和过期时间
+var (
+	localLocks   = make(map[string]localLock)
+	localLocksMu sync.Mutex
+)
+
+type localLock struct {
+	token     string
+	expiresAt time.Time
+}
+
+// TryLock 尝试获取锁，锁已被持有时返回nil和nil
+func TryLock(ctx context.Context, key string, ttl time.Duration) (*DistributedLock, error) {
+	token := GenerateRandomString(32)
+
+	if RDB != nil {
+		ok, err := RDB.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		return &DistributedLock{key: key, token: token}, nil
+	}
+
+	localLocksMu.Lock()
+	defer localLocksMu.Unlock()
+
+	now := time.Now()
+	if held, exists := localLocks[key]; exists && now.Before(held.expiresAt) {
+		return nil, nil
+	}
+	localLocks[key] = localLock{token: token, expiresAt: now.Add(ttl)}
+	return &DistributedLock{key: key, token: token}, nil
+}
+
+// AcquireLock 获取锁，锁已被持有时在wait时间内轮询等待，超时返回ErrLockNotAcquired
+func AcquireLock(ctx context.Context, key string, ttl, wait time.Duration) (*DistributedLock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		lock, err := TryLock(ctx, key, ttl)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockNotAcquired
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// Unlock 释放锁，锁已过期或已被其他持有者获取时不做任何操作
+func (l *DistributedLock) Unlock() {
+	if l == nil {
+		return
+	}
+
+	if RDB != nil {
+		if err := releaseLockScript.Run(context.Background(), RDB, []string{l.key}, l.token).Err(); err != nil && !errors.Is(err, redis.Nil) {
+			SysError("Failed to release lock " + l.key + ": " + err.Error())
+		}
+		return
+	}
+
+	localLocksMu.Lock()
+	defer localLocksMu.Unlock()
+	if held, exists := localLocks[l.key]; exists && held.token == l.token {
+		delete(localLocks, l.key)
+	}
+}
@@ -0,0 +1,191 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// setupTestRedis 使用内存Redis替换RDB，模拟多个实例共享同一个Redis
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	previous := RDB
+	RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		RDB.Close()
+		RDB = previous
+	})
+	return mr
+}
+
+func TestTryLockIsExclusive(t *testing.T) {
+	mr := setupTestRedis(t)
+	ctx := context.Background()
+
+	lock, err := TryLock(ctx, "test_lock", time.Minute)
+	if err != nil || lock == nil {
+		t.Fatalf("first TryLock = %v, %v; want lock", lock, err)
+	}
+
+	other, err := TryLock(ctx, "test_lock", time.Minute)
+	if err != nil || other != nil {
+		t.Fatalf("second TryLock = %v, %v; want nil, nil while lock is held", other, err)
+	}
+
+	lock.Unlock()
+	if mr.Exists("test_lock") {
+		t.Fatal("lock key still exists after Unlock")
+	}
+
+	again, err := TryLock(ctx, "test_lock", time.Minute)
+	if err != nil || again == nil {
+		t.Fatalf("TryLock after Unlock = %v, %v; want lock", again, err)
+	}
+}
+
+func TestTryLockExpires(t *testing.T) {
+	mr := setupTestRedis(t)
+	ctx := context.Background()
+
+	if lock, err := TryLock(ctx, "test_lock", time.Second); err != nil || lock == nil {
+		t.Fatalf("TryLock = %v, %v; want lock", lock, err)
+	}
+	mr.FastForward(2 * time.Second)
+
+	if lock, err := TryLock(ctx, "test_lock", time.Second); err != nil || lock == nil {
+		t.Fatalf("TryLock after ttl = %v, %v; want lock", lock, err)
+	}
+}
+
+func TestUnlockKeepsOtherHoldersLock(t *testing.T) {
+	mr := setupTestRedis(t)
+	ctx := context.Background()
+
+	expired, _ := TryLock(ctx, "test_lock", time.Second)
+	mr.FastForward(2 * time.Second)
+	current, _ := TryLock(ctx, "test_lock", time.Minute)
+	if expired == nil || current == nil {
+		t.Fatal("failed to acquire locks")
+	}
+
+	// 过期的持有者释放锁时不能删除新持有者的锁
+	expired.Unlock()
+	if got, err := mr.Get("test_lock"); err != nil || got != current.token {
+		t.Fatalf("lock value = %q, %v; want current holder's token", got, err)
+	}
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	setupTestRedis(t)
+	ctx := context.Background()
+
+	lock, _ := TryLock(ctx, "test_lock", time.Minute)
+	if lock == nil {
+		t.Fatal("failed to acquire lock")
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		lock.Unlock()
+	}()
+
+	waited, err := AcquireLock(ctx, "test_lock", time.Minute, 5*time.Second)
+	if err != nil || waited == nil {
+		t.Fatalf("AcquireLock = %v, %v; want lock after release", waited, err)
+	}
+}
+
+func TestAcquireLockTimeout(t *testing.T) {
+	setupTestRedis(t)
+	ctx := context.Background()
+
+	if lock, _ := TryLock(ctx, "test_lock", time.Minute); lock == nil {
+		t.Fatal("failed to acquire lock")
+	}
+
+	_, err := AcquireLock(ctx, "test_lock", time.Minute, 300*time.Millisecond)
+	if !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("AcquireLock err = %v; want ErrLockNotAcquired", err)
+	}
+}
+
+func TestAcquireLockSingleHolder(t *testing.T) {
+	setupTestRedis(t)
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		holders int
+		maxSeen int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := AcquireLock(ctx, "test_lock", time.Minute, 10*time.Second)
+			if err != nil {
+				t.Errorf("AcquireLock: %v", err)
+				return
+			}
+			mu.Lock()
+			holders++
+			maxSeen = max(maxSeen, holders)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen != 1 {
+		t.Fatalf("max concurrent holders = %d; want 1", maxSeen)
+	}
+}
+
+func TestGetInstanceIDSharedAcrossInstances(t *testing.T) {
+	mr := setupTestRedis(t)
+
+	first := GetInstanceID()
+	if first == "" {
+		t.Fatal("GetInstanceID returned empty id")
+	}
+	if second := GetInstanceID(); second != first {
+		t.Fatalf("second GetInstanceID = %q; want %q", second, first)
+	}
+	if stored, _ := mr.Get("system:instance_id"); stored != first {
+		t.Fatalf("stored id = %q; want %q", stored, first)
+	}
+}
+
+func TestGetInstanceIDConcurrent(t *testing.T) {
+	setupTestRedis(t)
+
+	// 多个实例同时生成ID时只有SETNX成功的ID生效
+	ids := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = GetInstanceID()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if id == "" || id != ids[0] {
+			t.Fatalf("instance ids = %v; want all equal", ids)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 加密后的密钥格式: enc:v1:<主密钥ID>:<base64(被主密钥加密的数据密钥)>:<base64(被数据密钥加密的内容)>
+// 每个值使用独立的随机数据密钥加密，数据密钥再由主密钥加密(信封加密)，均为AES-256-GCM
+const encryptedSecretPrefix = "enc:v1:"
+
+// secretKeyring 账号密钥加密使用的主密钥，第一个为当前密钥，其余仅用于解密轮换前的数据
+type secretKeyring struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+var (
+	accountSecretKeyring     *secretKeyring
+	accountSecretKeyringErr  error
+	accountSecretKeyringOnce sync.Once
+)
+
+// InitSecretEncryption 加载账号密钥加密的主密钥
+// ACCOUNT_ENCRYPTION_KEYS: 逗号分隔的 密钥ID:base64(32字节密钥)，第一个为当前加密密钥
+// ACCOUNT_ENCRYPTION_KEY_FILE: 密钥文件路径，每行一个 密钥ID:base64(32字节密钥)，#开头为注释，与环境变量二选一
+// 未配置主密钥时密钥以明文存储
+func InitSecretEncryption() error {
+	keyring, err := getSecretKeyring()
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		SysLog("Account secret encryption disabled: ACCOUNT_ENCRYPTION_KEYS not configured, secrets are stored in plaintext")
+		return nil
+	}
+	SysLog(fmt.Sprintf("Account secret encryption enabled, current key: %s, %d key(s) loaded", keyring.currentID, len(keyring.keys)))
+	return nil
+}
+
+func getSecretKeyring() (*secretKeyring, error) {
+	accountSecretKeyringOnce.Do(func() {
+		accountSecretKeyring, accountSecretKeyringErr = loadSecretKeyring()
+	})
+	return accountSecretKeyring, accountSecretKeyringErr
+}
+
+func loadSecretKeyring() (*secretKeyring, error) {
+	var entries []string
+	if keyFile := os.Getenv("ACCOUNT_ENCRYPTION_KEY_FILE"); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取主密钥文件失败: %v", err)
+		}
+		entries = strings.Split(string(content), "\n")
+	} else {
+		entries = strings.Split(os.Getenv("ACCOUNT_ENCRYPTION_KEYS"), ",")
+	}
+
+	var keyring *secretKeyring
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encodedKey, ok := strings.Cut(entry, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, errors.New("主密钥格式错误，应为 密钥ID:base64密钥")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("主密钥 %s 必须是base64编码的32字节密钥", id)
+		}
+
+		if keyring == nil {
+			keyring = &secretKeyring{currentID: id, keys: make(map[string][]byte)}
+		}
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("主密钥ID %s 重复", id)
+		}
+		keyring.keys[id] = key
+	}
+	return keyring, nil
+}
+
+// IsSecretEncryptionEnabled 是否配置了主密钥
+func IsSecretEncryptionEnabled() (bool, error) {
+	keyring, err := getSecretKeyring()
+	return keyring != nil, err
+}
+
+// IsSecretEncrypted 值是否为加密格式
+func IsSecretEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// EncryptSecret 使用当前主密钥加密，空值和未配置主密钥时原样返回
+func EncryptSecret(plaintext string) (string, error) {
+	keyring, err := getSecretKeyring()
+	if err != nil {
+		return "", err
+	}
+	if plaintext == "" || keyring == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealAESGCM(keyring.keys[keyring.currentID], dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAESGCM(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedSecretPrefix + keyring.currentID + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptSecret 解密密钥，未加密的历史明文原样返回
+func DecryptSecret(value string) (string, error) {
+	if !IsSecretEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("加密密钥格式错误")
+	}
+
+	keyring, err := getSecretKeyring()
+	if err != nil {
+		return "", err
+	}
+	if keyring == nil {
+		return "", errors.New("密钥已加密但未配置主密钥 ACCOUNT_ENCRYPTION_KEYS")
+	}
+	masterKey, ok := keyring.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("未找到主密钥 %s，轮换后请保留旧密钥直到重新加密完成", parts[0])
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("加密密钥格式错误")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("加密密钥格式错误")
+	}
+
+	dataKey, err := openAESGCM(masterKey, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("解密数据密钥失败: %v", err)
+	}
+	plaintext, err := openAESGCM(dataKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("解密密钥失败: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// SecretNeedsReencryption 开启加密后，明文或非当前主密钥加密的值需要重新加密
+func SecretNeedsReencryption(value string) bool {
+	keyring, err := getSecretKeyring()
+	if err != nil || keyring == nil || value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedSecretPrefix+keyring.currentID+":")
+}
+
+// MaskSecret 脱敏显示密钥，只保留首尾各4位
+func MaskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 12 {
+		return strings.Repeat("*", 8)
+	}
+	return secret[:4] + strings.Repeat("*", 8) + secret[len(secret)-4:]
+}
+
+// sealAESGCM 加密，结果为 nonce+密文
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openAESGCM 解密 sealAESGCM 的结果
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("密文长度错误")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"io"
 	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -14,6 +15,24 @@ type TokenUsage struct {
 	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
 	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
 	Model                    string `json:"model"`
+
+	// 流式响应的时间点，用于计算首字节耗时、首个内容增量耗时和输出速度
+	FirstByteAt    time.Time `json:"-"` // 收到上游第一个字节的时间
+	FirstContentAt time.Time `json:"-"` // 收到第一个content_block_delta事件的时间
+}
+
+// MarkFirstByte 记录收到上游第一个字节的时间，只记录第一次
+func (u *TokenUsage) MarkFirstByte() {
+	if u != nil && u.FirstByteAt.IsZero() {
+		u.FirstByteAt = time.Now()
+	}
+}
+
+// MarkFirstContent 记录收到第一个文本或工具调用增量的时间，只记录第一次
+func (u *TokenUsage) MarkFirstContent() {
+	if u != nil && u.FirstContentAt.IsZero() {
+		u.FirstContentAt = time.Now()
+	}
 }
 
 // StreamCopyWriter 实现真正的流式转发，边转发边解析
@@ -37,6 +56,8 @@ func (w *StreamCopyWriter) Write(p []byte) (n int, err error) {
 		return 0, nil
 	}
 
+	w.usage.MarkFirstByte()
+
 	// 先写入目标，实现真正的流式转发
 	n, err = w.dst.Write(p)
 	if err != nil {
@@ -121,6 +142,11 @@ func (w *StreamCopyWriter) parseLine(line string) {
 
 	eventType := gjson.Get(dataJSON, "type").String()
 
+	// 记录第一个内容增量的时间
+	if eventType == "content_block_delta" {
+		w.usage.MarkFirstContent()
+	}
+
 	// 检查是否是message_start事件，解析model字段和使用量
 	if eventType == "message_start" {
 		model := gjson.Get(dataJSON, "message.model").String()
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultTraceServiceName = "claude-code-relay"
+
+var tracerProvider atomic.Pointer[sdktrace.TracerProvider]
+
+// Tracer 返回本服务的tracer，未开启链路追踪时为no-op实现
+func Tracer() trace.Tracer {
+	return otel.Tracer(defaultTraceServiceName)
+}
+
+// InitTracing 根据环境变量初始化链路追踪
+// OTEL_TRACES_EXPORTER: otlp(OTLP/HTTP)、console/stdout 或 none(默认)
+// 导出地址、请求头、服务名称、采样器等使用OTel SDK的标准环境变量，如
+// OTEL_EXPORTER_OTLP_ENDPOINT、OTEL_EXPORTER_OTLP_HEADERS、OTEL_SERVICE_NAME、OTEL_TRACES_SAMPLER
+func InitTracing() {
+	ctx := context.Background()
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return
+	}
+	if err != nil {
+		SysError("Failed to create trace exporter: " + err.Error())
+		return
+	}
+
+	// 未设置OTEL_SERVICE_NAME时使用默认服务名称
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(defaultTraceServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		SysError("Failed to create trace resource: " + err.Error())
+		res = resource.Default()
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	if !tracerProvider.CompareAndSwap(nil, provider) {
+		_ = provider.Shutdown(ctx)
+		return
+	}
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	SysLog("Tracing started, exporter: " + os.Getenv("OTEL_TRACES_EXPORTER"))
+}
+
+// StopTracing 停止链路追踪并导出队列中剩余的span
+func StopTracing(timeout time.Duration) {
+	provider := tracerProvider.Swap(nil)
+	if provider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		SysError("Tracing exporter shutdown failed: " + err.Error())
+	}
+}
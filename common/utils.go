@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -75,8 +76,15 @@ func GenerateRandomInstanceID() string {
 	return hex.EncodeToString(bytes)[:61] // 取前61位
 }
 
+// localInstanceID Redis未配置时进程内使用的实例ID
+var (
+	localInstanceID   string
+	localInstanceIDMu sync.Mutex
+)
+
 // GetInstanceID 获取实例ID，如果不存在则生成61位随机字符串并存储到Redis
 // 仅在分组示例ID不存在时调用, 即全局共享组专属ID
+// 多个实例同时生成时通过SETNX保证只有一个ID生效，其余实例读取已生效的ID
 func GetInstanceID() string {
 	const instanceKey = "system:instance_id"
 	ctx := context.Background()
@@ -87,6 +95,12 @@ func GetInstanceID() string {
 		if err == nil && id != "" {
 			return id
 		}
+	} else {
+		localInstanceIDMu.Lock()
+		defer localInstanceIDMu.Unlock()
+		if localInstanceID != "" {
+			return localInstanceID
+		}
 	}
 
 	newID := GenerateRandomInstanceID()
@@ -95,12 +109,18 @@ func GetInstanceID() string {
 		return ""
 	}
 
-	// 存储到Redis（永久存储）
+	// 存储到Redis（永久存储），已被其他实例抢先生成时使用已存储的ID
 	if RDB != nil {
-		err := RDB.Set(ctx, instanceKey, newID, 0).Err()
+		stored, err := RDB.SetNX(ctx, instanceKey, newID, 0).Result()
 		if err != nil {
 			SysError("Failed to store instance ID to Redis: " + err.Error())
+		} else if !stored {
+			if id, err := RDB.Get(ctx, instanceKey).Result(); err == nil && id != "" {
+				return id
+			}
 		}
+	} else {
+		localInstanceID = newID
 	}
 
 	SysLog("Generated new instance ID: " + newID)
@@ -41,5 +41,15 @@ const (
 	PlatformOpenAI        = "openai"
 	PlatformGemini        = "gemini"
 
+	// 账号调度策略
+	ScheduleStrategyPriorityWeighted = "priority_weighted" // 优先级 + 权重随机
+	ScheduleStrategyLeastConnections = "least_connections" // 最少进行中请求
+	ScheduleStrategyLeastCost        = "least_cost"        // 今日费用最少
+	ScheduleStrategyRoundRobin       = "round_robin"       // 分组内轮询
+
+	// OpenAI平台账号的上游接口类型
+	OpenAIApiTypeChatCompletions = "chat_completions" // /chat/completions 接口
+	OpenAIApiTypeResponses       = "responses"        // /responses 接口
+
 	ClaudeCodeSystemPrompt = "You are Claude Code, Anthropic's official CLI for Claude."
 )
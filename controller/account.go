@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -89,6 +91,13 @@ func CreateAccount(c *gin.Context) {
 
 	account, err := accountService.CreateAccount(&req, user.ID)
 	if err != nil {
+		if errors.Is(err, common.ErrInvalidModelPattern) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+				"code":  constant.InvalidParams,
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 			"code":  constant.InternalServerError,
@@ -186,7 +195,10 @@ func UpdateAccount(c *gin.Context) {
 	if err != nil {
 		var statusCode int
 		var code int
-		if err.Error() == "账号不存在" {
+		if errors.Is(err, common.ErrInvalidModelPattern) {
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		} else if err.Error() == "账号不存在" {
 			statusCode = http.StatusNotFound
 			code = constant.NotFound
 		} else if err.Error() == "无权访问此账号" {
@@ -324,6 +336,78 @@ func UpdateAccountActiveStatus(c *gin.Context) {
 	})
 }
 
+// RevealAccountSecrets 查看账号完整密钥，其他接口返回的密钥均已脱敏
+func RevealAccountSecrets(c *gin.Context) {
+	idParam := c.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的账号ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	// 只有账号所属用户可以查看，管理员也不例外
+	user := c.MustGet("user").(*model.User)
+
+	accountService := service.NewAccountService()
+	account, err := accountService.RevealAccountSecrets(uint(id), user.ID)
+	if err != nil {
+		var statusCode int
+		var code int
+		if err.Error() == "账号不存在" {
+			statusCode = http.StatusNotFound
+			code = constant.NotFound
+		} else if err.Error() == "无权访问此账号" {
+			statusCode = http.StatusForbidden
+			code = constant.Forbidden
+		} else {
+			statusCode = http.StatusInternalServerError
+			code = constant.InternalServerError
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"secret_key":    account.SecretKey,
+			"access_token":  account.AccessToken,
+			"refresh_token": account.RefreshToken,
+		},
+	})
+}
+
+// ReencryptAccountSecrets 使用当前主密钥重新加密所有账号密钥（管理员专用）
+func ReencryptAccountSecrets(c *gin.Context) {
+	accountService := service.NewAccountService()
+	updatedCount, err := accountService.ReencryptAccountSecrets()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "重新加密账号密钥失败: " + err.Error(),
+			"code":  constant.InternalServerError,
+			"data": gin.H{
+				"updated_count": updatedCount,
+			},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "重新加密成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"updated_count": updatedCount,
+		},
+	})
+}
+
 // UpdateAccountCurrentStatus 更新账号当前状态
 func UpdateAccountCurrentStatus(c *gin.Context) {
 	idParam := c.Param("id")
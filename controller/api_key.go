@@ -4,6 +4,7 @@ import (
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -30,8 +31,11 @@ func CreateApiKey(c *gin.Context) {
 	if err != nil {
 		var statusCode int
 		var code int
-		switch err.Error() {
-		case "API Key名称不能为空", "指定的分组不存在", "过期时间不能早于当前时间":
+		switch {
+		case errors.Is(err, service.ErrInvalidApiKeyScope):
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		case err.Error() == "API Key名称不能为空", err.Error() == "指定的分组不存在", err.Error() == "过期时间不能早于当前时间":
 			statusCode = http.StatusBadRequest
 			code = constant.InvalidParams
 		default:
@@ -123,8 +127,11 @@ func UpdateApiKey(c *gin.Context) {
 	if err != nil {
 		var statusCode int
 		var code int
-		switch err.Error() {
-		case "API Key不存在", "指定的分组不存在", "过期时间不能早于当前时间":
+		switch {
+		case errors.Is(err, service.ErrInvalidApiKeyScope):
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		case err.Error() == "API Key不存在", err.Error() == "指定的分组不存在", err.Error() == "过期时间不能早于当前时间":
 			statusCode = http.StatusBadRequest
 			code = constant.InvalidParams
 		default:
@@ -185,6 +192,111 @@ func DeleteApiKey(c *gin.Context) {
 	})
 }
 
+// RotateApiKey 轮换API Key，新密钥只返回一次，旧密钥在宽限期内仍然有效
+func RotateApiKey(c *gin.Context) {
+	id := c.Param("id")
+	idInt, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的API Key ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	var req struct {
+		GraceMinutes *int `json:"grace_minutes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	// 从认证中获取用户ID
+	user := c.MustGet("user").(*model.User)
+	userID := user.ID
+
+	apiKey, err := service.RotateApiKey(uint(idInt), userID, req.GraceMinutes)
+	if err != nil {
+		var statusCode int
+		var code int
+		switch err.Error() {
+		case "API Key不存在":
+			statusCode = http.StatusNotFound
+			code = constant.InvalidParams
+		case "宽限期不能为负数", "宽限期不能超过30天":
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		default:
+			statusCode = http.StatusInternalServerError
+			code = constant.InternalServerError
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "轮换API Key成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"key":                     apiKey.Key,
+			"key_prefix":              apiKey.KeyPrefix,
+			"previous_key_prefix":     apiKey.PreviousKeyPrefix,
+			"previous_key_expires_at": apiKey.PreviousKeyExpiresAt,
+		},
+	})
+}
+
+// RevokePreviousApiKey 使轮换前的旧密钥立即失效
+func RevokePreviousApiKey(c *gin.Context) {
+	id := c.Param("id")
+	idInt, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的API Key ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	// 从认证中获取用户ID
+	user := c.MustGet("user").(*model.User)
+	userID := user.ID
+
+	err = service.RevokePreviousApiKey(uint(idInt), userID)
+	if err != nil {
+		var statusCode int
+		var code int
+		switch err.Error() {
+		case "API Key不存在":
+			statusCode = http.StatusNotFound
+			code = constant.InvalidParams
+		case "没有处于宽限期的旧密钥":
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		default:
+			statusCode = http.StatusInternalServerError
+			code = constant.InternalServerError
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "旧密钥已失效",
+		"code":    constant.Success,
+	})
+}
+
 // UpdateApiKeyStatus 更新API Key状态
 func UpdateApiKeyStatus(c *gin.Context) {
 	id := c.Param("id")
@@ -344,6 +456,8 @@ func GetApiKeyInfo(c *gin.Context) {
 		})
 		return
 	}
+	// 公开接口不暴露账号信息
+	stats.AccountLatency = nil
 
 	// 获取日志列表
 	filters := &model.LogFilters{
@@ -361,14 +475,34 @@ func GetApiKeyInfo(c *gin.Context) {
 		return
 	}
 
+	// 获取预算使用情况
+	budget, err := service.GetApiKeyBudgetUsage(apiKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "获取预算数据失败",
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+	groupBudget, err := service.GetGroupBudgetUsage(apiKey.GroupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "获取预算数据失败",
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
 	// 返回响应
 	c.JSON(http.StatusOK, gin.H{
 		"code": constant.Success,
 		"data": gin.H{
 			"api_key_info": gin.H{
-				"id":     apiKey.ID,
-				"name":   apiKey.Name,
-				"status": apiKey.Status,
+				"id":           apiKey.ID,
+				"name":         apiKey.Name,
+				"status":       apiKey.Status,
+				"budget":       budget,
+				"group_budget": groupBudget,
 			},
 			"stats": stats,
 			"logs": gin.H{
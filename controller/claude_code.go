@@ -1,17 +1,22 @@
 package controller
 
 import (
+	"bytes"
 	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/relay"
+	"claude-code-relay/service"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type ExchangeRequest struct {
@@ -40,6 +45,7 @@ type RequestContext struct {
 	APIKey           *model.ApiKey
 	Body             []byte
 	ModelName        string
+	SessionHash      string // 会话指纹，用于将同一会话粘滞到同一账号
 	FilteredAccounts []model.Account
 }
 
@@ -120,9 +126,27 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 		return nil, false
 	}
 
+	// 检查max_tokens和上下文大小是否超出API Key的限制
+	if scopeErr := service.CheckApiKeyRequestLimits(keyInfo, body); scopeErr != nil {
+		c.JSON(scopeErr.StatusCode, scopeErr.Response())
+		return nil, false
+	}
+
+	// 记录客户端是否请求流式响应，中转时保持一致
+	c.Set("is_stream", gjson.GetBytes(body, "stream").Bool())
+	c.Set("model_name", modelName)
+
 	// 根据API Key的分组ID查询可用账号列表
+	_, selectSpan := common.Tracer().Start(c.Request.Context(), "relay.select_accounts", trace.WithSpanKind(trace.SpanKindInternal))
+	defer selectSpan.End()
+	selectSpan.SetAttributes(
+		attribute.Int("group_id", keyInfo.GroupID),
+		attribute.String("model", modelName),
+	)
+
 	accounts, err := model.GetAvailableAccountsByGroupID(keyInfo.GroupID)
 	if err != nil {
+		selectSpan.SetStatus(codes.Error, err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": "查询账号列表失败",
 			"code":    constant.InternalServerError,
@@ -130,8 +154,17 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 		return nil, false
 	}
 
-	// 根据模型权限过滤账号
+	// 根据模型权限过滤账号，并按分组的调度策略排序
 	filteredAccounts := filterAccountsByModelPermission(accounts, keyInfo, modelName)
+	filteredAccounts = service.ScheduleAccounts(keyInfo.GroupID, filteredAccounts)
+
+	// 同一会话优先使用上次成功的账号，保证 prompt cache 命中
+	sessionHash := service.GetSessionFingerprint(body)
+	filteredAccounts = service.ApplyStickySession(keyInfo.GroupID, sessionHash, filteredAccounts)
+	selectSpan.SetAttributes(
+		attribute.Int("accounts.available", len(accounts)),
+		attribute.Int("accounts.candidates", len(filteredAccounts)),
+	)
 
 	if len(filteredAccounts) == 0 {
 		if len(accounts) == 0 {
@@ -152,6 +185,7 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 		APIKey:           keyInfo,
 		Body:             body,
 		ModelName:        modelName,
+		SessionHash:      sessionHash,
 		FilteredAccounts: filteredAccounts,
 	}, true
 }
@@ -163,22 +197,105 @@ func GetMessages(c *gin.Context) {
 		return
 	}
 
-	// 选择第一个账号（已按优先级和使用次数排序）
-	selectedAccount := ctx.FilteredAccounts[0]
+	// 按预估的最大费用预占每日限额，避免并发请求在统计更新前超出限额
+	reservation, ok := service.ReserveApiKeyBudget(ctx.APIKey, ctx.Body)
+	if !ok {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "API Key剩余每日限额不足以支付本次请求的预估费用",
+			"code":  40004,
+		})
+		return
+	}
+	if reservation != nil {
+		c.Set("budget_reservation", reservation)
+		defer reservation.Release()
+	}
+
+	// 开启内容抓取时记录响应，请求结束后与请求日志关联保存
+	if relay.ShouldCaptureBodies(ctx.APIKey) {
+		captureWriter := relay.NewCaptureResponseWriter(c.Writer)
+		c.Writer = captureWriter
+		defer relay.SaveRequestCapture(c, captureWriter, ctx.Body)
+	}
+
+	// 按调度顺序依次尝试账号，在向客户端写出数据之前遇到限流或上游异常时切换到下一个账号
+	maxAttempts := relay.GetRelayMaxAttempts()
+	if maxAttempts > len(ctx.FilteredAccounts) {
+		maxAttempts = len(ctx.FilteredAccounts)
+	}
+
+	requestStartTime := time.Now()
+	for i := 0; i < maxAttempts; i++ {
+		selectedAccount := ctx.FilteredAccounts[i]
+		canRetry := i < maxAttempts-1
+
+		startTime := time.Now()
+		result := relayToAccount(c, &selectedAccount, ctx.Body, canRetry)
+		relay.RecordRelayAttempt(c, &selectedAccount, result, startTime)
+
+		if result == nil || !result.Retryable {
+			if result != nil && result.StatusCode >= http.StatusOK && result.StatusCode < http.StatusMultipleChoices {
+				service.BindStickySession(ctx.APIKey.GroupID, ctx.SessionHash, selectedAccount.ID)
+			} else if result != nil && result.StatusCode >= http.StatusBadRequest {
+				// 成功请求的日志由中转处理函数记录，失败请求在这里统一记录错误详情
+				relay.SaveFailedRequestLog(c, &selectedAccount, result, requestStartTime, ctx.ModelName)
+			}
+			return
+		}
+	}
+}
 
-	// 根据平台类型路由到不同的处理器
-	switch selectedAccount.PlatformType {
+// ChatCompletions OpenAI 兼容的对话接口，请求转换为 Claude 格式后走同一账号池，响应再转换回 OpenAI 格式
+func ChatCompletions(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, relay.OpenAIError("Failed to read request body: "+err.Error(), "invalid_request_error", nil))
+		return
+	}
+
+	claudeBody, chatReq, err := relay.ConvertOpenAIChatToClaude(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, relay.OpenAIError("Invalid chat completions request: "+err.Error(), "invalid_request_error", nil))
+		return
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(claudeBody))
+
+	writer := relay.NewOpenAIChatResponseWriter(c.Writer, chatReq)
+	c.Writer = writer
+	GetMessages(c)
+	writer.Finish()
+}
+
+// relayToAccount 根据平台类型将请求路由到对应的处理器
+func relayToAccount(c *gin.Context, account *model.Account, body []byte, canRetry bool) *relay.RelayResult {
+	// 记录账号进行中的请求数，供最少连接策略使用
+	release := service.AcquireAccountConnection(account.ID)
+	defer release()
+	defer relay.TrackStreamInFlight(c, account)()
+
+	switch account.PlatformType {
 	case constant.PlatformClaude:
-		relay.HandleClaudeRequest(c, &selectedAccount, ctx.Body)
+		return relay.HandleClaudeRequest(c, account, body, canRetry)
 	case constant.PlatformClaudeConsole:
-		relay.HandleClaudeConsoleRequest(c, &selectedAccount, ctx.Body)
+		return relay.HandleClaudeConsoleRequest(c, account, body, canRetry)
 	case constant.PlatformOpenAI:
-		relay.HandleOpenAIRequest(c, &selectedAccount, ctx.Body)
+		return relay.HandleOpenAIRequest(c, account, body, canRetry)
+	case constant.PlatformGemini:
+		return relay.HandleGeminiRequest(c, account, body, canRetry)
 	default:
+		if canRetry {
+			return &relay.RelayResult{
+				StatusCode: http.StatusBadRequest,
+				Retryable:  true,
+				Error:      "unsupported platform type: " + account.PlatformType,
+			}
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "不支持的平台类型: " + selectedAccount.PlatformType,
+			"message": "不支持的平台类型: " + account.PlatformType,
 			"code":    constant.InvalidParams,
 		})
+		return nil
 	}
 }
 
@@ -260,6 +377,8 @@ func executeAccountTest(account *model.Account) TestAccountResponse {
 		statusCode, errorMsg = relay.TestHandleClaudeConsoleRequest(account)
 	case constant.PlatformOpenAI:
 		statusCode, errorMsg = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, errorMsg = relay.TestHandleGeminiRequest(account)
 	default:
 		return TestAccountResponse{
 			Success:      false,
@@ -285,50 +404,17 @@ func executeAccountTest(account *model.Account) TestAccountResponse {
 }
 
 // filterAccountsByModelPermission 根据模型权限过滤账号列表
+// 模型限制支持通配符、正则和 ! 排除规则，规则写法见 common.MatchModelPattern
 func filterAccountsByModelPermission(accounts []model.Account, apiKey *model.ApiKey, modelName string) []model.Account {
-	// 首先检查API Key的模型限制（优先级最高）
-	if apiKey.ModelRestriction != "" {
-		// 解析API Key允许的模型列表
-		allowedModels := strings.Split(apiKey.ModelRestriction, ",")
-
-		// 检查当前模型是否在API Key允许列表中
-		isModelAllowed := false
-		for _, allowedModel := range allowedModels {
-			if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
-				isModelAllowed = true
-				break
-			}
-		}
-
-		// 如果API Key不允许此模型，直接返回空列表
-		if !isModelAllowed {
-			return []model.Account{}
-		}
+	// 首先检查API Key的模型限制（优先级最高），不允许此模型时直接返回空列表
+	if !common.IsModelAllowed(apiKey.ModelRestriction, modelName) {
+		return []model.Account{}
 	}
 
 	// API Key允许此模型或没有限制，继续检查账号级别的模型限制
 	var filteredAccounts []model.Account
 	for _, account := range accounts {
-		// 如果账号没有模型限制，直接加入列表
-		if account.ModelRestriction == "" {
-			filteredAccounts = append(filteredAccounts, account)
-			continue
-		}
-
-		// 解析账号允许的模型列表
-		accountAllowedModels := strings.Split(account.ModelRestriction, ",")
-
-		// 检查当前模型是否在账号允许列表中
-		isAccountModelAllowed := false
-		for _, allowedModel := range accountAllowedModels {
-			if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
-				isAccountModelAllowed = true
-				break
-			}
-		}
-
-		// 如果账号允许此模型，加入列表
-		if isAccountModelAllowed {
+		if common.IsModelAllowed(account.ModelRestriction, modelName) {
 			filteredAccounts = append(filteredAccounts, account)
 		}
 	}
@@ -25,6 +25,13 @@ type LogQueryRequest struct {
 	EndTime   string   `form:"end_time"`   // 结束时间 格式: 2024-01-01 15:04:05
 	MinCost   *float64 `form:"min_cost"`   // 最小费用筛选
 	MaxCost   *float64 `form:"max_cost"`   // 最大费用筛选
+
+	StatusCode        *int   `form:"status_code"`         // 状态码筛选
+	OnlyErrors        bool   `form:"only_errors"`         // 只看失败请求
+	ErrorType         string `form:"error_type"`          // 错误类型筛选
+	UpstreamRequestID string `form:"upstream_request_id"` // 上游request-id筛选
+	ClientIP          string `form:"client_ip"`           // 客户端IP筛选
+	UsedPreviousKey   *bool  `form:"used_previous_key"`   // 是否使用轮换前的旧密钥筛选
 }
 
 // GetLogs 获取日志列表（支持多种筛选条件）
@@ -89,6 +96,12 @@ func GetLogById(c *gin.Context) {
 		return
 	}
 
+	// 抓取的请求/响应内容只对日志所属用户和管理员可见
+	user := c.MustGet("user").(*model.User)
+	if log.UserID == user.ID || user.Role == "admin" {
+		log.Capture = logService.GetLogCapture(log.ID)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "获取日志详情成功",
 		"code":    constant.Success,
@@ -436,5 +449,28 @@ func buildLogFilters(req *LogQueryRequest) *model.LogFilters {
 		filters.MaxCost = req.MaxCost
 	}
 
+	// 状态码及错误筛选
+	if req.StatusCode != nil {
+		filters.StatusCode = req.StatusCode
+	}
+
+	filters.OnlyErrors = req.OnlyErrors
+
+	if req.ErrorType != "" {
+		filters.ErrorType = &req.ErrorType
+	}
+
+	if req.UpstreamRequestID != "" {
+		filters.UpstreamRequestID = &req.UpstreamRequestID
+	}
+
+	if req.ClientIP != "" {
+		filters.ClientIP = &req.ClientIP
+	}
+
+	if req.UsedPreviousKey != nil {
+		filters.UsedPreviousKey = req.UsedPreviousKey
+	}
+
 	return filters
 }
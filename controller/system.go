@@ -1,11 +1,16 @@
 package controller
 
 import (
+	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/scheduled"
+	"claude-code-relay/service"
+	"crypto/subtle"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,6 +26,28 @@ func GetStatus(c *gin.Context) {
 	})
 }
 
+// GetMetrics 以Prometheus文本格式输出监控指标
+// 需要配置 METRICS_TOKEN，只能通过 Authorization: Bearer <token> 访问，避免令牌出现在访问日志中，未配置时接口不可用
+func GetMetrics(c *gin.Context) {
+	token := os.Getenv("METRICS_TOKEN")
+	if token == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if err := service.RefreshAccountStatusMetrics(); err != nil {
+		common.SysError("Failed to refresh account status metrics: " + err.Error())
+	}
+
+	common.MetricsHandler.ServeHTTP(c.Writer, c.Request)
+}
+
 func GetApiLogs(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
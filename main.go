@@ -6,6 +6,7 @@ import (
 	"claude-code-relay/model"
 	"claude-code-relay/router"
 	"claude-code-relay/scheduled"
+	"claude-code-relay/service"
 	"embed"
 	"fmt"
 	"io/fs"
@@ -43,6 +44,11 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// 加载账号密钥加密的主密钥
+	if err := common.InitSecretEncryption(); err != nil {
+		common.FatalLog("failed to load account encryption keys: " + err.Error())
+	}
+
 	// 初始化数据库
 	err = model.InitDB()
 	if err != nil {
@@ -60,6 +66,15 @@ func main() {
 		common.FatalLog("failed to initialize Redis: " + err.Error())
 	}
 
+	// 分配日志ID的机器号，需在Redis初始化之后
+	model.InitLogMachineID()
+
+	// 初始化链路追踪
+	common.InitTracing()
+
+	// 启动请求日志异步写入器
+	service.StartLogWriter()
+
 	// 初始化定时任务服务
 	scheduled.InitCronService()
 	defer scheduled.StopCronService()
@@ -76,6 +91,16 @@ func main() {
 		})
 	}))
 
+	// 配置可信代理，只采用这些代理传入的X-Forwarded-For作为客户端IP，API Key的IP白名单依赖客户端IP
+	// 未配置时不信任任何代理，客户端IP取连接的对端地址，设置了IP白名单的API Key不可使用
+	if trustedProxies := service.TrustedProxies(); len(trustedProxies) > 0 {
+		if err := server.SetTrustedProxies(trustedProxies); err != nil {
+			common.FatalLog("invalid TRUSTED_PROXIES: " + err.Error())
+		}
+	} else if err := server.SetTrustedProxies(nil); err != nil {
+		common.FatalLog("failed to disable trusted proxies: " + err.Error())
+	}
+
 	// 请求ID中间件
 	server.Use(middleware.RequestId())
 
@@ -119,5 +144,11 @@ func main() {
 	// 停止定时任务服务
 	scheduled.StopCronService()
 
+	// 将队列中剩余的请求日志写入数据库
+	service.StopLogWriter(10 * time.Second)
+
+	// 导出剩余的链路数据
+	common.StopTracing(5 * time.Second)
+
 	common.SysLog("Server stopped gracefully")
 }
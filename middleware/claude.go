@@ -1,11 +1,20 @@
 package middleware
 
 import (
+	"bytes"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
+	"claude-code-relay/relay"
+	"claude-code-relay/service"
+	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
 )
 
 // SystemMessage 系统消息结构体
@@ -25,32 +34,29 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 		// 从多个可能的请求头中获取API Key
 		apiKey := getApiKeyFromHeaders(c)
 		if apiKey == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
+			abortWithError(c, http.StatusUnauthorized, gin.H{
 				"error": "缺少API Key",
 				"code":  40001,
 			})
-			c.Abort()
 			return
 		}
 
 		// 从数据库查询API Key
 		keyInfo, err := model.GetApiKeyByKey(apiKey)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
+			abortWithError(c, http.StatusUnauthorized, gin.H{
 				"error": "无效的API Key",
 				"code":  40001,
 			})
-			c.Abort()
 			return
 		}
 
 		// 判断是否达到每日限额
 		if keyInfo.DailyLimit > 0 && keyInfo.TodayTotalCost >= keyInfo.DailyLimit {
-			c.JSON(http.StatusTooManyRequests, gin.H{
+			abortWithError(c, http.StatusTooManyRequests, gin.H{
 				"error": "API Key已达到每日使用限额",
 				"code":  40004,
 			})
-			c.Abort()
 			return
 		}
 
@@ -58,15 +64,55 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 		if keyInfo.GroupID > 0 {
 			status := model.GetGroupStatus(keyInfo.GroupID)
 			if status != 1 {
-				c.JSON(http.StatusForbidden, gin.H{
+				abortWithError(c, http.StatusForbidden, gin.H{
 					"error": "API Key所属分组不可用",
 					"code":  40005,
 				})
-				c.Abort()
 				return
 			}
 		}
 
+		// 检查API Key允许调用的接口、来源IP和客户端
+		if scopeErr := service.CheckApiKeyAccess(keyInfo, service.RelayEndpointName(c.FullPath()), c.ClientIP(), c.GetHeader("User-Agent")); scopeErr != nil {
+			abortWithError(c, scopeErr.StatusCode, scopeErr.Response())
+			return
+		}
+
+		// 判断API Key及所属分组是否超出周/月/总预算
+		if reason := service.CheckSpendBudget(keyInfo); reason != "" {
+			abortWithError(c, http.StatusTooManyRequests, gin.H{
+				"error": reason,
+				"code":  40004,
+			})
+			return
+		}
+
+		// 检查每分钟请求数和tokens限制
+		rateLimit := service.CheckApiKeyRateLimit(keyInfo)
+		setRateLimitHeaders(c, rateLimit)
+		if !rateLimit.Allowed {
+			c.Header("retry-after", strconv.Itoa(rateLimit.RetryAfter))
+			abortWithError(c, http.StatusTooManyRequests, gin.H{
+				"error": rateLimit.Reason,
+				"code":  constant.TooManyRequests,
+			})
+			return
+		}
+
+		// 检查进行中的流式请求数，非流式请求不占用名额
+		if keyInfo.MaxConcurrency > 0 && isStreamRequest(c) {
+			release, ok := service.AcquireApiKeyConcurrency(keyInfo)
+			if !ok {
+				c.Header("retry-after", "1")
+				abortWithError(c, http.StatusTooManyRequests, gin.H{
+					"error": "API Key并发流式请求数超过限制",
+					"code":  constant.TooManyRequests,
+				})
+				return
+			}
+			defer release()
+		}
+
 		// API Key已经在model层验证了状态和过期时间
 		// 将API Key信息存储到上下文中供后续使用
 		c.Set("api_key_id", keyInfo.ID)
@@ -74,10 +120,52 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 		c.Set("user_id", keyInfo.UserID)
 		c.Set("group_id", keyInfo.GroupID)
 
+		// 使用轮换前的旧密钥时记录调用方，便于找出仍未切换到新密钥的客户端
+		if keyInfo.UsedPreviousKey {
+			go service.RecordPreviousApiKeyUsage(keyInfo, c.ClientIP(), c.GetHeader("User-Agent"))
+		}
+
 		c.Next()
 	}
 }
 
+// setRateLimitHeaders 设置 Anthropic 风格的限流响应头（未配置的限制不返回）
+func setRateLimitHeaders(c *gin.Context, rateLimit *service.ApiKeyRateLimitResult) {
+	reset := rateLimit.Reset.UTC().Format(time.RFC3339)
+
+	if rateLimit.RequestsLimit > 0 {
+		c.Header("anthropic-ratelimit-requests-limit", strconv.Itoa(rateLimit.RequestsLimit))
+		c.Header("anthropic-ratelimit-requests-remaining", strconv.Itoa(rateLimit.RequestsRemaining))
+		c.Header("anthropic-ratelimit-requests-reset", reset)
+	}
+	if rateLimit.TokensLimit > 0 {
+		c.Header("anthropic-ratelimit-tokens-limit", strconv.Itoa(rateLimit.TokensLimit))
+		c.Header("anthropic-ratelimit-tokens-remaining", strconv.Itoa(rateLimit.TokensRemaining))
+		c.Header("anthropic-ratelimit-tokens-reset", reset)
+	}
+}
+
+// isStreamRequest 判断请求体是否要求流式响应，读取后放回请求体供后续处理
+func isStreamRequest(c *gin.Context) bool {
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return gjson.GetBytes(body, "stream").Bool()
+}
+
+// abortWithError 返回错误响应并终止请求，OpenAI兼容接口返回OpenAI格式的错误
+func abortWithError(c *gin.Context, statusCode int, body interface{}) {
+	if service.RelayEndpointName(c.FullPath()) == service.ApiKeyEndpointChatCompletions {
+		data, _ := json.Marshal(body)
+		c.Data(statusCode, "application/json", relay.ConvertErrorToOpenAI(statusCode, data))
+	} else {
+		c.JSON(statusCode, body)
+	}
+	c.Abort()
+}
+
 // getApiKeyFromHeaders 从多个可能的请求头中提取API Key
 func getApiKeyFromHeaders(c *gin.Context) string {
 	// 1. 检查 X-API-Key
@@ -2,8 +2,13 @@ package middleware
 
 import (
 	"claude-code-relay/common"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func RequestId() gin.HandlerFunc {
@@ -14,6 +19,29 @@ func RequestId() gin.HandlerFunc {
 		}
 		c.Set("request_id", requestID)
 		c.Header("X-Request-ID", requestID)
+
+		// 创建请求的根span，请求头带有W3C traceparent时沿用上游的trace
+		ctx := propagation.TraceContext{}.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := common.Tracer().Start(ctx, c.Request.Method+" "+c.Request.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		c.Request = c.Request.WithContext(ctx)
+		if span.IsRecording() {
+			c.Header("X-Trace-ID", span.SpanContext().TraceID().String())
+		}
+		span.SetAttributes(
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.target", c.Request.URL.Path),
+			attribute.String("request_id", requestID),
+		)
+
 		c.Next()
+
+		if route := c.FullPath(); route != "" {
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		span.SetAttributes(attribute.Int("http.status_code", c.Writer.Status()))
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(c.Writer.Status()))
+		}
+		span.End()
 	}
 }
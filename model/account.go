@@ -1,18 +1,22 @@
 package model
 
 import (
+	"claude-code-relay/common"
 	"gorm.io/gorm"
 	"time"
 )
 
+// AccountStatusRefreshFailed 账号当前状态：OAuth token已过期且刷新失败，需要重新授权或更新refresh token
+const AccountStatusRefreshFailed = 4
+
 type Account struct {
 	ID                            uint           `json:"id" gorm:"primaryKey"`
 	Name                          string         `json:"name" gorm:"type:varchar(100);not null;comment:账号名称"`
 	PlatformType                  string         `json:"platform_type" gorm:"type:varchar(50);not null;comment:平台类型(claude/claude_console)"`
 	RequestURL                    string         `json:"request_url" gorm:"type:varchar(500);comment:请求地址"`
-	SecretKey                     string         `json:"secret_key" gorm:"type:text;comment:请求秘钥"`
-	AccessToken                   string         `json:"access_token" gorm:"type:text;comment:claude的官方token"`
-	RefreshToken                  string         `json:"refresh_token" gorm:"type:text;comment:claude的官方刷新token"`
+	SecretKey                     string         `json:"secret_key" gorm:"type:text;serializer:secret;comment:请求秘钥"`
+	AccessToken                   string         `json:"access_token" gorm:"type:text;serializer:secret;comment:claude的官方token"`
+	RefreshToken                  string         `json:"refresh_token" gorm:"type:text;serializer:secret;comment:claude的官方刷新token"`
 	ExpiresAt                     int            `json:"expires_at" gorm:"default:0;comment:token过期时间戳"`
 	IsMax                         bool           `json:"is_max" gorm:"default:false;comment:是否是max账号"`
 	GroupID                       int            `json:"group_id" gorm:"default:0;comment:分组ID"`
@@ -28,9 +32,10 @@ type Account struct {
 	ProxyURI                      string         `json:"proxy_uri" gorm:"type:varchar(500);comment:代理URI字符串"`
 	ModelMapping                  string         `json:"model_mapping" gorm:"type:text;comment:模型映射配置(格式:claude-model:openai-model,多个用逗号分隔)"`
 	ModelRestriction              string         `json:"model_restriction" gorm:"type:text;comment:模型限制(允许使用的模型列表,逗号分隔,空值表示无限制)"`
+	OpenAIApiType                 string         `json:"openai_api_type" gorm:"column:openai_api_type;type:varchar(30);default:'chat_completions';comment:OpenAI接口类型(chat_completions/responses)"`
 	LastUsedTime                  *Time          `json:"last_used_time" gorm:"comment:最后使用时间;type:datetime"`
 	RateLimitEndTime              *Time          `json:"rate_limit_end_time" gorm:"comment:限流结束时间;type:datetime"`
-	CurrentStatus                 int            `json:"current_status" gorm:"default:1;comment:当前状态(1:正常,2:接口异常,3:账号异常/限流)"`
+	CurrentStatus                 int            `json:"current_status" gorm:"default:1;comment:当前状态(1:正常,2:接口异常,3:账号异常/限流,4:token刷新失败)"`
 	ActiveStatus                  int            `json:"active_status" gorm:"default:1;comment:激活状态(1:激活,2:禁用)"`
 	UserID                        uint           `json:"user_id" gorm:"not null;comment:所属用户ID"`
 	CreatedAt                     Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
@@ -74,6 +79,7 @@ type CreateAccountRequest struct {
 	ProxyURI         string `json:"proxy_uri"`
 	ModelMapping     string `json:"model_mapping"`
 	ModelRestriction string `json:"model_restriction"`
+	OpenAIApiType    string `json:"openai_api_type" binding:"omitempty,oneof=chat_completions responses"` // OpenAI接口类型
 	ActiveStatus     int    `json:"active_status" binding:"oneof=1 2"`
 	IsMax            bool   `json:"is_max"` // 是否是max账号
 	AccessToken      string `json:"access_token"`
@@ -95,6 +101,7 @@ type UpdateAccountRequest struct {
 	ProxyURI         string `json:"proxy_uri"`
 	ModelMapping     string `json:"model_mapping"`
 	ModelRestriction string `json:"model_restriction"`
+	OpenAIApiType    string `json:"openai_api_type" binding:"omitempty,oneof=chat_completions responses"` // OpenAI接口类型
 	ActiveStatus     int    `json:"active_status" binding:"oneof=1 2"`
 	IsMax            bool   `json:"is_max"` // 是否是max账号
 	AccessToken      string `json:"access_token"`
@@ -141,9 +148,93 @@ func GetAccountByID(id uint) (*Account, error) {
 	return &account, nil
 }
 
-// 更新账号
+// accountRuntimeColumns 由请求处理、token刷新和定时任务单独更新的字段，保存账号配置时不能覆盖
+// 密钥和token通过 UpdateAccountSecretKey、UpdateAccountOAuthTokens 写入
+var accountRuntimeColumns = []string{
+	"today_usage_count",
+	"today_input_tokens",
+	"today_output_tokens",
+	"today_cache_read_input_tokens",
+	"today_cache_creation_input_tokens",
+	"today_total_cost",
+	"last_used_time",
+	"current_status",
+	"rate_limit_end_time",
+	"secret_key",
+	"access_token",
+	"refresh_token",
+	"expires_at",
+}
+
+// 更新账号配置，不覆盖使用统计、运行状态、密钥和token
 func UpdateAccount(account *Account) error {
-	return DB.Save(account).Error
+	return DB.Omit(accountRuntimeColumns...).Save(account).Error
+}
+
+// UpdateAccountRateLimit 只更新账号的限流状态和限流结束时间
+func UpdateAccountRateLimit(id uint, currentStatus int, rateLimitEndTime *Time) error {
+	return DB.Model(&Account{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"current_status":      currentStatus,
+		"rate_limit_end_time": rateLimitEndTime,
+	}).Error
+}
+
+// ClearAccountRateLimit 账号仍处于限流状态时恢复为正常，已被管理员或其他请求修改状态时不做处理
+func ClearAccountRateLimit(id uint, rateLimitStatus, activeStatus int) error {
+	return DB.Model(&Account{}).Where("id = ? AND current_status = ?", id, rateLimitStatus).Updates(map[string]interface{}{
+		"current_status":      activeStatus,
+		"rate_limit_end_time": nil,
+	}).Error
+}
+
+// UpdateAccountTodayUsageCount 只更新账号的今日使用次数，用于调整账号在调度中的顺序
+func UpdateAccountTodayUsageCount(id uint, todayUsageCount int) error {
+	return DB.Model(&Account{}).Where("id = ?", id).Update("today_usage_count", todayUsageCount).Error
+}
+
+// UpdateAccountSecretKey 只更新账号的请求秘钥
+func UpdateAccountSecretKey(id uint, secretKey string) error {
+	encryptedSecretKey, err := common.EncryptSecret(secretKey)
+	if err != nil {
+		return err
+	}
+	return DB.Model(&Account{}).Where("id = ?", id).Update("secret_key", encryptedSecretKey).Error
+}
+
+// UpdateAccountOAuthTokens 只更新账号的OAuth token字段，刷新失败状态的账号同时恢复为正常
+// accessToken、refreshToken为空时保留原值，expiresAt为0时保留原过期时间
+func UpdateAccountOAuthTokens(id uint, accessToken, refreshToken string, expiresAt int) error {
+	updates := map[string]interface{}{
+		"current_status": gorm.Expr("CASE WHEN current_status = ? THEN ? ELSE current_status END", AccountStatusRefreshFailed, 1),
+	}
+	if accessToken != "" {
+		encryptedAccessToken, err := common.EncryptSecret(accessToken)
+		if err != nil {
+			return err
+		}
+		updates["access_token"] = encryptedAccessToken
+	}
+	if expiresAt > 0 {
+		updates["expires_at"] = expiresAt
+	}
+	if refreshToken != "" {
+		encryptedRefreshToken, err := common.EncryptSecret(refreshToken)
+		if err != nil {
+			return err
+		}
+		updates["refresh_token"] = encryptedRefreshToken
+	}
+	return DB.Model(&Account{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// GetAccountOAuthTokens 读取账号最新的OAuth token字段，用于刷新前确认token是否已被其他请求刷新
+func GetAccountOAuthTokens(id uint) (*Account, error) {
+	var account Account
+	err := DB.Select("id", "access_token", "refresh_token", "expires_at", "current_status").First(&account, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
 }
 
 // 删除账号（软删除）
@@ -287,6 +378,7 @@ func setWeeklyStatsForAccounts(accounts []Account) error {
 
 	var weeklyStats []WeeklyStats
 	err := DB.Table("logs").
+		Scopes(successfulLogs).
 		Select("account_id, SUM(total_cost) as total_cost, COUNT(*) as total_count").
 		Where("account_id IN ? AND created_at >= ? AND created_at <= ?", accountIDs, weekStart, now).
 		Group("account_id").
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+func init() {
+	schema.RegisterSerializer("secret", SecretSerializer{})
+}
+
+// SecretSerializer 账号密钥字段的GORM序列化器，写入时加密，读取时解密
+// 注意：map形式的Updates/Update不经过序列化器，需自行调用 common.EncryptSecret
+type SecretSerializer struct{}
+
+// Scan 读取时解密，兼容未加密的历史明文
+func (SecretSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("unsupported secret value type %T", dbValue)
+	}
+
+	plaintext, err := common.DecryptSecret(value)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+// Value 写入时使用当前主密钥加密
+func (SecretSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, _ := fieldValue.(string)
+	return common.EncryptSecret(plaintext)
+}
+
+// MarshalJSON 序列化时脱敏账号密钥，完整密钥只能由账号所属用户通过 RevealAccountSecrets 接口查看
+func (a Account) MarshalJSON() ([]byte, error) {
+	type accountJSON Account
+	redacted := accountJSON(a)
+	redacted.SecretKey = common.MaskSecret(a.SecretKey)
+	redacted.AccessToken = common.MaskSecret(a.AccessToken)
+	redacted.RefreshToken = common.MaskSecret(a.RefreshToken)
+	return json.Marshal(redacted)
+}
+
+// accountSecretRow 账号密钥字段在数据库中的原始值
+type accountSecretRow struct {
+	ID           uint
+	SecretKey    string
+	AccessToken  string
+	RefreshToken string
+}
+
+// ReencryptAccountSecrets 使用当前主密钥重新加密所有账号的密钥，返回更新的账号数
+// 用于开启加密后加密历史明文，以及主密钥轮换后迁移到新密钥，可重复执行
+func ReencryptAccountSecrets() (int, error) {
+	const batchSize = 100
+
+	updatedCount := 0
+	var lastID uint
+	for {
+		var rows []accountSecretRow
+		err := DB.Table("accounts").Select("id", "secret_key", "access_token", "refresh_token").
+			Where("id > ?", lastID).Order("id").Limit(batchSize).Scan(&rows).Error
+		if err != nil {
+			return updatedCount, err
+		}
+		if len(rows) == 0 {
+			return updatedCount, nil
+		}
+
+		for _, row := range rows {
+			lastID = row.ID
+
+			updates := make(map[string]interface{})
+			columns := map[string]string{
+				"secret_key":    row.SecretKey,
+				"access_token":  row.AccessToken,
+				"refresh_token": row.RefreshToken,
+			}
+			for column, value := range columns {
+				if !common.SecretNeedsReencryption(value) {
+					continue
+				}
+				plaintext, err := common.DecryptSecret(value)
+				if err != nil {
+					return updatedCount, fmt.Errorf("账号 %d 的 %s 解密失败: %v", row.ID, column, err)
+				}
+				encrypted, err := common.EncryptSecret(plaintext)
+				if err != nil {
+					return updatedCount, err
+				}
+				updates[column] = encrypted
+			}
+
+			if len(updates) == 0 {
+				continue
+			}
+			if err := DB.Table("accounts").Where("id = ?", row.ID).Updates(updates).Error; err != nil {
+				return updatedCount, err
+			}
+			updatedCount++
+		}
+	}
+}
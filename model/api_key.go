@@ -4,8 +4,12 @@ import (
 	"claude-code-relay/common"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,7 +18,17 @@ import (
 type ApiKey struct {
 	ID                            uint           `json:"id" gorm:"primaryKey"`
 	Name                          string         `json:"name" gorm:"type:varchar(100);not null"`
-	Key                           string         `json:"key" gorm:"type:varchar(100);uniqueIndex;not null"`
+	Key                           string         `json:"key,omitempty" gorm:"-"` // 完整密钥，只在创建时返回一次，不存储
+	KeyHash                       string         `json:"-" gorm:"type:char(64);uniqueIndex;not null;comment:API Key的SHA-256哈希"`
+	KeyPrefix                     string         `json:"key_prefix" gorm:"type:varchar(20);comment:API Key显示前缀"`
+	PreviousKeyHash               string         `json:"-" gorm:"type:char(64);index;comment:轮换前旧密钥的SHA-256哈希"`
+	PreviousKeyPrefix             string         `json:"previous_key_prefix" gorm:"type:varchar(20);comment:轮换前旧密钥显示前缀"`
+	PreviousKeyExpiresAt          *Time          `json:"previous_key_expires_at" gorm:"type:datetime;comment:旧密钥宽限期截止时间"`
+	PreviousKeyUsageCount         int            `json:"previous_key_usage_count" gorm:"default:0;comment:轮换后旧密钥的使用次数"`
+	PreviousKeyLastUsedAt         *Time          `json:"previous_key_last_used_at" gorm:"type:datetime;comment:旧密钥最后使用时间"`
+	PreviousKeyLastIP             string         `json:"previous_key_last_ip" gorm:"type:varchar(64);comment:最后使用旧密钥的客户端IP"`
+	PreviousKeyLastUserAgent      string         `json:"previous_key_last_user_agent" gorm:"type:varchar(255);comment:最后使用旧密钥的User-Agent"`
+	RotatedAt                     *Time          `json:"rotated_at" gorm:"type:datetime;comment:最近一次轮换时间"`
 	ExpiresAt                     *Time          `json:"expires_at" gorm:"type:datetime"`
 	Status                        int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
 	GroupID                       int            `json:"group_id" gorm:"default:0;index"`
@@ -26,7 +40,20 @@ type ApiKey struct {
 	TodayCacheCreationInputTokens int            `json:"today_cache_creation_input_tokens" gorm:"default:0;comment:今日缓存创建输入tokens"`
 	TodayTotalCost                float64        `json:"today_total_cost" gorm:"default:0;comment:今日使用总费用(USD)"`
 	ModelRestriction              string         `json:"model_restriction" gorm:"type:text;comment:模型限制,逗号分隔"`
+	AllowedEndpoints              string         `json:"allowed_endpoints" gorm:"type:text;comment:允许调用的接口,逗号分隔,为空表示不限制"`
+	AllowedIPs                    string         `json:"allowed_ips" gorm:"type:text;comment:允许的来源IP或CIDR,逗号分隔,为空表示不限制"`
+	AllowedUserAgents             string         `json:"allowed_user_agents" gorm:"type:text;comment:允许的User-Agent前缀,逗号分隔,为空表示不限制"`
+	MaxTokensLimit                int            `json:"max_tokens_limit" gorm:"default:0;comment:单次请求max_tokens上限,0表示不限制"`
+	MaxContextTokens              int            `json:"max_context_tokens" gorm:"default:0;comment:单次请求上下文tokens上限(本地估算),0表示不限制"`
 	DailyLimit                    float64        `json:"daily_limit" gorm:"default:0;comment:日限额(美元),0表示不限制"`
+	RpmLimit                      int            `json:"rpm_limit" gorm:"default:0;comment:每分钟请求数限制,0表示不限制"`
+	TpmLimit                      int            `json:"tpm_limit" gorm:"default:0;comment:每分钟输入+输出tokens限制,0表示不限制"`
+	MaxConcurrency                int            `json:"max_concurrency" gorm:"default:0;comment:最大并发流式请求数,0表示不限制"`
+	WeeklyBudget                  float64        `json:"weekly_budget" gorm:"default:0;comment:最近7天预算(美元),0表示不限制"`
+	MonthlyBudget                 float64        `json:"monthly_budget" gorm:"default:0;comment:最近30天预算(美元),0表示不限制"`
+	TotalBudget                   float64        `json:"total_budget" gorm:"default:0;comment:总预算(美元),0表示不限制"`
+	TotalCost                     float64        `json:"total_cost" gorm:"default:0;comment:累计使用总费用(USD)"`
+	CaptureBodies                 bool           `json:"capture_bodies" gorm:"default:false;comment:是否抓取请求/响应内容"`
 	LastUsedTime                  *Time          `json:"last_used_time" gorm:"comment:最后使用时间;type:datetime"`
 	CreatedAt                     Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
 	UpdatedAt                     Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
@@ -37,25 +64,52 @@ type ApiKey struct {
 	// 最近一周统计数据（不存储到数据库，运行时计算）
 	WeeklyCost  float64 `json:"weekly_cost" gorm:"-"`  // 最近一周使用费用
 	WeeklyCount int64   `json:"weekly_count" gorm:"-"` // 最近一周使用次数
+
+	// 本次请求是否使用了轮换前的旧密钥（不存储到数据库，鉴权时设置）
+	UsedPreviousKey bool `json:"-" gorm:"-"`
 }
 
 type CreateApiKeyRequest struct {
-	Name             string  `json:"name" binding:"required"`
-	Key              string  `json:"key"`
-	ExpiresAt        *Time   `json:"expires_at"`
-	Status           int     `json:"status" binding:"oneof=1 2"`
-	GroupID          int     `json:"group_id"`
-	ModelRestriction string  `json:"model_restriction"`
-	DailyLimit       float64 `json:"daily_limit"`
+	Name              string  `json:"name" binding:"required"`
+	Key               string  `json:"key"`
+	ExpiresAt         *Time   `json:"expires_at"`
+	Status            int     `json:"status" binding:"oneof=1 2"`
+	GroupID           int     `json:"group_id"`
+	ModelRestriction  string  `json:"model_restriction"`
+	DailyLimit        float64 `json:"daily_limit"`
+	AllowedEndpoints  string  `json:"allowed_endpoints"`
+	AllowedIPs        string  `json:"allowed_ips"`
+	AllowedUserAgents string  `json:"allowed_user_agents"`
+	MaxTokensLimit    int     `json:"max_tokens_limit" binding:"min=0"`
+	MaxContextTokens  int     `json:"max_context_tokens" binding:"min=0"`
+	RpmLimit          int     `json:"rpm_limit" binding:"min=0"`
+	TpmLimit          int     `json:"tpm_limit" binding:"min=0"`
+	MaxConcurrency    int     `json:"max_concurrency" binding:"min=0"`
+	WeeklyBudget      float64 `json:"weekly_budget" binding:"min=0"`
+	MonthlyBudget     float64 `json:"monthly_budget" binding:"min=0"`
+	TotalBudget       float64 `json:"total_budget" binding:"min=0"`
+	CaptureBodies     bool    `json:"capture_bodies"`
 }
 
 type UpdateApiKeyRequest struct {
-	Name             string   `json:"name"`
-	ExpiresAt        *Time    `json:"expires_at"`
-	Status           *int     `json:"status"`
-	GroupID          *int     `json:"group_id"`
-	ModelRestriction *string  `json:"model_restriction"`
-	DailyLimit       *float64 `json:"daily_limit"`
+	Name              string   `json:"name"`
+	ExpiresAt         *Time    `json:"expires_at"`
+	Status            *int     `json:"status"`
+	GroupID           *int     `json:"group_id"`
+	ModelRestriction  *string  `json:"model_restriction"`
+	DailyLimit        *float64 `json:"daily_limit"`
+	AllowedEndpoints  *string  `json:"allowed_endpoints"`
+	AllowedIPs        *string  `json:"allowed_ips"`
+	AllowedUserAgents *string  `json:"allowed_user_agents"`
+	MaxTokensLimit    *int     `json:"max_tokens_limit" binding:"omitempty,min=0"`
+	MaxContextTokens  *int     `json:"max_context_tokens" binding:"omitempty,min=0"`
+	RpmLimit          *int     `json:"rpm_limit" binding:"omitempty,min=0"`
+	TpmLimit          *int     `json:"tpm_limit" binding:"omitempty,min=0"`
+	MaxConcurrency    *int     `json:"max_concurrency" binding:"omitempty,min=0"`
+	WeeklyBudget      *float64 `json:"weekly_budget" binding:"omitempty,min=0"`
+	MonthlyBudget     *float64 `json:"monthly_budget" binding:"omitempty,min=0"`
+	TotalBudget       *float64 `json:"total_budget" binding:"omitempty,min=0"`
+	CaptureBodies     *bool    `json:"capture_bodies"`
 }
 
 type ApiKeyListResult struct {
@@ -77,9 +131,22 @@ func (a *ApiKey) BeforeCreate(tx *gorm.DB) error {
 		}
 		a.Key = key
 	}
+	a.KeyHash = HashApiKey(a.Key)
+	a.KeyPrefix = apiKeyDisplayPrefix(a.Key)
 	return nil
 }
 
+// HashApiKey 计算API Key的SHA-256哈希，数据库和缓存中只保存哈希
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyDisplayPrefix 用于列表中识别密钥的前缀，最多8位且不超过密钥长度的一半
+func apiKeyDisplayPrefix(key string) string {
+	return key[:min(8, len(key)/2)]
+}
+
 func generateApiKey() (string, error) {
 	bytes := make([]byte, 30)
 	_, err := rand.Read(bytes)
@@ -112,42 +179,47 @@ func GetApiKeyById(id uint, userID uint) (*ApiKey, error) {
 	return &apiKey, nil
 }
 
-// GetApiKeyByKey 根据API Key获取（带缓存）
+// GetApiKeyByKey 根据API Key获取（带缓存），按密钥哈希查询
+// 轮换后的旧密钥在宽限期内同样有效，返回同一个API Key并设置UsedPreviousKey
 func GetApiKeyByKey(key string) (*ApiKey, error) {
-	// 先尝试从缓存获取
+	keyHash := HashApiKey(key)
+
+	// 先尝试从缓存获取，当前密钥和旧密钥分别缓存
 	if common.RDB != nil {
-		cacheKey := fmt.Sprintf("api_key:%s", key)
-		cachedData, err := common.RDB.Get(context.Background(), cacheKey).Result()
-		if err == nil {
-			var apiKey ApiKey
-			if json.Unmarshal([]byte(cachedData), &apiKey) == nil {
-				// 检查缓存的数据是否过期
-				if apiKey.ExpiresAt != nil && time.Time(*apiKey.ExpiresAt).Before(time.Now()) {
-					// 缓存的数据已过期，删除缓存
-					common.RDB.Del(context.Background(), cacheKey)
-					return nil, gorm.ErrRecordNotFound
-				}
-				return &apiKey, nil
-			}
+		if apiKey, ok := getCachedApiKey(fmt.Sprintf("api_key:%s", keyHash)); ok {
+			return checkApiKeyExpired(apiKey)
+		}
+		if apiKey, ok := getCachedApiKey(fmt.Sprintf("api_key:prev:%s", keyHash)); ok {
+			apiKey.UsedPreviousKey = true
+			return checkApiKeyExpired(apiKey)
 		}
 	}
 
 	// 缓存未命中，从数据库查询
 	var apiKey ApiKey
-	err := DB.Where("`key` = ? AND status = 1", key).First(&apiKey).Error
+	err := DB.Where("status = 1 AND (key_hash = ? OR (previous_key_hash = ? AND previous_key_expires_at > ?))", keyHash, keyHash, time.Now()).
+		First(&apiKey).Error
 	if err != nil {
 		return nil, err
 	}
+	apiKey.UsedPreviousKey = apiKey.KeyHash != keyHash
 
 	// 检查是否过期
-	if apiKey.ExpiresAt != nil && time.Time(*apiKey.ExpiresAt).Before(time.Now()) {
-		return nil, gorm.ErrRecordNotFound
+	if _, err := checkApiKeyExpired(&apiKey); err != nil {
+		return nil, err
 	}
 
 	// 存储到缓存（5分钟）
 	if common.RDB != nil {
-		cacheKey := fmt.Sprintf("api_key:%s", key)
-		cachedData, err := json.Marshal(apiKey)
+		cacheKey := fmt.Sprintf("api_key:%s", keyHash)
+		if apiKey.UsedPreviousKey {
+			cacheKey = fmt.Sprintf("api_key:prev:%s", keyHash)
+		}
+		cachedData, err := json.Marshal(cachedApiKey{
+			ApiKey:          &apiKey,
+			KeyHash:         apiKey.KeyHash,
+			PreviousKeyHash: apiKey.PreviousKeyHash,
+		})
 		if err == nil {
 			common.RDB.Set(context.Background(), cacheKey, cachedData, 5*time.Minute)
 		}
@@ -156,32 +228,165 @@ func GetApiKeyByKey(key string) (*ApiKey, error) {
 	return &apiKey, nil
 }
 
-// GetApiKeyByKeyForUpdate 根据API Key获取（无缓存，专用于统计更新）
-func GetApiKeyByKeyForUpdate(key string) (*ApiKey, error) {
-	var apiKey ApiKey
-	err := DB.Where("`key` = ? AND status = 1", key).First(&apiKey).Error
+// cachedApiKey API Key的缓存内容
+// 密钥哈希在ApiKey中不参与JSON序列化，单独缓存，命中缓存时清理缓存需要用到新旧两个哈希
+type cachedApiKey struct {
+	ApiKey          *ApiKey `json:"api_key"`
+	KeyHash         string  `json:"key_hash"`
+	PreviousKeyHash string  `json:"previous_key_hash"`
+}
+
+// getCachedApiKey 读取缓存的API Key，旧格式的缓存视为未命中
+func getCachedApiKey(cacheKey string) (*ApiKey, bool) {
+	cachedData, err := common.RDB.Get(context.Background(), cacheKey).Result()
 	if err != nil {
-		return nil, err
+		return nil, false
 	}
+	var cached cachedApiKey
+	if json.Unmarshal([]byte(cachedData), &cached) != nil || cached.ApiKey == nil || cached.KeyHash == "" {
+		return nil, false
+	}
+	cached.ApiKey.KeyHash = cached.KeyHash
+	cached.ApiKey.PreviousKeyHash = cached.PreviousKeyHash
+	return cached.ApiKey, true
+}
 
-	// 检查是否过期
-	if apiKey.ExpiresAt != nil && time.Time(*apiKey.ExpiresAt).Before(time.Now()) {
+// checkApiKeyExpired 检查API Key是否过期，使用旧密钥时同时检查宽限期
+func checkApiKeyExpired(apiKey *ApiKey) (*ApiKey, error) {
+	now := time.Now()
+	expired := apiKey.ExpiresAt != nil && time.Time(*apiKey.ExpiresAt).Before(now)
+	if apiKey.UsedPreviousKey {
+		expired = expired || apiKey.PreviousKeyExpiresAt == nil || !time.Time(*apiKey.PreviousKeyExpiresAt).After(now)
+	}
+	if expired {
+		// 缓存的数据已过期，删除缓存
+		ClearApiKeyCache(apiKey)
 		return nil, gorm.ErrRecordNotFound
 	}
+	return apiKey, nil
+}
 
-	return &apiKey, nil
+// ClearApiKeyCache 清理API Key缓存，包括当前密钥和轮换前旧密钥的缓存
+func ClearApiKeyCache(apiKey *ApiKey) {
+	if common.RDB == nil {
+		return
+	}
+
+	cacheKeys := []string{fmt.Sprintf("api_key:%s", apiKey.KeyHash)}
+	if apiKey.PreviousKeyHash != "" {
+		cacheKeys = append(cacheKeys,
+			fmt.Sprintf("api_key:%s", apiKey.PreviousKeyHash),
+			fmt.Sprintf("api_key:prev:%s", apiKey.PreviousKeyHash))
+	}
+	common.RDB.Del(context.Background(), cacheKeys...)
 }
 
-// ClearApiKeyCache 清理API Key缓存
-func ClearApiKeyCache(key string) {
-	if common.RDB != nil {
-		cacheKey := fmt.Sprintf("api_key:%s", key)
-		common.RDB.Del(context.Background(), cacheKey)
+// RotateApiKey 为API Key生成新密钥，原密钥在grace时间内仍然有效，grace为0时原密钥立即失效
+// 新旧密钥对应同一个API Key，统计、限额和日志均不受影响
+func RotateApiKey(apiKey *ApiKey, grace time.Duration) error {
+	newKey, err := generateApiKey()
+	if err != nil {
+		return err
+	}
+
+	// 清理轮换前的缓存，包括更早一次轮换留下的旧密钥
+	ClearApiKeyCache(apiKey)
+
+	now := Time(time.Now())
+	updates := map[string]interface{}{
+		"key_hash":                     HashApiKey(newKey),
+		"key_prefix":                   apiKeyDisplayPrefix(newKey),
+		"previous_key_hash":            "",
+		"previous_key_prefix":          "",
+		"previous_key_expires_at":      nil,
+		"previous_key_usage_count":     0,
+		"previous_key_last_used_at":    nil,
+		"previous_key_last_ip":         "",
+		"previous_key_last_user_agent": "",
+		"rotated_at":                   &now,
+	}
+	if grace > 0 {
+		expiresAt := Time(time.Now().Add(grace))
+		updates["previous_key_hash"] = apiKey.KeyHash
+		updates["previous_key_prefix"] = apiKey.KeyPrefix
+		updates["previous_key_expires_at"] = &expiresAt
 	}
+
+	if err := DB.Model(&ApiKey{}).Where("id = ?", apiKey.ID).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	apiKey.Key = newKey
+	apiKey.KeyHash = updates["key_hash"].(string)
+	apiKey.KeyPrefix = updates["key_prefix"].(string)
+	apiKey.PreviousKeyHash = updates["previous_key_hash"].(string)
+	apiKey.PreviousKeyPrefix = updates["previous_key_prefix"].(string)
+	apiKey.PreviousKeyExpiresAt, _ = updates["previous_key_expires_at"].(*Time)
+	apiKey.PreviousKeyUsageCount = 0
+	apiKey.PreviousKeyLastUsedAt = nil
+	apiKey.PreviousKeyLastIP = ""
+	apiKey.PreviousKeyLastUserAgent = ""
+	apiKey.RotatedAt = &now
+
+	// 清理轮换期间可能以当前密钥身份写入的原密钥缓存
+	ClearApiKeyCache(apiKey)
+	return nil
+}
+
+// RevokePreviousApiKey 提前结束宽限期，使轮换前的旧密钥立即失效
+func RevokePreviousApiKey(apiKey *ApiKey) error {
+	err := DB.Model(&ApiKey{}).Where("id = ?", apiKey.ID).Updates(map[string]interface{}{
+		"previous_key_hash":       "",
+		"previous_key_expires_at": nil,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	ClearApiKeyCache(apiKey)
+	apiKey.PreviousKeyHash = ""
+	apiKey.PreviousKeyExpiresAt = nil
+	return nil
+}
+
+// RecordPreviousApiKeyUsage 记录旧密钥的使用情况，便于用户找出仍在使用旧密钥的客户端
+func RecordPreviousApiKeyUsage(id uint, clientIP, userAgent string) error {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	return DB.Model(&ApiKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"previous_key_usage_count":     gorm.Expr("previous_key_usage_count + 1"),
+		"previous_key_last_used_at":    Time(time.Now()),
+		"previous_key_last_ip":         clientIP,
+		"previous_key_last_user_agent": userAgent,
+	}).Error
+}
+
+// apiKeyUsageColumns 由IncrementApiKeyUsage原子累加的统计字段及轮换字段，保存配置时不能覆盖
+var apiKeyUsageColumns = []string{
+	"today_usage_count",
+	"today_input_tokens",
+	"today_output_tokens",
+	"today_cache_read_input_tokens",
+	"today_cache_creation_input_tokens",
+	"today_total_cost",
+	"total_cost",
+	"last_used_time",
+	// 轮换相关字段由RotateApiKey、RecordPreviousApiKeyUsage单独更新
+	"key_hash",
+	"key_prefix",
+	"previous_key_hash",
+	"previous_key_prefix",
+	"previous_key_expires_at",
+	"previous_key_usage_count",
+	"previous_key_last_used_at",
+	"previous_key_last_ip",
+	"previous_key_last_user_agent",
+	"rotated_at",
 }
 
 func UpdateApiKey(apiKey *ApiKey) error {
-	err := DB.Save(apiKey).Error
+	err := DB.Omit(apiKeyUsageColumns...).Save(apiKey).Error
 	if err != nil {
 		return err
 	}
@@ -193,7 +398,7 @@ func DeleteApiKey(id uint) error {
 	// 先获取API Key信息用于清理缓存
 	var apiKey ApiKey
 	if err := DB.First(&apiKey, id).Error; err == nil {
-		defer ClearApiKeyCache(apiKey.Key)
+		defer ClearApiKeyCache(&apiKey)
 	}
 
 	return DB.Delete(&ApiKey{}, id).Error
@@ -294,6 +499,7 @@ func setWeeklyStatsForApiKeys(apiKeys []ApiKey) error {
 
 	var weeklyStats []WeeklyStats
 	err := DB.Table("logs").
+		Scopes(successfulLogs).
 		Select("api_key_id, SUM(total_cost) as total_cost, COUNT(*) as total_count").
 		Where("api_key_id IN ? AND created_at >= ? AND created_at <= ?", apiKeyIDs, weekStart, now).
 		Group("api_key_id").
@@ -322,3 +528,74 @@ func setWeeklyStatsForApiKeys(apiKeys []ApiKey) error {
 
 	return nil
 }
+
+// migrateApiKeyHashes 将明文存储的API Key迁移为哈希存储，需在AutoMigrate之前执行
+// 先为已有记录补全key_hash和key_prefix，全部完成后清空明文的key列，中途失败可重复执行。
+// 删除列属于不可逆的表结构变更，默认保留key列，确认后设置 API_KEY_DROP_PLAINTEXT_COLUMN=true 才删除
+func migrateApiKeyHashes() error {
+	migrator := DB.Migrator()
+	if !migrator.HasTable("api_keys") || !migrator.HasColumn("api_keys", "key") {
+		return nil
+	}
+
+	// key_hash先以可空列添加，补全后由AutoMigrate创建唯一索引
+	if !migrator.HasColumn("api_keys", "key_hash") {
+		if err := DB.Exec("ALTER TABLE api_keys ADD COLUMN key_hash char(64) NULL COMMENT 'API Key的SHA-256哈希'").Error; err != nil {
+			return err
+		}
+	}
+	if !migrator.HasColumn("api_keys", "key_prefix") {
+		if err := DB.Exec("ALTER TABLE api_keys ADD COLUMN key_prefix varchar(20) NULL COMMENT 'API Key显示前缀'").Error; err != nil {
+			return err
+		}
+	}
+
+	// 新建的API Key不再写入key列，需允许为空
+	columnTypes, err := migrator.ColumnTypes("api_keys")
+	if err != nil {
+		return err
+	}
+	for _, column := range columnTypes {
+		if nullable, ok := column.Nullable(); column.Name() == "key" && ok && !nullable {
+			if err := DB.Exec("ALTER TABLE api_keys MODIFY COLUMN `key` varchar(100) NULL").Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	type plaintextApiKey struct {
+		ID  uint
+		Key string
+	}
+	var rows []plaintextApiKey
+	err = DB.Table("api_keys").Select("id", "`key`").
+		Where("key_hash IS NULL OR key_hash = ''").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		err := DB.Table("api_keys").Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"key_hash":   HashApiKey(row.Key),
+			"key_prefix": apiKeyDisplayPrefix(row.Key),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := DB.Exec("UPDATE api_keys SET `key` = NULL WHERE `key` IS NOT NULL").Error; err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		common.SysLog(fmt.Sprintf("Migrated %d API keys to hashed storage", len(rows)))
+	}
+
+	if drop, _ := strconv.ParseBool(os.Getenv("API_KEY_DROP_PLAINTEXT_COLUMN")); drop {
+		if err := DB.Exec("ALTER TABLE api_keys DROP COLUMN `key`").Error; err != nil {
+			return err
+		}
+		common.SysLog("Dropped plaintext key column from api_keys")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+func TestGetApiKeyByKeyExpiredPreviousKeyClearsAllCacheEntries(t *testing.T) {
+	mr := miniredis.RunT(t)
+	previous := common.RDB
+	common.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		common.RDB.Close()
+		common.RDB = previous
+	})
+
+	currentHash := HashApiKey("sk-current")
+	previousHash := HashApiKey("sk-previous")
+	graceEnd := Time(time.Now().Add(-time.Minute))
+	apiKey := &ApiKey{ID: 1, Status: 1, PreviousKeyExpiresAt: &graceEnd}
+	cachedData, err := json.Marshal(cachedApiKey{ApiKey: apiKey, KeyHash: currentHash, PreviousKeyHash: previousHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 新旧密钥都已缓存，旧密钥的宽限期已过
+	cacheKeys := []string{"api_key:" + currentHash, "api_key:prev:" + previousHash}
+	for _, cacheKey := range cacheKeys {
+		mr.Set(cacheKey, string(cachedData))
+	}
+
+	if _, err := GetApiKeyByKey("sk-previous"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	for _, cacheKey := range cacheKeys {
+		if n, _ := common.RDB.Exists(context.Background(), cacheKey).Result(); n != 0 {
+			t.Errorf("cache entry %s was not cleared", cacheKey)
+		}
+	}
+}
@@ -96,6 +96,14 @@ func InitDB() error {
 	maxIdleTimeMinutes := getIntEnv("MYSQL_MAX_IDLE_TIME_MINUTES", 30)
 	sqlDB.SetConnMaxIdleTime(time.Duration(maxIdleTimeMinutes) * time.Minute)
 
+	// API Key从明文存储迁移为哈希存储
+	if err := migrateApiKeyHashes(); err != nil {
+		return fmt.Errorf("failed to migrate api keys to hashed storage: %v", err)
+	}
+
+	// api_keys表新增累计总费用字段时，迁移后需要从日志表补全历史费用
+	needTotalCostBackfill := DB.Migrator().HasTable("api_keys") && !DB.Migrator().HasColumn("api_keys", "total_cost")
+
 	// 自动迁移数据库表
 	err = DB.AutoMigrate(
 		&User{},
@@ -105,11 +113,18 @@ func InitDB() error {
 		&Group{},
 		&ApiKey{},
 		&Log{},
+		&LogCapture{},
 	)
 	if err != nil {
 		return err
 	}
 
+	if needTotalCostBackfill {
+		if err := backfillApiKeyTotalCost(); err != nil {
+			return fmt.Errorf("failed to backfill api key total cost: %v", err)
+		}
+	}
+
 	common.SysLog("Database initialized successfully")
 	return nil
 }
@@ -3,6 +3,7 @@ package model
 import (
 	"claude-code-relay/common"
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
@@ -11,15 +12,20 @@ import (
 )
 
 type Group struct {
-	ID         uint           `json:"id" gorm:"primaryKey"`
-	Name       string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
-	Remark     string         `json:"remark" gorm:"type:text"`
-	Status     int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
-	UserID     uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
-	InstanceID string         `json:"instance_id" gorm:"type:varchar(150)"`
-	CreatedAt  Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
-	UpdatedAt  Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
-	DeletedAt  gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
+	ID               uint           `json:"id" gorm:"primaryKey"`
+	Name             string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
+	Remark           string         `json:"remark" gorm:"type:text"`
+	Status           int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
+	UserID           uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
+	InstanceID       string         `json:"instance_id" gorm:"type:varchar(150)"`
+	ScheduleStrategy string         `json:"schedule_strategy" gorm:"type:varchar(30);default:'priority_weighted'"` // 账号调度策略
+	WeeklyBudget     float64        `json:"weekly_budget" gorm:"default:0;comment:最近7天预算(美元),0表示不限制"`
+	MonthlyBudget    float64        `json:"monthly_budget" gorm:"default:0;comment:最近30天预算(美元),0表示不限制"`
+	TotalBudget      float64        `json:"total_budget" gorm:"default:0;comment:总预算(美元),0表示不限制"`
+	CaptureBodies    bool           `json:"capture_bodies" gorm:"default:false;comment:是否抓取分组下所有API Key的请求/响应内容"`
+	CreatedAt        Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt        gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
 
 	// 统计字段，不存储在数据库中
 	ApiKeyCount  int `json:"api_key_count" gorm:"-"`
@@ -27,15 +33,25 @@ type Group struct {
 }
 
 type CreateGroupRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Remark string `json:"remark"`
-	Status int    `json:"status"`
+	Name             string  `json:"name" binding:"required"`
+	Remark           string  `json:"remark"`
+	Status           int     `json:"status"`
+	ScheduleStrategy string  `json:"schedule_strategy" binding:"omitempty,oneof=priority_weighted least_connections least_cost round_robin"`
+	WeeklyBudget     float64 `json:"weekly_budget" binding:"min=0"`
+	MonthlyBudget    float64 `json:"monthly_budget" binding:"min=0"`
+	TotalBudget      float64 `json:"total_budget" binding:"min=0"`
+	CaptureBodies    bool    `json:"capture_bodies"`
 }
 
 type UpdateGroupRequest struct {
-	Name   string `json:"name"`
-	Remark string `json:"remark"`
-	Status *int   `json:"status"`
+	Name             string   `json:"name"`
+	Remark           string   `json:"remark"`
+	Status           *int     `json:"status"`
+	ScheduleStrategy *string  `json:"schedule_strategy" binding:"omitempty,oneof=priority_weighted least_connections least_cost round_robin"`
+	WeeklyBudget     *float64 `json:"weekly_budget" binding:"omitempty,min=0"`
+	MonthlyBudget    *float64 `json:"monthly_budget" binding:"omitempty,min=0"`
+	TotalBudget      *float64 `json:"total_budget" binding:"omitempty,min=0"`
+	CaptureBodies    *bool    `json:"capture_bodies"`
 }
 
 type GroupListResult struct {
@@ -97,11 +113,111 @@ func GetGroupStatus(id int) int {
 	return group.Status
 }
 
+// GetGroupScheduleStrategy 获取分组的账号调度策略（带缓存），找不到返回空字符串
+func GetGroupScheduleStrategy(id int) string {
+	cacheKey := fmt.Sprintf("group_strategy:%d", id)
+
+	// 先尝试从缓存获取
+	if common.RDB != nil {
+		cachedStrategy, err := common.RDB.Get(context.Background(), cacheKey).Result()
+		if err == nil {
+			return cachedStrategy
+		}
+	}
+
+	// 缓存未命中，从数据库查询
+	var group Group
+	strategy := ""
+	if err := DB.Select("id,schedule_strategy").Where("id = ?", id).First(&group).Error; err == nil {
+		strategy = group.ScheduleStrategy
+	}
+
+	// 存储到缓存（5分钟），查询失败时缓存空值避免频繁查询
+	if common.RDB != nil {
+		common.RDB.Set(context.Background(), cacheKey, strategy, 5*time.Minute)
+	}
+
+	return strategy
+}
+
+// GetGroupBudget 获取分组的预算配置（带缓存），找不到返回nil
+func GetGroupBudget(id int) *Group {
+	cacheKey := fmt.Sprintf("group_budget:%d", id)
+
+	// 先尝试从缓存获取
+	if common.RDB != nil {
+		cachedData, err := common.RDB.Get(context.Background(), cacheKey).Result()
+		if err == nil {
+			var group Group
+			if json.Unmarshal([]byte(cachedData), &group) == nil {
+				if group.ID == 0 {
+					return nil
+				}
+				return &group
+			}
+		}
+	}
+
+	// 缓存未命中，从数据库查询
+	var group Group
+	if err := DB.Select("id,weekly_budget,monthly_budget,total_budget").Where("id = ?", id).First(&group).Error; err != nil {
+		// 查询失败时缓存空值避免频繁查询
+		group = Group{}
+	}
+
+	// 存储到缓存（5分钟）
+	if common.RDB != nil {
+		if cachedData, err := json.Marshal(group); err == nil {
+			common.RDB.Set(context.Background(), cacheKey, cachedData, 5*time.Minute)
+		}
+	}
+
+	if group.ID == 0 {
+		return nil
+	}
+	return &group
+}
+
+// GetGroupCaptureBodies 获取分组是否开启请求/响应内容抓取（带缓存）
+func GetGroupCaptureBodies(id int) bool {
+	cacheKey := fmt.Sprintf("group_capture:%d", id)
+
+	// 先尝试从缓存获取
+	if common.RDB != nil {
+		cachedValue, err := common.RDB.Get(context.Background(), cacheKey).Result()
+		if err == nil {
+			return cachedValue == "1"
+		}
+	}
+
+	// 缓存未命中，从数据库查询
+	var group Group
+	capture := false
+	if err := DB.Select("id,capture_bodies").Where("id = ?", id).First(&group).Error; err == nil {
+		capture = group.CaptureBodies
+	}
+
+	// 存储到缓存（5分钟）
+	if common.RDB != nil {
+		cachedValue := "0"
+		if capture {
+			cachedValue = "1"
+		}
+		common.RDB.Set(context.Background(), cacheKey, cachedValue, 5*time.Minute)
+	}
+
+	return capture
+}
+
 // clearGroupStatusCache 清理分组状态缓存
 func clearGroupStatusCache(groupID int) {
 	if common.RDB != nil {
-		cacheKey := fmt.Sprintf("group_status:%d", groupID)
-		common.RDB.Del(context.Background(), cacheKey)
+		common.RDB.Del(context.Background(),
+			fmt.Sprintf("group_status:%d", groupID),
+			fmt.Sprintf("group_strategy:%d", groupID),
+			fmt.Sprintf("group_budget:%d", groupID),
+			fmt.Sprintf("group_capture:%d", groupID),
+		)
 	}
 }
 
@@ -194,10 +310,18 @@ func GetInstanceID(groupID uint) string {
 	}
 
 	if group.InstanceID == "" {
-		group.InstanceID = common.GenerateRandomInstanceID()
-
-		// 保存到数据库
-		DB.Model(&group).Update("instance_id", group.InstanceID)
+		newID := common.GenerateRandomInstanceID()
+
+		// 仅在实例ID仍为空时保存，并发生成时以先写入的为准
+		result := DB.Model(&Group{}).
+			Where("id = ? AND (instance_id = '' OR instance_id IS NULL)", groupID).
+			Update("instance_id", newID)
+		if result.Error == nil && result.RowsAffected == 0 {
+			DB.Select("instance_id").Where("id = ?", groupID).First(&group)
+		}
+		if group.InstanceID == "" {
+			group.InstanceID = newID
+		}
 	}
 	return group.InstanceID
 }
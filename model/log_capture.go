@@ -0,0 +1,115 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"time"
+)
+
+// LogCapture 请求/响应内容抓取记录，与Log一对一关联，内容以gzip压缩存储
+type LogCapture struct {
+	LogID        string `json:"log_id" gorm:"primaryKey;type:varchar(19)"`                       // 关联的日志ID
+	RequestBody  []byte `json:"-" gorm:"type:longblob"`                                          // 请求体(gzip)
+	ResponseBody []byte `json:"-" gorm:"type:longblob"`                                          // 还原后的响应(gzip)
+	StopReason   string `json:"stop_reason" gorm:"type:varchar(50)"`                             // 结束原因
+	Truncated    bool   `json:"truncated" gorm:"default:false"`                                  // 内容超过上限被截断
+	CreatedAt    Time   `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP;index"` // 创建时间
+}
+
+// LogCaptureDetail 解压后的抓取内容，用于日志详情展示
+type LogCaptureDetail struct {
+	Request    string `json:"request"`
+	Response   string `json:"response"`
+	StopReason string `json:"stop_reason"`
+	Truncated  bool   `json:"truncated"`
+}
+
+func (l *LogCapture) TableName() string {
+	return "log_captures"
+}
+
+// CreateLogCapture 压缩并保存请求/响应内容
+func CreateLogCapture(logID string, request, response []byte, stopReason string, truncated bool) error {
+	requestBody, err := gzipBytes(request)
+	if err != nil {
+		return err
+	}
+	responseBody, err := gzipBytes(response)
+	if err != nil {
+		return err
+	}
+
+	return DB.Create(&LogCapture{
+		LogID:        logID,
+		RequestBody:  requestBody,
+		ResponseBody: responseBody,
+		StopReason:   stopReason,
+		Truncated:    truncated,
+		CreatedAt:    Time(time.Now()),
+	}).Error
+}
+
+// GetLogCaptureDetail 获取日志的抓取内容，没有抓取记录时返回nil
+func GetLogCaptureDetail(logID string) (*LogCaptureDetail, error) {
+	var capture LogCapture
+	if err := DB.Where("log_id = ?", logID).First(&capture).Error; err != nil {
+		return nil, err
+	}
+
+	request, err := gunzipBytes(capture.RequestBody)
+	if err != nil {
+		return nil, err
+	}
+	response, err := gunzipBytes(capture.ResponseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogCaptureDetail{
+		Request:    string(request),
+		Response:   string(response),
+		StopReason: capture.StopReason,
+		Truncated:  capture.Truncated,
+	}, nil
+}
+
+// DeleteExpiredLogCaptures 删除指定天数之前的抓取内容
+func DeleteExpiredLogCaptures(days int) (int64, error) {
+	if days <= 0 {
+		return 0, errors.New("天数必须大于0")
+	}
+
+	cutoffTime := time.Now().AddDate(0, 0, -days)
+	result := DB.Where("created_at < ?", cutoffTime).Delete(&LogCapture{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return result.RowsAffected, nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -2,11 +2,18 @@ package model
 
 import (
 	"claude-code-relay/common"
+	"context"
 	"errors"
+	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Log 日志记录表 - 记录Claude Code调用的详细日志
@@ -27,11 +34,27 @@ type Log struct {
 	TotalCost                float64 `json:"total_cost" gorm:"default:0"`                               // 总费用(USD)
 	IsStream                 bool    `json:"is_stream" gorm:"default:false"`                            // 是否为流式输出
 	Duration                 int64   `json:"duration"`                                                  // 请求总耗时(毫秒)
+	FirstByteTime            int64   `json:"first_byte_time" gorm:"default:0"`                          // 首字节耗时(毫秒)，非流式请求为0
+	FirstTokenTime           int64   `json:"first_token_time" gorm:"default:0"`                         // 首个内容增量耗时(毫秒)，非流式请求为0
+	OutputTokensPerSecond    float64 `json:"output_tokens_per_second" gorm:"default:0"`                 // 输出速度(tokens/秒)，从首个内容增量开始计算
+	StatusCode               int     `json:"status_code" gorm:"default:200;index"`                      // 响应状态码
+	ErrorType                string  `json:"error_type" gorm:"type:varchar(100);index"`                 // 错误类型，成功请求为空
+	ErrorMessage             string  `json:"error_message" gorm:"type:text"`                            // 错误信息，成功请求为空
+	UpstreamRequestID        string  `json:"upstream_request_id" gorm:"type:varchar(100);index"`        // 上游返回的request-id
+	RetryCount               int     `json:"retry_count" gorm:"default:0"`                              // 切换账号重试的次数
+	ClientIP                 string  `json:"client_ip" gorm:"type:varchar(64);index"`                   // 客户端IP
+	UsedPreviousKey          bool    `json:"used_previous_key" gorm:"default:false"`                    // 是否使用轮换前的旧密钥
 	CreatedAt                Time    `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"` // 创建时间
 
 	// 关联关系
 	User   User   `json:"user,omitempty" gorm:"foreignKey:UserID"`
 	ApiKey ApiKey `json:"api_key,omitempty" gorm:"foreignKey:ApiKeyID"`
+
+	// 请求/响应抓取内容（不存储在logs表中，查看详情时加载）
+	Capture *LogCaptureDetail `json:"capture,omitempty" gorm:"-"`
+
+	// 产生日志的请求所在的链路，批量写入时用于关联
+	TraceContext trace.SpanContext `json:"-" gorm:"-"`
 }
 
 // LogCreateRequest 创建日志请求结构
@@ -85,6 +108,9 @@ type DetailedStatsResult struct {
 	CacheWriteCost           float64 `json:"cache_write_cost"`            // 缓存写入费用
 	CacheReadCost            float64 `json:"cache_read_cost"`             // 缓存读取费用
 	AvgDuration              float64 `json:"avg_duration"`                // 平均响应时间
+	AvgFirstByteTime         float64 `json:"avg_first_byte_time"`         // 平均首字节耗时(毫秒)
+	AvgFirstTokenTime        float64 `json:"avg_first_token_time"`        // 平均首个内容增量耗时(毫秒)
+	AvgOutputSpeed           float64 `json:"avg_output_speed"`            // 平均输出速度(tokens/秒)
 	StreamRequests           int64   `json:"stream_requests"`             // 流式请求数
 	StreamPercent            float64 `json:"stream_percent"`              // 流式请求比例
 }
@@ -103,20 +129,54 @@ type StatsQueryRequest struct {
 
 // TrendDataItem 趋势数据项
 type TrendDataItem struct {
-	Date         string  `json:"date"`          // 日期
-	Requests     int64   `json:"requests"`      // 请求数
-	Tokens       int64   `json:"tokens"`        // tokens数
-	Cost         float64 `json:"cost"`          // 费用
-	AvgDuration  float64 `json:"avg_duration"`  // 平均响应时间
-	CacheTokens  int64   `json:"cache_tokens"`  // 缓存tokens
-	InputTokens  int64   `json:"input_tokens"`  // 输入tokens
-	OutputTokens int64   `json:"output_tokens"` // 输出tokens
+	Date              string  `json:"date"`                 // 日期
+	Requests          int64   `json:"requests"`             // 请求数
+	Tokens            int64   `json:"tokens"`               // tokens数
+	Cost              float64 `json:"cost"`                 // 费用
+	AvgDuration       float64 `json:"avg_duration"`         // 平均响应时间
+	CacheTokens       int64   `json:"cache_tokens"`         // 缓存tokens
+	InputTokens       int64   `json:"input_tokens"`         // 输入tokens
+	OutputTokens      int64   `json:"output_tokens"`        // 输出tokens
+	AvgFirstByteTime  float64 `json:"avg_first_byte_time"`  // 平均首字节耗时(毫秒)
+	AvgFirstTokenTime float64 `json:"avg_first_token_time"` // 平均首个内容增量耗时(毫秒)
+	AvgOutputSpeed    float64 `json:"avg_output_speed"`     // 平均输出速度(tokens/秒)
+}
+
+// LatencyStatsItem 按账号或模型分组的延迟统计
+type LatencyStatsItem struct {
+	AccountID         uint    `json:"account_id,omitempty"`   // 账号ID，按账号分组时有值
+	AccountName       string  `json:"account_name,omitempty"` // 账号名称，按账号分组时有值
+	ModelName         string  `json:"model_name,omitempty"`   // 模型名称，按模型分组时有值
+	Requests          int64   `json:"requests"`               // 请求数
+	AvgDuration       float64 `json:"avg_duration"`           // 平均响应时间
+	AvgFirstByteTime  float64 `json:"avg_first_byte_time"`    // 平均首字节耗时(毫秒)
+	AvgFirstTokenTime float64 `json:"avg_first_token_time"`   // 平均首个内容增量耗时(毫秒)
+	AvgOutputSpeed    float64 `json:"avg_output_speed"`       // 平均输出速度(tokens/秒)
 }
 
 // StatsResponse 统计响应结果
 type StatsResponse struct {
-	Summary   *DetailedStatsResult `json:"summary"`    // 汇总统计
-	TrendData []TrendDataItem      `json:"trend_data"` // 趋势数据
+	Summary        *DetailedStatsResult `json:"summary"`         // 汇总统计
+	TrendData      []TrendDataItem      `json:"trend_data"`      // 趋势数据
+	AccountLatency []LatencyStatsItem   `json:"account_latency"` // 按账号的延迟统计
+	ModelLatency   []LatencyStatsItem   `json:"model_latency"`   // 按模型的延迟统计
+}
+
+// LogRequestMeta 请求日志的附加信息
+type LogRequestMeta struct {
+	StatusCode        int
+	ErrorType         string
+	ErrorMessage      string
+	UpstreamRequestID string
+	RetryCount        int
+	ClientIP          string
+	UsedPreviousKey   bool
+
+	FirstByteTime         int64
+	FirstTokenTime        int64
+	OutputTokensPerSecond float64
+
+	TraceContext trace.SpanContext
 }
 
 // LogFilters 日志查询过滤条件
@@ -130,27 +190,125 @@ type LogFilters struct {
 	EndTime   *time.Time `json:"end_time"`   // 结束时间
 	MinCost   *float64   `json:"min_cost"`   // 最小费用
 	MaxCost   *float64   `json:"max_cost"`   // 最大费用
+
+	StatusCode        *int    `json:"status_code"`         // 状态码筛选
+	OnlyErrors        bool    `json:"only_errors"`         // 只看失败请求
+	ErrorType         *string `json:"error_type"`          // 错误类型筛选
+	UpstreamRequestID *string `json:"upstream_request_id"` // 上游request-id筛选
+	ClientIP          *string `json:"client_ip"`           // 客户端IP筛选
+	UsedPreviousKey   *bool   `json:"used_previous_key"`   // 是否使用轮换前的旧密钥筛选
 }
 
 func (l *Log) TableName() string {
 	return "logs"
 }
 
+// successfulLogs 只统计成功的请求，失败请求的日志不计入请求数等统计
+func successfulLogs(db *gorm.DB) *gorm.DB {
+	return db.Where("status_code < ?", 400)
+}
+
+// 延迟指标的聚合字段，未测量的记录(值为0)不参与平均
+const (
+	avgFirstByteTimeSQL  = "COALESCE(AVG(NULLIF(first_byte_time, 0)), 0) as avg_first_byte_time"
+	avgFirstTokenTimeSQL = "COALESCE(AVG(NULLIF(first_token_time, 0)), 0) as avg_first_token_time"
+	avgOutputSpeedSQL    = "COALESCE(AVG(NULLIF(output_tokens_per_second, 0)), 0) as avg_output_speed"
+)
+
 // generateSnowflakeID 生成类雪花算法ID (简化版，基于时间戳+递增序列)
 // 格式: 时间戳(13位) + 机器ID(2位) + 序列号(4位) = 19位数字字符串
-var sequenceNum int64 = 0
+var (
+	sequenceNum int64 = 0
+	sequenceMu  sync.Mutex
+)
+
+// logMachineID 日志ID中的机器号，多实例部署时由 InitLogMachineID 分配，未配置Redis时为1
+var logMachineID atomic.Int64
+
+func init() {
+	logMachineID.Store(1)
+}
+
+const (
+	// 机器号占2位
+	logMachineIDCount = 100
+	// 机器号租约时长，实例退出后租约过期，机器号可被新实例使用
+	logMachineIDLeaseTTL = 5 * time.Minute
+)
+
+// 租约仍由自己持有或已过期时续期，已被其他实例占用时返回0
+var renewLogMachineIDScript = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder == false or holder == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`)
+
+// InitLogMachineID 通过Redis为当前实例分配日志ID的机器号，避免多个实例生成相同的日志ID
+// 使用INCR轮流选取机器号，SETNX占用租约并定期续期，所有机器号都被占用时沿用默认机器号
+func InitLogMachineID() {
+	if common.RDB == nil {
+		return
+	}
+
+	ctx := context.Background()
+	token := common.GenerateRandomString(32)
+	for i := 0; i < logMachineIDCount; i++ {
+		seq, err := common.RDB.Incr(ctx, "log_machine_id:seq").Result()
+		if err != nil {
+			common.SysError("Failed to allocate log machine id: " + err.Error())
+			return
+		}
+
+		machineID := seq % logMachineIDCount
+		leaseKey := fmt.Sprintf("log_machine_id:%d", machineID)
+		ok, err := common.RDB.SetNX(ctx, leaseKey, token, logMachineIDLeaseTTL).Result()
+		if err != nil {
+			common.SysError("Failed to allocate log machine id: " + err.Error())
+			return
+		}
+		if ok {
+			logMachineID.Store(machineID)
+			go renewLogMachineIDLease(leaseKey, token)
+			common.SysLog(fmt.Sprintf("Log machine id: %d", machineID))
+			return
+		}
+	}
+
+	common.SysError(fmt.Sprintf("All %d log machine ids are in use, log ids may conflict across instances", logMachineIDCount))
+}
+
+// renewLogMachineIDLease 定期续期机器号租约
+func renewLogMachineIDLease(leaseKey, token string) {
+	ticker := time.NewTicker(logMachineIDLeaseTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		renewed, err := renewLogMachineIDScript.Run(context.Background(), common.RDB, []string{leaseKey}, token, logMachineIDLeaseTTL.Milliseconds()).Int()
+		if err != nil {
+			common.SysError("Failed to renew log machine id lease: " + err.Error())
+		} else if renewed == 0 {
+			common.SysError("Log machine id lease " + leaseKey + " was taken by another instance")
+		}
+	}
+}
 
 func generateSnowflakeID() string {
 	timestamp := time.Now().UnixMilli()
-	machineID := int64(1) // 简化处理，可配置
+	machineID := logMachineID.Load()
 
+	// 日志异步批量写入时会并发生成ID，序列号需要加锁
+	sequenceMu.Lock()
 	sequenceNum++
 	if sequenceNum > 9999 {
 		sequenceNum = 1
 	}
+	seq := sequenceNum
+	sequenceMu.Unlock()
 
 	// 组合生成19位ID: 时间戳(13位) + 机器ID(2位) + 序列号(4位)
-	id := timestamp*1000000 + machineID*10000 + sequenceNum
+	id := timestamp*1000000 + machineID*10000 + seq
 	return strconv.FormatInt(id, 10)
 }
 
@@ -184,6 +342,87 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 	return log, nil
 }
 
+// NewLogFromTokenUsage 根据TokenUsage构建日志记录（不写入数据库），ID和创建时间在构建时确定
+func NewLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool, meta *LogRequestMeta) *Log {
+	costResult := common.CalculateCost(usage)
+
+	entry := &Log{
+		ID:                       generateSnowflakeID(),
+		ModelName:                usage.Model,
+		AccountID:                accountID,
+		UserID:                   userID,
+		ApiKeyID:                 apiKeyID,
+		InputTokens:              usage.InputTokens,
+		OutputTokens:             usage.OutputTokens,
+		CacheReadInputTokens:     usage.CacheReadInputTokens,
+		CacheCreationInputTokens: usage.CacheCreationInputTokens,
+		InputCost:                costResult.Costs.Input,
+		OutputCost:               costResult.Costs.Output,
+		CacheWriteCost:           costResult.Costs.CacheWrite,
+		CacheReadCost:            costResult.Costs.CacheRead,
+		TotalCost:                costResult.Costs.Total,
+		IsStream:                 isStream,
+		Duration:                 duration,
+		StatusCode:               200,
+		CreatedAt:                Time(time.Now()),
+	}
+
+	if meta != nil {
+		if meta.StatusCode > 0 {
+			entry.StatusCode = meta.StatusCode
+		}
+		entry.ErrorType = meta.ErrorType
+		entry.ErrorMessage = meta.ErrorMessage
+		entry.UpstreamRequestID = meta.UpstreamRequestID
+		entry.RetryCount = meta.RetryCount
+		entry.ClientIP = meta.ClientIP
+		entry.UsedPreviousKey = meta.UsedPreviousKey
+		entry.FirstByteTime = meta.FirstByteTime
+		entry.FirstTokenTime = meta.FirstTokenTime
+		entry.OutputTokensPerSecond = meta.OutputTokensPerSecond
+		entry.TraceContext = meta.TraceContext
+	}
+
+	return entry
+}
+
+// CreateLogsInBatches 批量写入日志记录
+func CreateLogsInBatches(logs []*Log, batchSize int) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	return DB.Omit(clause.Associations).CreateInBatches(logs, batchSize).Error
+}
+
+// FilterUnsavedLogs 过滤掉数据库中已存在和重复的日志，重放落盘日志时跳过已写入成功的记录
+func FilterUnsavedLogs(logs []*Log, batchSize int) ([]*Log, error) {
+	saved := make(map[string]bool, len(logs))
+	for start := 0; start < len(logs); start += batchSize {
+		end := min(start+batchSize, len(logs))
+		ids := make([]string, 0, end-start)
+		for _, entry := range logs[start:end] {
+			ids = append(ids, entry.ID)
+		}
+
+		var existing []string
+		if err := DB.Model(&Log{}).Where("id IN ?", ids).Pluck("id", &existing).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range existing {
+			saved[id] = true
+		}
+	}
+
+	unsaved := make([]*Log, 0, len(logs))
+	for _, entry := range logs {
+		if !saved[entry.ID] {
+			saved[entry.ID] = true
+			unsaved = append(unsaved, entry)
+		}
+	}
+	return unsaved, nil
+}
+
 // CreateLogFromTokenUsage 根据TokenUsage创建日志记录
 func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool) (*Log, error) {
 	// 使用费用计算器计算详细费用
@@ -294,7 +533,7 @@ func GetLogsByModel(modelName string, page, limit int) ([]Log, int64, error) {
 func GetLogStats(userID *uint) (*LogStatsResult, error) {
 	var stats LogStatsResult
 
-	query := DB.Model(&Log{})
+	query := DB.Model(&Log{}).Scopes(successfulLogs)
 	if userID != nil {
 		query = query.Where("user_id = ?", *userID)
 	}
@@ -338,6 +577,9 @@ func GetLogStats(userID *uint) (*LogStatsResult, error) {
 
 // DeleteLogById 删除指定ID的日志记录
 func DeleteLogById(id string) error {
+	if err := DB.Delete(&LogCapture{}, "log_id = ?", id).Error; err != nil {
+		return err
+	}
 	return DB.Delete(&Log{}, "id = ?", id).Error
 }
 
@@ -408,6 +650,37 @@ func GetLogsWithFilters(filters *LogFilters, page, limit int) ([]Log, int64, err
 			query = query.Where("total_cost <= ?", *filters.MaxCost)
 			countQuery = countQuery.Where("total_cost <= ?", *filters.MaxCost)
 		}
+
+		// 状态码及错误筛选
+		if filters.StatusCode != nil {
+			query = query.Where("status_code = ?", *filters.StatusCode)
+			countQuery = countQuery.Where("status_code = ?", *filters.StatusCode)
+		}
+
+		if filters.OnlyErrors {
+			query = query.Where("status_code >= ?", 400)
+			countQuery = countQuery.Where("status_code >= ?", 400)
+		}
+
+		if filters.ErrorType != nil {
+			query = query.Where("error_type = ?", *filters.ErrorType)
+			countQuery = countQuery.Where("error_type = ?", *filters.ErrorType)
+		}
+
+		if filters.UpstreamRequestID != nil {
+			query = query.Where("upstream_request_id = ?", *filters.UpstreamRequestID)
+			countQuery = countQuery.Where("upstream_request_id = ?", *filters.UpstreamRequestID)
+		}
+
+		if filters.ClientIP != nil {
+			query = query.Where("client_ip = ?", *filters.ClientIP)
+			countQuery = countQuery.Where("client_ip = ?", *filters.ClientIP)
+		}
+
+		if filters.UsedPreviousKey != nil {
+			query = query.Where("used_previous_key = ?", *filters.UsedPreviousKey)
+			countQuery = countQuery.Where("used_previous_key = ?", *filters.UsedPreviousKey)
+		}
 	}
 
 	// 先获取总数
@@ -474,6 +747,9 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 		CacheWriteCost           float64
 		CacheReadCost            float64
 		AvgDuration              float64
+		AvgFirstByteTime         float64
+		AvgFirstTokenTime        float64
+		AvgOutputSpeed           float64
 		StreamRequests           int64
 	}
 
@@ -489,6 +765,9 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 		"SUM(cache_write_cost) as cache_write_cost",
 		"SUM(cache_read_cost) as cache_read_cost",
 		"AVG(duration) as avg_duration",
+		avgFirstByteTimeSQL,
+		avgFirstTokenTimeSQL,
+		avgOutputSpeedSQL,
 		"SUM(CASE WHEN is_stream = true THEN 1 ELSE 0 END) as stream_requests",
 	).Scan(&result).Error
 
@@ -509,6 +788,9 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 	stats.CacheWriteCost = result.CacheWriteCost
 	stats.CacheReadCost = result.CacheReadCost
 	stats.AvgDuration = result.AvgDuration
+	stats.AvgFirstByteTime = result.AvgFirstByteTime
+	stats.AvgFirstTokenTime = result.AvgFirstTokenTime
+	stats.AvgOutputSpeed = result.AvgOutputSpeed
 	stats.StreamRequests = result.StreamRequests
 
 	// 计算流式请求比例
@@ -559,6 +841,9 @@ func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 		"SUM(cache_read_input_tokens + cache_creation_input_tokens) as cache_tokens",
 		"SUM(input_tokens) as input_tokens",
 		"SUM(output_tokens) as output_tokens",
+		avgFirstByteTimeSQL,
+		avgFirstTokenTimeSQL,
+		avgOutputSpeedSQL,
 	).Group(groupBy).Order(groupBy).Rows()
 
 	if err != nil {
@@ -578,6 +863,9 @@ func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 			&item.CacheTokens,
 			&item.InputTokens,
 			&item.OutputTokens,
+			&item.AvgFirstByteTime,
+			&item.AvgFirstTokenTime,
+			&item.AvgOutputSpeed,
 		)
 		if err != nil {
 			return nil, err
@@ -592,8 +880,62 @@ func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 	return trendData, nil
 }
 
+// GetLatencyStats 按账号或模型分组统计延迟指标，用于发现响应慢的代理和账号
+// groupBy 为 "account" 或 "model"，结果按平均首个内容增量耗时从高到低排序
+func GetLatencyStats(req *StatsQueryRequest, groupBy string) ([]LatencyStatsItem, error) {
+	var groupColumn string
+	switch groupBy {
+	case "account":
+		groupColumn = "account_id"
+	case "model":
+		groupColumn = "model_name"
+	default:
+		return nil, errors.New("不支持的分组方式")
+	}
+
+	query := applyStatsFilters(DB.Model(&Log{}), req)
+
+	startTime, endTime := calculateTimeRange(req)
+	query = query.Where("created_at >= ? AND created_at <= ?", startTime, endTime)
+
+	var items []LatencyStatsItem
+	err := query.Select(
+		groupColumn,
+		"COUNT(*) as requests",
+		"AVG(duration) as avg_duration",
+		avgFirstByteTimeSQL,
+		avgFirstTokenTimeSQL,
+		avgOutputSpeedSQL,
+	).Group(groupColumn).Order("avg_first_token_time DESC").Scan(&items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if groupBy == "account" && len(items) > 0 {
+		accountIDs := make([]uint, 0, len(items))
+		for _, item := range items {
+			accountIDs = append(accountIDs, item.AccountID)
+		}
+
+		var accounts []Account
+		if err := DB.Unscoped().Select("id", "name").Where("id IN ?", accountIDs).Find(&accounts).Error; err != nil {
+			return nil, err
+		}
+		names := make(map[uint]string, len(accounts))
+		for _, account := range accounts {
+			names[account.ID] = account.Name
+		}
+		for i := range items {
+			items[i].AccountName = names[items[i].AccountID]
+		}
+	}
+
+	return items, nil
+}
+
 // applyStatsFilters 应用统计查询过滤条件
 func applyStatsFilters(query *gorm.DB, req *StatsQueryRequest) *gorm.DB {
+	query = query.Scopes(successfulLogs)
 	if req.UserID != nil {
 		query = query.Where("user_id = ?", *req.UserID)
 	}
@@ -650,9 +992,9 @@ func resolveFilters(req *StatsQueryRequest) error {
 			id := uint(apiKeyID)
 			req.ApiKeyID = &id
 		} else {
-			// 作为秘钥值查询（通过key字段）
+			// 作为秘钥值查询（通过密钥哈希）
 			var apiKey ApiKey
-			err := DB.Where("`key` = ?", req.ApiKeyFilter).First(&apiKey).Error
+			err := DB.Where("key_hash = ?", HashApiKey(req.ApiKeyFilter)).First(&apiKey).Error
 			if err == nil {
 				req.ApiKeyID = &apiKey.ID
 			}
@@ -682,9 +1024,21 @@ func GetCompleteStats(req *StatsQueryRequest) (*StatsResponse, error) {
 		return nil, err
 	}
 
+	// 获取按账号和模型的延迟统计
+	accountLatency, err := GetLatencyStats(req, "account")
+	if err != nil {
+		return nil, err
+	}
+	modelLatency, err := GetLatencyStats(req, "model")
+	if err != nil {
+		return nil, err
+	}
+
 	return &StatsResponse{
-		Summary:   summary,
-		TrendData: trendData,
+		Summary:        summary,
+		TrendData:      trendData,
+		AccountLatency: accountLatency,
+		ModelLatency:   modelLatency,
 	}, nil
 }
 
@@ -817,7 +1171,7 @@ func getBaseStats() (*struct {
 	}
 
 	// 查询总费用和总tokens
-	err := DB.Model(&Log{}).Select(
+	err := DB.Model(&Log{}).Scopes(successfulLogs).Select(
 		"SUM(total_cost) as total_cost",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as total_tokens",
 	).Scan(&result).Error
@@ -858,7 +1212,7 @@ func getRecentTrendData(days int) ([]TrendDataItem, error) {
 	startTime := time.Date(now.Year(), now.Month(), now.Day()-days, 0, 0, 0, 0, now.Location())
 	endTime := time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 59, 999999999, now.Location())
 
-	rows, err := DB.Model(&Log{}).Select(
+	rows, err := DB.Model(&Log{}).Scopes(successfulLogs).Select(
 		"DATE(created_at) as date_group",
 		"COUNT(*) as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
@@ -904,7 +1258,7 @@ func getRecentTrendData(days int) ([]TrendDataItem, error) {
 func getModelUsageStats() ([]ModelUsageItem, error) {
 	var modelStats []ModelUsageItem
 
-	rows, err := DB.Model(&Log{}).Select(
+	rows, err := DB.Model(&Log{}).Scopes(successfulLogs).Select(
 		"model_name",
 		"COUNT(*) as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
@@ -957,7 +1311,7 @@ func getAccountRanking(limit int) ([]AccountRankItem, error) {
 			SUM(l.total_cost) as cost
 		`).
 		Joins("LEFT JOIN accounts a ON l.account_id = a.id").
-		Where("l.created_at >= ? AND l.created_at <= ?", currentStart, currentEnd).
+		Where("l.created_at >= ? AND l.created_at <= ? AND l.status_code < ?", currentStart, currentEnd, 400).
 		Group("l.account_id, a.name, a.platform_type").
 		Order("cost DESC").
 		Limit(limit).Rows()
@@ -1013,7 +1367,7 @@ func getApiKeyRanking(limit int) ([]ApiKeyRankItem, error) {
 			SUM(l.total_cost) as cost
 		`).
 		Joins("LEFT JOIN api_keys ak ON l.api_key_id = ak.id").
-		Where("l.created_at >= ? AND l.created_at <= ?", currentStart, currentEnd).
+		Where("l.created_at >= ? AND l.created_at <= ? AND l.status_code < ?", currentStart, currentEnd, 400).
 		Group("l.api_key_id, ak.name").
 		Order("requests DESC").
 		Limit(limit).Rows()
@@ -1082,7 +1436,7 @@ func getDayStats(startTime, endTime time.Time, label string) (*DayStatsItem, err
 		Cost     float64
 	}
 
-	err := DB.Model(&Log{}).Select(
+	err := DB.Model(&Log{}).Scopes(successfulLogs).Select(
 		"COUNT(*) as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
 		"SUM(total_cost) as cost",
@@ -1136,7 +1490,7 @@ func calculateApiKeyGrowthRate(apiKeyID uint, prevStart, prevEnd, currentStart,
 	var prevRequests, currentRequests int64
 
 	// 上期请求数
-	err := DB.Model(&Log{}).Select("COUNT(*)").
+	err := DB.Model(&Log{}).Scopes(successfulLogs).Select("COUNT(*)").
 		Where("api_key_id = ? AND created_at >= ? AND created_at <= ?", apiKeyID, prevStart, prevEnd).
 		Scan(&prevRequests).Error
 	if err != nil {
@@ -1144,7 +1498,7 @@ func calculateApiKeyGrowthRate(apiKeyID uint, prevStart, prevEnd, currentStart,
 	}
 
 	// 本期请求数
-	err = DB.Model(&Log{}).Select("COUNT(*)").
+	err = DB.Model(&Log{}).Scopes(successfulLogs).Select("COUNT(*)").
 		Where("api_key_id = ? AND created_at >= ? AND created_at <= ?", apiKeyID, currentStart, currentEnd).
 		Scan(&currentRequests).Error
 	if err != nil {
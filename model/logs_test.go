@@ -0,0 +1,35 @@
+package model
+
+import (
+	"claude-code-relay/common"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestInitLogMachineIDUniqueAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	previous := common.RDB
+	common.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		common.RDB.Close()
+		common.RDB = previous
+		logMachineID.Store(1)
+	})
+
+	// 模拟多个实例依次启动，已被占用的机器号会被跳过
+	mr.Set("log_machine_id:2", "other-instance")
+	seen := make(map[int64]bool)
+	for i := 0; i < 3; i++ {
+		InitLogMachineID()
+		machineID := logMachineID.Load()
+		if seen[machineID] {
+			t.Fatalf("machine id %d allocated twice", machineID)
+		}
+		if machineID == 2 {
+			t.Fatal("allocated machine id held by another instance")
+		}
+		seen[machineID] = true
+	}
+}
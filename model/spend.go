@@ -0,0 +1,139 @@
+package model
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 费用汇总缓存时间，预算判断允许有该时长的延迟
+const spendSummaryCacheTTL = time.Minute
+
+// SpendSummary 费用汇总（USD）
+type SpendSummary struct {
+	WeeklyCost  float64 `json:"weekly_cost"`  // 最近7天费用
+	MonthlyCost float64 `json:"monthly_cost"` // 最近30天费用
+	TotalCost   float64 `json:"total_cost"`   // 累计总费用
+}
+
+// GetApiKeySpend 获取API Key的费用汇总（带缓存）
+// 最近7天/30天费用从日志表统计，累计总费用取自api_keys表的计数字段（日志会按保留期清理）
+func GetApiKeySpend(apiKeyID uint) (*SpendSummary, error) {
+	cacheKey := fmt.Sprintf("api_key_spend:%d", apiKeyID)
+	if summary := getCachedSpendSummary(cacheKey); summary != nil {
+		return summary, nil
+	}
+
+	summary, err := sumLogSpend(DB.Table("logs").Where("api_key_id = ?", apiKeyID))
+	if err != nil {
+		return nil, err
+	}
+
+	err = DB.Model(&ApiKey{}).Unscoped().
+		Select("COALESCE(total_cost, 0)").
+		Where("id = ?", apiKeyID).
+		Scan(&summary.TotalCost).Error
+	if err != nil {
+		return nil, err
+	}
+
+	setCachedSpendSummary(cacheKey, summary)
+	return summary, nil
+}
+
+// backfillApiKeyTotalCost 新增累计总费用字段后，按日志表中的历史费用补全已有API Key的累计总费用
+// 只在AutoMigrate新增该字段时执行一次，已按保留期清理的日志无法计入
+func backfillApiKeyTotalCost() error {
+	if !DB.Migrator().HasTable("logs") {
+		return nil
+	}
+
+	result := DB.Exec("UPDATE api_keys SET total_cost = " +
+		"(SELECT COALESCE(SUM(logs.total_cost), 0) FROM logs WHERE logs.api_key_id = api_keys.id)")
+	if result.Error != nil {
+		return result.Error
+	}
+
+	common.SysLog(fmt.Sprintf("Backfilled total cost of %d API keys from request logs", result.RowsAffected))
+	return nil
+}
+
+// GetGroupSpend 获取分组下所有API Key的费用汇总（带缓存）
+func GetGroupSpend(groupID int) (*SpendSummary, error) {
+	cacheKey := fmt.Sprintf("group_spend:%d", groupID)
+	if summary := getCachedSpendSummary(cacheKey); summary != nil {
+		return summary, nil
+	}
+
+	// 包含已删除的API Key，删除Key不能绕过分组预算
+	groupKeys := DB.Model(&ApiKey{}).Unscoped().Select("id").Where("group_id = ?", groupID)
+
+	summary, err := sumLogSpend(DB.Table("logs").Where("api_key_id IN (?)", groupKeys))
+	if err != nil {
+		return nil, err
+	}
+
+	err = DB.Model(&ApiKey{}).Unscoped().
+		Select("COALESCE(SUM(total_cost), 0)").
+		Where("group_id = ?", groupID).
+		Scan(&summary.TotalCost).Error
+	if err != nil {
+		return nil, err
+	}
+
+	setCachedSpendSummary(cacheKey, summary)
+	return summary, nil
+}
+
+// sumLogSpend 从日志表统计最近7天和最近30天的费用
+func sumLogSpend(query *gorm.DB) (*SpendSummary, error) {
+	now := time.Now()
+	weekStart := now.AddDate(0, 0, -7)
+	monthStart := now.AddDate(0, 0, -30)
+
+	var result struct {
+		WeeklyCost  float64
+		MonthlyCost float64
+	}
+	err := query.
+		Select("COALESCE(SUM(CASE WHEN created_at >= ? THEN total_cost ELSE 0 END), 0) as weekly_cost, "+
+			"COALESCE(SUM(total_cost), 0) as monthly_cost", weekStart).
+		Where("created_at >= ?", monthStart).
+		Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &SpendSummary{
+		WeeklyCost:  result.WeeklyCost,
+		MonthlyCost: result.MonthlyCost,
+	}, nil
+}
+
+func getCachedSpendSummary(cacheKey string) *SpendSummary {
+	if common.RDB == nil {
+		return nil
+	}
+	cachedData, err := common.RDB.Get(context.Background(), cacheKey).Result()
+	if err != nil {
+		return nil
+	}
+	var summary SpendSummary
+	if json.Unmarshal([]byte(cachedData), &summary) != nil {
+		return nil
+	}
+	return &summary
+}
+
+func setCachedSpendSummary(cacheKey string, summary *SpendSummary) {
+	if common.RDB == nil {
+		return
+	}
+	if cachedData, err := json.Marshal(summary); err == nil {
+		common.RDB.Set(context.Background(), cacheKey, cachedData, spendSummaryCacheTTL)
+	}
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"claude-code-relay/common"
+	"fmt"
+	"time"
+)
+
+// usageCounterSQL 在一条UPDATE中原子地累加今日使用统计，最后使用时间早于今天时重置为本次用量
+// MySQL按从左到右的顺序执行赋值，last_used_time必须放在最后更新
+const usageCounterSQL = `UPDATE %s SET
+	today_usage_count = CASE WHEN last_used_time >= ? THEN today_usage_count + 1 ELSE 1 END,
+	today_input_tokens = CASE WHEN last_used_time >= ? THEN today_input_tokens + ? ELSE ? END,
+	today_output_tokens = CASE WHEN last_used_time >= ? THEN today_output_tokens + ? ELSE ? END,
+	today_cache_read_input_tokens = CASE WHEN last_used_time >= ? THEN today_cache_read_input_tokens + ? ELSE ? END,
+	today_cache_creation_input_tokens = CASE WHEN last_used_time >= ? THEN today_cache_creation_input_tokens + ? ELSE ? END,
+	today_total_cost = CASE WHEN last_used_time >= ? THEN today_total_cost + ? ELSE ? END,
+	%s
+	last_used_time = ?
+	WHERE id = ?`
+
+// incrementUsageCounters 原子地累加指定表中一行的今日使用统计
+// extraSet为额外的赋值语句（以逗号结尾），参数依次放在extraArgs中
+func incrementUsageCounters(table string, id uint, usage *common.TokenUsage, cost float64, extraSet string, extraArgs ...interface{}) error {
+	if usage == nil {
+		usage = &common.TokenUsage{}
+	}
+
+	now := time.Now()
+	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	args := []interface{}{
+		todayStart,
+		todayStart, usage.InputTokens, usage.InputTokens,
+		todayStart, usage.OutputTokens, usage.OutputTokens,
+		todayStart, usage.CacheReadInputTokens, usage.CacheReadInputTokens,
+		todayStart, usage.CacheCreationInputTokens, usage.CacheCreationInputTokens,
+		todayStart, cost, cost,
+	}
+	args = append(args, extraArgs...)
+	args = append(args, now, id)
+
+	return DB.Exec(fmt.Sprintf(usageCounterSQL, table, extraSet), args...).Error
+}
+
+// IncrementAccountUsage 原子地累加账号的今日使用统计，并将当前状态置为正常
+func IncrementAccountUsage(id uint, usage *common.TokenUsage, cost float64) error {
+	return incrementUsageCounters("accounts", id, usage, cost, "current_status = ?,", 1)
+}
+
+// IncrementApiKeyUsage 原子地累加API Key的今日使用统计和累计总费用
+func IncrementApiKeyUsage(id uint, usage *common.TokenUsage, cost float64) error {
+	return incrementUsageCounters("api_keys", id, usage, cost, "total_cost = total_cost + ?,", cost)
+}
+
+// UpdateAccountCurrentStatus 只更新账号的当前状态，不覆盖其他字段
+func UpdateAccountCurrentStatus(id uint, currentStatus int) error {
+	return DB.Model(&Account{}).Where("id = ?", id).Update("current_status", currentStatus).Error
+}
@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"claude-code-relay/model"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 抓取内容的大小上限，超出部分截断
+const maxCaptureBytes = 4 << 20
+
+// CaptureResponseWriter 在写给客户端的同时记录Claude格式的响应内容
+type CaptureResponseWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// NewCaptureResponseWriter 创建响应抓取写入器
+func NewCaptureResponseWriter(w gin.ResponseWriter) *CaptureResponseWriter {
+	return &CaptureResponseWriter{ResponseWriter: w}
+}
+
+func (w *CaptureResponseWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *CaptureResponseWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *CaptureResponseWriter) capture(data []byte) {
+	remaining := maxCaptureBytes - w.buf.Len()
+	if len(data) > remaining {
+		data = data[:max(remaining, 0)]
+		w.truncated = true
+	}
+	w.buf.Write(data)
+}
+
+// ShouldCaptureBodies 判断API Key或其所属分组是否开启了请求/响应内容抓取
+func ShouldCaptureBodies(apiKey *model.ApiKey) bool {
+	if apiKey.CaptureBodies {
+		return true
+	}
+	return apiKey.GroupID > 0 && model.GetGroupCaptureBodies(apiKey.GroupID)
+}
+
+// SaveRequestCapture 保存请求体和还原后的响应，关联到本次请求记录的日志，未记录日志时不保存
+func SaveRequestCapture(c *gin.Context, writer *CaptureResponseWriter, requestBody []byte) {
+	logID := c.GetString(requestLogIDKey)
+	if logID == "" {
+		return
+	}
+
+	response, stopReason := writer.capturedResponse()
+	truncated := writer.truncated
+	if len(requestBody) > maxCaptureBytes {
+		requestBody = requestBody[:maxCaptureBytes]
+		truncated = true
+	}
+
+	go func() {
+		if err := model.CreateLogCapture(logID, requestBody, response, stopReason, truncated); err != nil {
+			log.Printf("保存请求抓取内容失败: %v", err)
+		}
+	}()
+}
+
+// capturedResponse 还原抓取到的响应：流式响应合并为完整的消息，其他响应原样返回
+func (w *CaptureResponseWriter) capturedResponse() ([]byte, string) {
+	data := w.buf.Bytes()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		return data, gjson.GetBytes(data, "stop_reason").String()
+	}
+	return reconstructClaudeStream(data)
+}
+
+// capturedMessage 由流式事件合并而成的完整消息
+type capturedMessage struct {
+	ID         string                   `json:"id,omitempty"`
+	Model      string                   `json:"model,omitempty"`
+	Role       string                   `json:"role"`
+	Content    []map[string]interface{} `json:"content"`
+	StopReason string                   `json:"stop_reason,omitempty"`
+	Usage      map[string]interface{}   `json:"usage,omitempty"`
+	Error      json.RawMessage          `json:"error,omitempty"`
+}
+
+// reconstructClaudeStream 将Claude SSE事件合并为一条完整的assistant消息（文本、思考、tool_use和结束原因）
+func reconstructClaudeStream(data []byte) ([]byte, string) {
+	message := &capturedMessage{Role: "assistant", Content: []map[string]interface{}{}}
+	blockIndexes := make(map[int64]int)
+	toolInputs := make(map[int]*strings.Builder)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxCaptureBytes)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		event := gjson.Parse(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+
+		switch event.Get("type").String() {
+		case "message_start":
+			message.ID = event.Get("message.id").String()
+			message.Model = event.Get("message.model").String()
+			if usage, ok := event.Get("message.usage").Value().(map[string]interface{}); ok {
+				message.Usage = usage
+			}
+		case "content_block_start":
+			block, ok := event.Get("content_block").Value().(map[string]interface{})
+			if !ok {
+				continue
+			}
+			blockIndexes[event.Get("index").Int()] = len(message.Content)
+			message.Content = append(message.Content, block)
+		case "content_block_delta":
+			position, ok := blockIndexes[event.Get("index").Int()]
+			if !ok {
+				continue
+			}
+			block := message.Content[position]
+			delta := event.Get("delta")
+			switch delta.Get("type").String() {
+			case "text_delta":
+				block["text"] = toString(block["text"]) + delta.Get("text").String()
+			case "thinking_delta":
+				block["thinking"] = toString(block["thinking"]) + delta.Get("thinking").String()
+			case "input_json_delta":
+				if toolInputs[position] == nil {
+					toolInputs[position] = &strings.Builder{}
+				}
+				toolInputs[position].WriteString(delta.Get("partial_json").String())
+			}
+		case "message_delta":
+			if stopReason := event.Get("delta.stop_reason").String(); stopReason != "" {
+				message.StopReason = stopReason
+			}
+			if message.Usage != nil {
+				event.Get("usage").ForEach(func(key, value gjson.Result) bool {
+					message.Usage[key.String()] = value.Value()
+					return true
+				})
+			}
+		case "error":
+			message.Error = json.RawMessage(event.Get("error").Raw)
+		}
+	}
+
+	// tool_use的输入由多个片段拼接而成，无法解析时保留原始字符串
+	for position, input := range toolInputs {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(input.String()), &parsed); err == nil {
+			message.Content[position]["input"] = parsed
+		} else {
+			message.Content[position]["input"] = input.String()
+		}
+	}
+
+	result, err := json.Marshal(message)
+	if err != nil {
+		return data, message.StopReason
+	}
+	return result, message.StopReason
+}
+
+func toString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
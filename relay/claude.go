@@ -74,6 +74,7 @@ var (
 	errNetworkError  = gin.H{"error": map[string]interface{}{"type": "network_error", "message": "Failed to execute request"}}
 	errDecompression = gin.H{"error": map[string]interface{}{"type": "decompression_error", "message": "Failed to create decompressor"}}
 	errResponseRead  = gin.H{"error": map[string]interface{}{"type": "response_read_error", "message": "Failed to read error response"}}
+	errResponseBody  = gin.H{"error": map[string]interface{}{"type": "response_read_error", "message": "Failed to read response"}}
 )
 
 // OAuthTokenResponse 表示OAuth token刷新响应
@@ -84,50 +85,65 @@ type OAuthTokenResponse struct {
 }
 
 // HandleClaudeRequest 处理Claude官方API平台的请求
-func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []byte) {
+// canRetry 为 true 时，向客户端写出任何数据之前发生的可重试错误不会响应给客户端，而是返回可重试结果由调用方切换账号
+func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []byte, canRetry bool) *RelayResult {
 	startTime := time.Now()
 
 	apiKey := extractAPIKey(c)
 
 	requestData := prepareRequestBody(c, requestBody)
 
-	accessToken, err := getValidAccessToken(account)
+	accessToken, err := getValidAccessToken(c.Request.Context(), account)
 	if err != nil {
 		log.Printf("获取有效访问token失败: %v", err)
+		if canFailover(c, canRetry) {
+			return retryableResult(http.StatusInternalServerError, "failed to get valid access token: %v", err)
+		}
 		respondStreamError(c, http.StatusInternalServerError, appendErrorMessage(errAuthFailed, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
 	client := createHTTPClient(account)
 	if client == nil {
+		if canFailover(c, canRetry) {
+			return retryableResult(http.StatusInternalServerError, "invalid proxy URI")
+		}
 		respondStreamError(c, http.StatusInternalServerError, errProxyConfig)
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: "invalid proxy URI"}
 	}
 
 	req, err := createClaudeRequest(c, requestData.Body, accessToken)
 	if err != nil {
 		respondStreamError(c, http.StatusInternalServerError, appendErrorMessage(errCreateRequest, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
+	upstreamSpan := startUpstreamSpan(c, account)
+	defer upstreamSpan.End()
 	resp, err := client.Do(req)
+	traceUpstreamResponse(upstreamSpan, resp, err)
 	if err != nil {
+		if canFailover(c, canRetry) && isRetryableRequestError(err) {
+			return retryableResult(http.StatusBadGateway, "request failed: %v", err)
+		}
 		handleRequestError(c, err)
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 	defer common.CloseIO(resp.Body)
+	recordUpstreamRequestID(c, resp)
 
 	responseReader, err := createResponseReader(resp)
 	if err != nil {
 		respondStreamError(c, http.StatusInternalServerError, appendErrorMessage(errDecompression, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
 	var usageTokens *common.TokenUsage
 	if resp.StatusCode < statusBadRequest {
-		usageTokens = handleSuccessResponse(c, resp, responseReader)
-	} else {
-		handleErrorResponse(c, resp, responseReader, account)
+		usageTokens = handleSuccessResponse(c, resp, responseReader, isClientStream(c))
+	} else if result := handleErrorResponse(c, resp, responseReader, account, canRetry); result.Retryable {
+		updateAccountAndStats(account, resp.StatusCode, nil)
+		return result
 	}
 
 	updateAccountAndStats(account, resp.StatusCode, usageTokens)
@@ -136,7 +152,9 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []b
 		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
 	}
 
-	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, true)
+	saveRequestLog(c, startTime, apiKey, account, resp.StatusCode, usageTokens, isClientStream(c))
+
+	return &RelayResult{StatusCode: resp.StatusCode}
 }
 
 // requestData 封装请求数据
@@ -152,15 +170,20 @@ func extractAPIKey(c *gin.Context) *model.ApiKey {
 	return nil
 }
 
-// prepareRequestBody 准备请求体，添加必要的字段
+// isClientStream 客户端是否请求流式响应（由控制器根据请求体的 stream 字段写入上下文）
+func isClientStream(c *gin.Context) bool {
+	return c.GetBool("is_stream")
+}
+
+// prepareRequestBody 准备请求体，添加必要的字段（stream 字段保持客户端原值）
 func prepareRequestBody(c *gin.Context, requestBody []byte) *requestData {
-	body, _ := sjson.SetBytes(requestBody, "stream", true) // 强制流式输出
+	var body []byte
 
 	// 上下文中提取分组ID
 	if groupID, exists := c.Get("group_id"); exists {
-		body, _ = sjson.SetBytes(body, "metadata.user_id", model.GetInstanceID(uint(groupID.(int))))
+		body, _ = sjson.SetBytes(requestBody, "metadata.user_id", model.GetInstanceID(uint(groupID.(int))))
 	} else {
-		body, _ = sjson.SetBytes(body, "metadata.user_id", common.GetInstanceID()) // 设置固定的用户ID
+		body, _ = sjson.SetBytes(requestBody, "metadata.user_id", common.GetInstanceID()) // 设置固定的用户ID
 	}
 
 	return &requestData{Body: body}
@@ -242,10 +265,15 @@ func setClaudeAPIHeaders(req *http.Request, accessToken string) {
 	req.Header.Del("Cookie")
 }
 
-// setStreamHeaders 设置流式请求头
+// setStreamHeaders 根据客户端是否流式设置Accept请求头
 func setStreamHeaders(c *gin.Context, req *http.Request) {
-	if c.Request.Header.Get("Accept") == "" {
+	if c.Request.Header.Get("Accept") != "" {
+		return
+	}
+	if isClientStream(c) {
 		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
 	}
 }
 
@@ -286,7 +314,11 @@ func createResponseReader(resp *http.Response) (io.Reader, error) {
 }
 
 // handleSuccessResponse 处理成功响应
-func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, isStream bool) *common.TokenUsage {
+	if !isStream {
+		return handleJSONResponse(c, resp, responseReader)
+	}
+
 	c.Status(resp.StatusCode)
 	copyResponseHeaders(c, resp)
 	setStreamResponseHeaders(c)
@@ -301,27 +333,57 @@ func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader i
 	return usageTokens
 }
 
-// handleErrorResponse 处理错误响应
-func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account) {
+// handleJSONResponse 处理非流式成功响应，读取完整响应体后原样返回
+func handleJSONResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+	responseBody, err := io.ReadAll(responseReader)
+	if err != nil {
+		log.Printf("❌ 读取响应失败: %v", err)
+		c.JSON(http.StatusBadGateway, appendErrorMessage(errResponseBody, err.Error()))
+		return nil
+	}
+
+	copyResponseHeaders(c, resp)
+	c.Writer.Header().Del("Content-Encoding") // 响应体已解压
+
+	usageTokens, _ := common.ParseJSONResponse(responseBody)
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
+
+	return usageTokens
+}
+
+// handleErrorResponse 处理错误响应，允许切换账号时不向客户端写出可重试的错误
+func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account, canRetry bool) *RelayResult {
 	responseBody, err := io.ReadAll(responseReader)
 	if err != nil {
 		log.Printf("❌ 读取错误响应失败: %v", err)
+		if canFailover(c, canRetry) {
+			return retryableResult(resp.StatusCode, "failed to read error response: %v", err)
+		}
 		c.JSON(http.StatusInternalServerError, appendErrorMessage(errResponseRead, err.Error()))
-		return
+		return &RelayResult{StatusCode: resp.StatusCode, Error: err.Error()}
 	}
 
 	log.Printf("❌ 状态码: %s, 错误响应内容: %s", strconv.Itoa(resp.StatusCode), string(responseBody))
 
+	isRateLimited := handleRateLimit(resp, responseBody, account)
+	if canFailover(c, canRetry) && isRetryableStatus(resp.StatusCode, isRateLimited) {
+		return retryableResult(resp.StatusCode, "%s", string(responseBody))
+	}
+
 	c.Status(resp.StatusCode)
 	copyResponseHeaders(c, resp)
 
-	handleRateLimit(resp, responseBody, account)
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
+	return &RelayResult{StatusCode: resp.StatusCode, Error: string(responseBody)}
 }
 
 // copyResponseHeaders 复制响应头
 func copyResponseHeaders(c *gin.Context, resp *http.Response) {
 	for name, values := range resp.Header {
+		// API Key配置了限流时保留中转自身的限流响应头
+		if strings.HasPrefix(strings.ToLower(name), "anthropic-ratelimit-") && c.Writer.Header().Get(name) != "" {
+			continue
+		}
 		if strings.ToLower(name) != "content-length" {
 			for _, value := range values {
 				c.Header(name, value)
@@ -339,11 +401,11 @@ func setStreamResponseHeaders(c *gin.Context) {
 	}
 }
 
-// handleRateLimit 处理限流逻辑
-func handleRateLimit(resp *http.Response, responseBody []byte, account *model.Account) {
+// handleRateLimit 处理限流逻辑，返回账号是否被限流
+func handleRateLimit(resp *http.Response, responseBody []byte, account *model.Account) bool {
 	isRateLimited, resetTimestamp := detectRateLimit(resp, responseBody)
 	if !isRateLimited {
-		return
+		return false
 	}
 
 	log.Printf("🚫 检测到账号 %s 被限流，状态码: %d", account.Name, resp.StatusCode)
@@ -362,9 +424,13 @@ func handleRateLimit(resp *http.Response, responseBody []byte, account *model.Ac
 		log.Printf("账号 %s 限流至 %s (默认5小时)", account.Name, resetTime.Format(time.RFC3339))
 	}
 
-	if err := model.UpdateAccount(account); err != nil {
+	if err := model.UpdateAccountRateLimit(account.ID, account.CurrentStatus, account.RateLimitEndTime); err != nil {
 		log.Printf("更新账号限流状态失败: %v", err)
 	}
+	service.EmitAccountAlert(account, service.AlertAccountRateLimited,
+		fmt.Sprintf("上游返回状态码 %d，限流至 %s", resp.StatusCode, time.Time(*account.RateLimitEndTime).Format("2006-01-02 15:04:05")))
+
+	return true
 }
 
 // detectRateLimit 检测限流状态
@@ -413,7 +479,7 @@ func clearRateLimitIfExpired(account *model.Account) {
 		if now.After(time.Time(*account.RateLimitEndTime)) {
 			account.CurrentStatus = accountStatusActive
 			account.RateLimitEndTime = nil
-			if err := model.UpdateAccount(account); err != nil {
+			if err := model.ClearAccountRateLimit(account.ID, accountStatusRateLimit, accountStatusActive); err != nil {
 				log.Printf("重置账号限流状态失败: %v", err)
 			} else {
 				log.Printf("账号 %s 限流状态已自动重置", account.Name)
@@ -422,17 +488,33 @@ func clearRateLimitIfExpired(account *model.Account) {
 	}
 }
 
-// saveRequestLog 保存请求日志
-func saveRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
+// saveRequestLog 保存请求日志，并结算请求的预占额度
+func saveRequestLog(c *gin.Context, startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
+	settleBudgetReservation(c, statusCode, usageTokens)
+
 	if statusCode >= statusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
-		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream)
-			if err != nil {
-				log.Printf("保存日志失败: %v", err)
-			}
-		}()
+		if entry, err := logService.EnqueueLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream, applyStreamTiming(buildRequestLogMeta(c, statusCode, len(GetRelayAttempts(c))), usageTokens, startTime)); err != nil {
+			log.Printf("保存日志失败: %v", err)
+		} else {
+			c.Set(requestLogIDKey, entry.ID)
+			recordUsageMetrics(c, account, entry)
+		}
+	}
+}
+
+// settleBudgetReservation 按实际费用结算请求开始时预占的每日限额，失败的请求只释放预占
+func settleBudgetReservation(c *gin.Context, statusCode int, usageTokens *common.TokenUsage) {
+	value, exists := c.Get("budget_reservation")
+	if !exists {
+		return
+	}
+	reservation := value.(*service.BudgetReservation)
+	if statusCode >= statusOK && statusCode < 300 {
+		reservation.Settle(usageTokens)
+	} else {
+		reservation.Release()
 	}
 }
 
@@ -443,8 +525,13 @@ func appendErrorMessage(baseError gin.H, message string) gin.H {
 	return gin.H{"error": errorMap}
 }
 
-// respondStreamError 以流式格式返回错误响应
+// respondStreamError 以流式格式返回错误响应，非流式请求返回JSON
 func respondStreamError(c *gin.Context, statusCode int, errorMsg gin.H) {
+	if !isClientStream(c) {
+		c.JSON(statusCode, errorMsg)
+		return
+	}
+
 	c.Status(statusCode)
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -463,7 +550,7 @@ func TestsHandleClaudeRequest(account *model.Account) (int, string) {
 	body, _ := sjson.SetBytes([]byte(common.TestRequestBody), "stream", true)
 
 	// 获取有效的访问token
-	accessToken, err := getValidAccessToken(account)
+	accessToken, err := getValidAccessToken(context.Background(), account)
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to get valid access token: " + err.Error()
 	}
@@ -523,61 +610,28 @@ func buildClaudeAPIHeaders(accessToken string, anthropicBeta string) map[string]
 }
 
 // getValidAccessToken 获取有效的访问token，如果过期则自动刷新
-func getValidAccessToken(account *model.Account) (string, error) {
+// 正常情况下token由定时任务提前刷新，这里只处理定时任务未覆盖到的情况
+func getValidAccessToken(ctx context.Context, account *model.Account) (string, error) {
 	// 检查当前token是否存在
 	if account.AccessToken == "" {
 		return "", errors.New("账号缺少访问token")
 	}
 
-	// 检查token是否过期（提前5分钟刷新）
-	now := time.Now().Unix()
-	expiresAt := int64(account.ExpiresAt)
-
 	// 如果过期时间存在且距离过期不到5分钟，或者已经过期，则需要刷新
-	if expiresAt > 0 && now >= (expiresAt-int64(tokenRefreshBuffer)) {
+	if tokenNeedsRefresh(account, time.Duration(tokenRefreshBuffer)*time.Second) {
 		log.Printf("账号 %s 的token即将过期或已过期，尝试刷新", account.Name)
 
-		if account.RefreshToken == "" {
-			return "", errors.New("账号缺少刷新token，无法自动刷新")
-		}
-
-		// 刷新token
-		newAccessToken, newRefreshToken, newExpiresAt, err := refreshToken(account)
-		if err != nil {
+		if err := RefreshAccountToken(ctx, account, time.Duration(tokenRefreshBuffer)*time.Second); err != nil {
 			log.Printf("刷新token失败: %v", err)
 			// 刷新失败时，如果当前token未完全过期，仍尝试使用
-			if now < expiresAt {
+			if time.Now().Unix() < int64(account.ExpiresAt) {
 				log.Printf("刷新失败但token未完全过期，尝试使用当前token")
 				return account.AccessToken, nil
 			}
-
-			// token已过期且刷新失败，禁用此账号
-			log.Printf("token已过期且刷新失败，禁用账号: %s", account.Name)
-			account.CurrentStatus = accountStatusDisabled // 设置为禁用状态
-			if updateErr := model.UpdateAccount(account); updateErr != nil {
-				log.Printf("禁用账号失败: %v", updateErr)
-			} else {
-				log.Printf("账号 %s 已被自动禁用", account.Name)
-			}
 			return "", fmt.Errorf("token已过期且刷新失败: %v", err)
 		}
-
-		// 更新账号信息
-		account.AccessToken = newAccessToken
-		account.RefreshToken = newRefreshToken
-		account.ExpiresAt = int(newExpiresAt)
-
-		// 保存到数据库
-		if err := model.UpdateAccount(account); err != nil {
-			log.Printf("更新账号token信息到数据库失败: %v", err)
-			// 不返回错误，因为内存中的token已经更新
-		}
-
-		log.Printf("账号 %s token刷新成功", account.Name)
-		return newAccessToken, nil
 	}
 
-	// token还有效，直接返回
 	return account.AccessToken, nil
 }
 
@@ -665,7 +719,7 @@ func maskToken(token string) string {
 
 // GetCountTokens 统计请求中的token数量，供速率限制和计费使用
 func GetCountTokens(c *gin.Context, account *model.Account, requestBody []byte) {
-	accessToken, err := getValidAccessToken(account)
+	accessToken, err := getValidAccessToken(c.Request.Context(), account)
 	if err != nil {
 		log.Printf("获取有效访问token失败: %v", err)
 		c.JSON(http.StatusInternalServerError, appendErrorMessage(errAuthFailed, err.Error()))
@@ -49,10 +49,12 @@ var (
 	consoleErrTimeout         = gin.H{"error": map[string]interface{}{"type": "timeout_error", "message": "Request was canceled or timed out"}}
 	consoleErrNetworkError    = gin.H{"error": map[string]interface{}{"type": "network_error", "message": "Failed to execute request"}}
 	consoleErrDecompression   = gin.H{"error": map[string]interface{}{"type": "decompression_error", "message": "Failed to create decompressor"}}
+	consoleErrResponseBody    = gin.H{"error": map[string]interface{}{"type": "response_read_error", "message": "Failed to read response"}}
 )
 
 // HandleClaudeConsoleRequest 处理Claude Console平台的请求
-func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestBody []byte) {
+// canRetry 为 true 时，向客户端写出任何数据之前发生的可重试错误由调用方切换账号处理
+func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestBody []byte, canRetry bool) *RelayResult {
 	startTime := time.Now()
 
 	apiKey := extractConsoleAPIKey(c)
@@ -60,39 +62,50 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 	body, err := parseConsoleRequest(c, requestBody)
 	if err != nil {
 		respondConsoleStreamError(c, http.StatusBadRequest, appendConsoleErrorMessage(consoleErrRequestBodyRead, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusBadRequest, Error: err.Error()}
 	}
 
 	client := createConsoleHTTPClient(account)
 	if client == nil {
+		if canFailover(c, canRetry) {
+			return retryableResult(http.StatusInternalServerError, "invalid proxy URI")
+		}
 		respondConsoleStreamError(c, http.StatusInternalServerError, consoleErrProxyConfig)
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: "invalid proxy URI"}
 	}
 
 	req, err := createConsoleRequest(c, body, account)
 	if err != nil {
 		respondConsoleStreamError(c, http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrCreateRequest, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
+	upstreamSpan := startUpstreamSpan(c, account)
+	defer upstreamSpan.End()
 	resp, err := client.Do(req)
+	traceUpstreamResponse(upstreamSpan, resp, err)
 	if err != nil {
+		if canFailover(c, canRetry) && isRetryableRequestError(err) {
+			return retryableResult(http.StatusBadGateway, "request failed: %v", err)
+		}
 		handleConsoleRequestError(c, err)
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 	defer common.CloseIO(resp.Body)
+	recordUpstreamRequestID(c, resp)
 
 	responseReader, err := createConsoleResponseReader(resp)
 	if err != nil {
 		respondConsoleStreamError(c, http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrDecompression, err.Error()))
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
 	var usageTokens *common.TokenUsage
 	if resp.StatusCode < consoleStatusBadRequest {
-		usageTokens = handleConsoleSuccessResponse(c, resp, responseReader)
-	} else {
-		handleConsoleErrorResponse(c, resp, responseReader, account)
+		usageTokens = handleConsoleSuccessResponse(c, resp, responseReader, isClientStream(c))
+	} else if result := handleConsoleErrorResponse(c, resp, responseReader, account, canRetry); result.Retryable {
+		updateConsoleAccountAndStats(account, resp.StatusCode, nil)
+		return result
 	}
 
 	updateConsoleAccountAndStats(account, resp.StatusCode, usageTokens)
@@ -103,7 +116,9 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 	}
 
 	// 保存请求日志
-	saveConsoleRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens)
+	saveConsoleRequestLog(c, startTime, apiKey, account, resp.StatusCode, usageTokens, isClientStream(c))
+
+	return &RelayResult{StatusCode: resp.StatusCode}
 }
 
 // extractConsoleAPIKey 从上下文中提取API Key
@@ -114,10 +129,8 @@ func extractConsoleAPIKey(c *gin.Context) *model.ApiKey {
 	return nil
 }
 
-// parseConsoleRequest 解析Console请求
+// parseConsoleRequest 解析Console请求（stream 字段保持客户端原值）
 func parseConsoleRequest(c *gin.Context, requestBody []byte) ([]byte, error) {
-	body, _ := sjson.SetBytes(requestBody, "stream", true) // 强制流式输出
-
 	userID := ""
 	// 上下文中提取分组ID
 	if groupID, exists := c.Get("group_id"); exists {
@@ -126,7 +139,7 @@ func parseConsoleRequest(c *gin.Context, requestBody []byte) ([]byte, error) {
 		userID = fmt.Sprintf("user_%x_account__session_%s", common.GetInstanceID(), uuid.New().String())
 	}
 
-	body, _ = sjson.SetBytes(body, "metadata.user_id", userID)
+	body, _ := sjson.SetBytes(requestBody, "metadata.user_id", userID)
 	return body, nil
 }
 
@@ -215,10 +228,15 @@ func buildConsoleAPIHeaders(secretKey string, anthropicBeta string) map[string]s
 	return common.MergeHeaders(customRequestHeaders, anthropicBeta)
 }
 
-// setConsoleStreamHeaders 设置Console流式请求头
+// setConsoleStreamHeaders 根据客户端是否流式设置Console的Accept请求头
 func setConsoleStreamHeaders(c *gin.Context, req *http.Request) {
-	if c.Request.Header.Get("Accept") == "" {
+	if c.Request.Header.Get("Accept") != "" {
+		return
+	}
+	if isClientStream(c) {
 		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
 	}
 }
 
@@ -259,11 +277,15 @@ func createConsoleResponseReader(resp *http.Response) (io.Reader, error) {
 }
 
 // handleConsoleSuccessResponse 处理Console成功响应
-func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, isStream bool) *common.TokenUsage {
 	if (resp.StatusCode < consoleStatusOK || resp.StatusCode >= consoleStatusBadRequest) || responseReader == nil {
 		return nil
 	}
 
+	if !isStream {
+		return handleConsoleJSONResponse(c, resp, responseReader)
+	}
+
 	c.Status(resp.StatusCode)
 	copyConsoleResponseHeaders(c, resp)
 	setConsoleStreamResponseHeaders(c)
@@ -278,9 +300,31 @@ func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseR
 	return usageTokens
 }
 
+// handleConsoleJSONResponse 处理Console非流式成功响应，读取完整响应体后原样返回
+func handleConsoleJSONResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+	responseBody, err := io.ReadAll(responseReader)
+	if err != nil {
+		log.Printf("❌ 读取响应失败: %v", err)
+		c.JSON(http.StatusBadGateway, appendConsoleErrorMessage(consoleErrResponseBody, err.Error()))
+		return nil
+	}
+
+	copyConsoleResponseHeaders(c, resp)
+	c.Writer.Header().Del("Content-Encoding") // 响应体已解压
+
+	usageTokens, _ := common.ParseJSONResponse(responseBody)
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
+
+	return usageTokens
+}
+
 // copyConsoleResponseHeaders 复制Console响应头
 func copyConsoleResponseHeaders(c *gin.Context, resp *http.Response) {
 	for name, values := range resp.Header {
+		// API Key配置了限流时保留中转自身的限流响应头
+		if strings.HasPrefix(strings.ToLower(name), "anthropic-ratelimit-") && c.Writer.Header().Get(name) != "" {
+			continue
+		}
 		if strings.ToLower(name) != "content-length" {
 			for _, value := range values {
 				c.Header(name, value)
@@ -298,17 +342,19 @@ func setConsoleStreamResponseHeaders(c *gin.Context) {
 	}
 }
 
-// saveConsoleRequestLog 保存Console请求日志
-func saveConsoleRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage) {
+// saveConsoleRequestLog 保存Console请求日志，并结算请求的预占额度
+func saveConsoleRequestLog(c *gin.Context, startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
+	settleBudgetReservation(c, statusCode, usageTokens)
+
 	if statusCode >= consoleStatusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
-		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, true)
-			if err != nil {
-				log.Printf("保存日志失败: %v", err)
-			}
-		}()
+		if entry, err := logService.EnqueueLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream, applyStreamTiming(buildRequestLogMeta(c, statusCode, len(GetRelayAttempts(c))), usageTokens, startTime)); err != nil {
+			log.Printf("保存日志失败: %v", err)
+		} else {
+			c.Set(requestLogIDKey, entry.ID)
+			recordUsageMetrics(c, account, entry)
+		}
 	}
 }
 
@@ -319,8 +365,13 @@ func appendConsoleErrorMessage(baseError gin.H, message string) gin.H {
 	return gin.H{"error": errorMap}
 }
 
-// respondConsoleStreamError 以流式格式返回Console错误响应
+// respondConsoleStreamError 以流式格式返回Console错误响应，非流式请求返回JSON
 func respondConsoleStreamError(c *gin.Context, statusCode int, errorMsg gin.H) {
+	if !isClientStream(c) {
+		c.JSON(statusCode, errorMsg)
+		return
+	}
+
 	c.Status(statusCode)
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -333,29 +384,37 @@ func respondConsoleStreamError(c *gin.Context, statusCode int, errorMsg gin.H) {
 	c.Writer.Flush()
 }
 
-// handleConsoleErrorResponse 处理错误响应
-func handleConsoleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account) {
+// handleConsoleErrorResponse 处理错误响应，允许切换账号时不向客户端写出可重试的错误
+func handleConsoleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account, canRetry bool) *RelayResult {
 	responseBody, err := io.ReadAll(responseReader)
 	if err != nil {
 		log.Printf("❌ 读取错误响应失败: %v", err)
+		if canFailover(c, canRetry) {
+			return retryableResult(resp.StatusCode, "failed to read error response: %v", err)
+		}
 		c.JSON(http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrDecompression, err.Error()))
-		return
+		return &RelayResult{StatusCode: resp.StatusCode, Error: err.Error()}
 	}
 
 	log.Printf("❌ 状态码: %s, 错误响应内容: %s", strconv.Itoa(resp.StatusCode), string(responseBody))
 
+	isRateLimited := handleConsoleRateLimit(resp, responseBody, account)
+	if canFailover(c, canRetry) && isRetryableStatus(resp.StatusCode, isRateLimited) {
+		return retryableResult(resp.StatusCode, "%s", string(responseBody))
+	}
+
 	c.Status(resp.StatusCode)
 	copyConsoleResponseHeaders(c, resp)
 
-	handleConsoleRateLimit(resp, responseBody, account)
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
+	return &RelayResult{StatusCode: resp.StatusCode, Error: string(responseBody)}
 }
 
-// handleConsoleRateLimit 处理Console限流逻辑
-func handleConsoleRateLimit(resp *http.Response, responseBody []byte, account *model.Account) {
+// handleConsoleRateLimit 处理Console限流逻辑，返回账号是否被限流
+func handleConsoleRateLimit(resp *http.Response, responseBody []byte, account *model.Account) bool {
 	isRateLimited, resetTimestamp := detectConsoleRateLimit(resp, responseBody)
 	if !isRateLimited {
-		return
+		return false
 	}
 
 	log.Printf("🚫 检测到Console账号 %s 被限流，状态码: %d", account.Name, resp.StatusCode)
@@ -376,9 +435,13 @@ func handleConsoleRateLimit(resp *http.Response, responseBody []byte, account *m
 		log.Printf("Console账号 %s 限流至 %s (默认至当天晚上0点)", account.Name, resetTime.Format(time.RFC3339))
 	}
 
-	if err := model.UpdateAccount(account); err != nil {
+	if err := model.UpdateAccountRateLimit(account.ID, account.CurrentStatus, account.RateLimitEndTime); err != nil {
 		log.Printf("更新Console账号限流状态失败: %v", err)
 	}
+	service.EmitAccountAlert(account, service.AlertAccountRateLimited,
+		fmt.Sprintf("上游返回状态码 %d，限流至 %s", resp.StatusCode, time.Time(*account.RateLimitEndTime).Format("2006-01-02 15:04:05")))
+
+	return true
 }
 
 // detectConsoleRateLimit 检测Console限流状态
@@ -427,7 +490,7 @@ func clearConsoleRateLimitIfExpired(account *model.Account) {
 		if now.After(time.Time(*account.RateLimitEndTime)) {
 			account.CurrentStatus = consoleAccountStatusActive
 			account.RateLimitEndTime = nil
-			if err := model.UpdateAccount(account); err != nil {
+			if err := model.ClearAccountRateLimit(account.ID, consoleAccountStatusRateLimit, consoleAccountStatusActive); err != nil {
 				log.Printf("重置Console账号限流状态失败: %v", err)
 			} else {
 				log.Printf("Console账号 %s 限流状态已自动重置", account.Name)
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 默认最大尝试次数（含首次请求）
+	defaultRelayMaxAttempts = 3
+
+	// 上游过载状态码
+	statusOverloaded = 529
+
+	// 上下文中记录尝试列表的键
+	relayAttemptsKey = "relay_attempts"
+)
+
+// RelayResult 单次账号中转的结果
+type RelayResult struct {
+	StatusCode int    // 上游返回的状态码，网络错误时为本地生成的状态码
+	Retryable  bool   // 失败发生在向客户端写出任何数据之前，可以切换到下一个账号重试
+	Error      string // 失败原因
+}
+
+// RelayAttempt 一次账号尝试的记录
+type RelayAttempt struct {
+	AccountID         uint   `json:"account_id"`
+	AccountName       string `json:"account_name"`
+	StatusCode        int    `json:"status_code"`
+	Error             string `json:"error,omitempty"`
+	UpstreamRequestID string `json:"upstream_request_id,omitempty"`
+	Duration          int64  `json:"duration"` // 耗时(毫秒)
+}
+
+// GetRelayMaxAttempts 获取单个请求最多尝试的账号数
+func GetRelayMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv("RELAY_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		return attempts
+	}
+	return defaultRelayMaxAttempts
+}
+
+// RecordRelayAttempt 记录一次账号尝试到请求上下文
+func RecordRelayAttempt(c *gin.Context, account *model.Account, result *RelayResult, startTime time.Time) {
+	attempt := RelayAttempt{
+		AccountID:         account.ID,
+		AccountName:       account.Name,
+		UpstreamRequestID: c.GetString(upstreamRequestIDKey),
+		Duration:          time.Since(startTime).Milliseconds(),
+	}
+	recordRelayMetrics(c, account, result, time.Since(startTime))
+	// 清除本次尝试的上游request-id，避免下一次尝试沿用
+	c.Set(upstreamRequestIDKey, "")
+	if result != nil {
+		attempt.StatusCode = result.StatusCode
+		attempt.Error = result.Error
+	}
+
+	attempts := append(GetRelayAttempts(c), attempt)
+	c.Set(relayAttemptsKey, attempts)
+
+	if result != nil && result.Retryable {
+		log.Printf("🔁 账号 %s (ID: %d) 第%d次尝试失败，状态码: %d, 原因: %s", account.Name, account.ID, len(attempts), result.StatusCode, result.Error)
+	}
+}
+
+// GetRelayAttempts 获取当前请求已记录的账号尝试
+func GetRelayAttempts(c *gin.Context) []RelayAttempt {
+	if value, exists := c.Get(relayAttemptsKey); exists {
+		if attempts, ok := value.([]RelayAttempt); ok {
+			return attempts
+		}
+	}
+	return nil
+}
+
+// isRetryableStatus 判断上游错误状态码是否值得切换账号重试
+func isRetryableStatus(statusCode int, isRateLimited bool) bool {
+	return isRateLimited ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode == statusOverloaded ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// isRetryableRequestError 判断请求错误是否值得切换账号重试（客户端主动取消的请求不重试）
+func isRetryableRequestError(err error) bool {
+	return !errors.Is(err, context.Canceled)
+}
+
+// canFailover 判断当前是否还能切换账号：允许重试且尚未向客户端写出任何数据
+func canFailover(c *gin.Context, canRetry bool) bool {
+	return canRetry && !c.Writer.Written()
+}
+
+// retryableResult 构造可重试的结果
+func retryableResult(statusCode int, format string, args ...interface{}) *RelayResult {
+	return &RelayResult{
+		StatusCode: statusCode,
+		Retryable:  true,
+		Error:      fmt.Sprintf(format, args...),
+	}
+}
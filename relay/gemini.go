@@ -0,0 +1,733 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Gemini默认API基础URL（账号未配置请求地址时使用）
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com"
+
+	// Gemini默认目标模型，会被模型映射覆盖
+	defaultGeminiModel = "gemini-2.5-pro"
+
+	// Gemini单个SSE事件的最大长度
+	geminiMaxEventSize = 10 * 1024 * 1024
+)
+
+// Gemini API 类型定义
+type GeminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type GeminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *GeminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig GeminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type GeminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// Gemini 响应类型定义
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+}
+
+type GeminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+}
+
+type GeminiPromptFeedback struct {
+	BlockReason string `json:"blockReason"`
+}
+
+type GeminiResponse struct {
+	Candidates     []GeminiCandidate     `json:"candidates"`
+	PromptFeedback *GeminiPromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *GeminiUsageMetadata  `json:"usageMetadata,omitempty"`
+}
+
+// HandleGeminiRequest 处理 Gemini 平台请求的中转
+// canRetry 为 true 时，向客户端写出任何数据之前发生的可重试错误由调用方切换账号处理
+func HandleGeminiRequest(c *gin.Context, account *model.Account, requestBody []byte, canRetry bool) *RelayResult {
+	startTime := time.Now()
+
+	apiKey := extractAPIKey(c)
+
+	// 解析Claude请求
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal(requestBody, &claudeReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_parse_error",
+				"message": "Failed to parse request JSON: " + err.Error(),
+			},
+		})
+		return &RelayResult{StatusCode: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	// 应用模型映射并转换为Gemini格式
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, defaultGeminiModel)
+	geminiBody, err := json.Marshal(convertClaudeToGemini(claudeReq))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_marshal_error",
+				"message": "Failed to marshal Gemini request: " + err.Error(),
+			},
+		})
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	client := createHTTPClient(account)
+	if client == nil {
+		if canFailover(c, canRetry) {
+			return retryableResult(http.StatusInternalServerError, "invalid proxy URI")
+		}
+		c.JSON(http.StatusInternalServerError, errProxyConfig)
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: "invalid proxy URI"}
+	}
+
+	// 统一使用流式接口，非流式客户端在本地聚合
+	req, err := createGeminiRequest(c, account, mappedModelName, geminiBody)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errCreateRequest, err.Error()))
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	upstreamSpan := startUpstreamSpan(c, account)
+	defer upstreamSpan.End()
+	resp, err := client.Do(req)
+	traceUpstreamResponse(upstreamSpan, resp, err)
+	if err != nil {
+		log.Printf("Gemini API request failed: %v", err)
+		if canFailover(c, canRetry) && isRetryableRequestError(err) {
+			return retryableResult(http.StatusBadGateway, "request failed: %v", err)
+		}
+		c.JSON(http.StatusInternalServerError, appendErrorMessage(errNetworkError, err.Error()))
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	defer common.CloseIO(resp.Body)
+	recordUpstreamRequestID(c, resp)
+
+	accountService := service.NewAccountService()
+	if resp.StatusCode >= 400 {
+		accountService.UpdateAccountStatus(account, resp.StatusCode, nil)
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		log.Printf("❌ Gemini状态码: %d, 错误响应内容: %s", resp.StatusCode, string(bodyBytes))
+		if canFailover(c, canRetry) && isRetryableStatus(resp.StatusCode, false) {
+			return retryableResult(resp.StatusCode, "%s", string(bodyBytes))
+		}
+		c.Data(resp.StatusCode, "application/json", bodyBytes)
+		return &RelayResult{StatusCode: resp.StatusCode, Error: string(bodyBytes)}
+	}
+
+	if claudeReq.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Writer.Flush()
+	}
+
+	transformer := createGeminiStreamTransformer(claudeReq.Model, claudeReq.Stream)
+	usageTokens := processGeminiStreamResponse(c.Writer, resp.Body, transformer)
+
+	// 更新账号状态和统计信息
+	go accountService.UpdateAccountStatus(account, resp.StatusCode, usageTokens)
+
+	// 更新API Key统计信息
+	if apiKey != nil {
+		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
+	}
+
+	// 保存日志记录
+	saveRequestLog(c, startTime, apiKey, account, resp.StatusCode, usageTokens, claudeReq.Stream)
+
+	return &RelayResult{StatusCode: resp.StatusCode}
+}
+
+// createGeminiRequest 创建Gemini流式请求
+func createGeminiRequest(c *gin.Context, account *model.Account, modelName string, body []byte) (*http.Request, error) {
+	baseURL := strings.TrimRight(account.RequestURL, "/")
+	if baseURL == "" {
+		baseURL = defaultGeminiBaseURL
+	}
+	requestURL := fmt.Sprintf("%s/v1beta/models/%s:streamGenerateContent?alt=sse", baseURL, modelName)
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", requestURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("x-goog-api-key", account.SecretKey)
+
+	return req, nil
+}
+
+// convertClaudeToGemini 将Claude请求转换为Gemini格式
+func convertClaudeToGemini(claudeReq ClaudeRequest) GeminiRequest {
+	geminiReq := GeminiRequest{
+		GenerationConfig: &GeminiGenerationConfig{
+			MaxOutputTokens: claudeReq.MaxTokens,
+			Temperature:     claudeReq.Temperature,
+			TopP:            claudeReq.TopP,
+			TopK:            claudeReq.TopK,
+			StopSequences:   claudeReq.StopSequences,
+		},
+	}
+
+	// 添加system消息（支持字符串和数组格式）
+	if systemMessage := extractSystemMessage(claudeReq.System); systemMessage != "" {
+		geminiReq.SystemInstruction = &GeminiContent{
+			Parts: []GeminiPart{{Text: systemMessage}},
+		}
+	}
+
+	// tool_result 只携带 tool_use_id，Gemini 需要函数名，因此记录每个 tool_use 的名称
+	toolNames := make(map[string]string)
+
+	for _, message := range claudeReq.Messages {
+		role := "user"
+		if message.Role == "assistant" {
+			role = "model"
+		}
+
+		parts := convertClaudeContentToGeminiParts(message.Content, toolNames)
+		if len(parts) == 0 {
+			continue
+		}
+
+		// Gemini 要求角色交替出现，连续相同角色的消息合并
+		if n := len(geminiReq.Contents); n > 0 && geminiReq.Contents[n-1].Role == role {
+			geminiReq.Contents[n-1].Parts = append(geminiReq.Contents[n-1].Parts, parts...)
+			continue
+		}
+		geminiReq.Contents = append(geminiReq.Contents, GeminiContent{Role: role, Parts: parts})
+	}
+
+	// 转换工具
+	if len(claudeReq.Tools) > 0 {
+		var declarations []GeminiFunctionDeclaration
+		for _, tool := range claudeReq.Tools {
+			declarations = append(declarations, GeminiFunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  recursivelyCleanSchema(tool.InputSchema),
+			})
+		}
+		geminiReq.Tools = []GeminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	// 转换工具选择
+	if claudeReq.ToolChoice != nil {
+		switch claudeReq.ToolChoice.Type {
+		case "auto":
+			geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: GeminiFunctionCallingConfig{Mode: "AUTO"}}
+		case "any":
+			geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: GeminiFunctionCallingConfig{Mode: "ANY"}}
+		case "tool":
+			geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: GeminiFunctionCallingConfig{
+				Mode:                 "ANY",
+				AllowedFunctionNames: []string{claudeReq.ToolChoice.Name},
+			}}
+		case "none":
+			geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: GeminiFunctionCallingConfig{Mode: "NONE"}}
+		}
+	}
+
+	return geminiReq
+}
+
+// convertClaudeContentToGeminiParts 将Claude消息内容转换为Gemini parts
+func convertClaudeContentToGeminiParts(content interface{}, toolNames map[string]string) []GeminiPart {
+	if text, ok := content.(string); ok {
+		if text == "" {
+			return nil
+		}
+		return []GeminiPart{{Text: text}}
+	}
+
+	contentBlocks, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var parts []GeminiPart
+	for _, block := range contentBlocks {
+		blockMap, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch blockMap["type"] {
+		case "text":
+			if text, ok := blockMap["text"].(string); ok && text != "" {
+				parts = append(parts, GeminiPart{Text: text})
+			}
+		case "image":
+			if inlineData := convertClaudeImageToGemini(blockMap); inlineData != nil {
+				parts = append(parts, GeminiPart{InlineData: inlineData})
+			}
+		case "tool_use":
+			id, _ := blockMap["id"].(string)
+			name, _ := blockMap["name"].(string)
+			args, _ := blockMap["input"].(map[string]interface{})
+			toolNames[id] = name
+			parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{Name: name, Args: args}})
+		case "tool_result":
+			toolUseID, _ := blockMap["tool_use_id"].(string)
+			resultText, images := extractToolResultContent(blockMap["content"])
+
+			responseKey := "content"
+			if isError, ok := blockMap["is_error"].(bool); ok && isError {
+				responseKey = "error"
+			}
+
+			parts = append(parts, GeminiPart{FunctionResponse: &GeminiFunctionResponse{
+				Name:     toolNames[toolUseID],
+				Response: map[string]interface{}{responseKey: resultText},
+			}})
+			for _, image := range images {
+				parts = append(parts, GeminiPart{InlineData: image})
+			}
+		}
+	}
+
+	return parts
+}
+
+// convertClaudeImageToGemini 将Claude图片块转换为Gemini内联数据（仅支持base64来源）
+func convertClaudeImageToGemini(blockMap map[string]interface{}) *GeminiInlineData {
+	source, ok := blockMap["source"].(map[string]interface{})
+	if !ok || source["type"] != "base64" {
+		return nil
+	}
+
+	mediaType, _ := source["media_type"].(string)
+	data, _ := source["data"].(string)
+	return &GeminiInlineData{MimeType: mediaType, Data: data}
+}
+
+// extractToolResultContent 提取tool_result中的文本和图片
+func extractToolResultContent(content interface{}) (string, []*GeminiInlineData) {
+	switch v := content.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		var textParts []string
+		var images []*GeminiInlineData
+		for _, item := range v {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch itemMap["type"] {
+			case "text":
+				if text, ok := itemMap["text"].(string); ok {
+					textParts = append(textParts, text)
+				}
+			case "image":
+				if inlineData := convertClaudeImageToGemini(itemMap); inlineData != nil {
+					images = append(images, inlineData)
+				}
+			}
+		}
+		return strings.Join(textParts, "\n"), images
+	case nil:
+		return "", nil
+	default:
+		contentBytes, _ := json.Marshal(v)
+		return string(contentBytes), nil
+	}
+}
+
+// processGeminiStreamResponse 处理Gemini流式响应并转换为Claude格式
+func processGeminiStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *GeminiStreamTransformer) *common.TokenUsage {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), geminiMaxEventSize)
+
+	for scanner.Scan() {
+		transformer.usage.MarkFirstByte()
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var chunk GeminiResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &chunk); err != nil {
+			continue // 忽略解析错误的chunk
+		}
+
+		transformer.processChunk(writer, chunk)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Gemini stream read failed: %v", err)
+	}
+
+	transformer.finish(writer)
+
+	if transformer.usage.InputTokens > 0 || transformer.usage.OutputTokens > 0 {
+		return transformer.usage
+	}
+	return nil
+}
+
+// GeminiStreamTransformer 将Gemini流式响应转换为Claude SSE事件，同时聚合完整响应
+type GeminiStreamTransformer struct {
+	stream        bool
+	initialized   bool
+	messageID     string
+	model         string
+	blockIndex    int    // 下一个内容块的索引
+	openBlock     string // 当前未关闭的内容块类型（仅文本块会跨chunk保持打开）
+	hasToolUse    bool
+	promptBlocked bool
+	finishReason  string
+	content       []ClaudeContentBlock
+	usage         *common.TokenUsage
+}
+
+// createGeminiStreamTransformer 创建Gemini流式转换器
+func createGeminiStreamTransformer(model string, stream bool) *GeminiStreamTransformer {
+	return &GeminiStreamTransformer{
+		stream:    stream,
+		messageID: fmt.Sprintf("msg_%s", generateRandomID()),
+		model:     model,
+		usage:     &common.TokenUsage{Model: model},
+	}
+}
+
+// sendEvent 发送SSE事件（非流式客户端不发送）
+func (gt *GeminiStreamTransformer) sendEvent(writer gin.ResponseWriter, eventType string, data interface{}) {
+	if !gt.stream {
+		return
+	}
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+	writer.Flush()
+}
+
+// processChunk 处理单个Gemini响应chunk
+func (gt *GeminiStreamTransformer) processChunk(writer gin.ResponseWriter, chunk GeminiResponse) {
+	if !gt.initialized {
+		gt.sendEvent(writer, "message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":          gt.messageID,
+				"type":        "message",
+				"role":        "assistant",
+				"model":       gt.model,
+				"content":     []interface{}{},
+				"stop_reason": nil,
+				"usage": map[string]int{
+					"input_tokens":  0,
+					"output_tokens": 0,
+				},
+			},
+		})
+		gt.initialized = true
+	}
+
+	// usageMetadata 为累计值，以最后一次为准
+	if chunk.UsageMetadata != nil {
+		gt.usage.InputTokens = chunk.UsageMetadata.PromptTokenCount - chunk.UsageMetadata.CachedContentTokenCount
+		gt.usage.CacheReadInputTokens = chunk.UsageMetadata.CachedContentTokenCount
+		gt.usage.OutputTokens = chunk.UsageMetadata.CandidatesTokenCount + chunk.UsageMetadata.ThoughtsTokenCount
+	}
+
+	// 输入被拦截时没有候选结果
+	if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+		gt.promptBlocked = true
+	}
+
+	if len(chunk.Candidates) == 0 {
+		return
+	}
+
+	candidate := chunk.Candidates[0]
+	if candidate.FinishReason != "" {
+		gt.finishReason = candidate.FinishReason
+	}
+
+	for _, part := range candidate.Content.Parts {
+		switch {
+		case part.Thought:
+			// 思考内容没有Claude签名，不转发给客户端
+			continue
+		case part.FunctionCall != nil:
+			gt.emitToolUse(writer, part.FunctionCall)
+		case part.Text != "":
+			gt.emitText(writer, part.Text)
+		}
+	}
+}
+
+// emitText 输出文本增量，必要时开启新的文本块
+func (gt *GeminiStreamTransformer) emitText(writer gin.ResponseWriter, text string) {
+	gt.usage.MarkFirstContent()
+	if gt.openBlock != "text" {
+		gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+			"type":  "content_block_start",
+			"index": gt.blockIndex,
+			"content_block": map[string]interface{}{
+				"type": "text",
+				"text": "",
+			},
+		})
+		gt.openBlock = "text"
+		gt.content = append(gt.content, ClaudeContentBlock{Type: "text"})
+	}
+
+	gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": gt.blockIndex,
+		"delta": map[string]interface{}{
+			"type": "text_delta",
+			"text": text,
+		},
+	})
+	gt.content[len(gt.content)-1].Text += text
+}
+
+// emitToolUse 输出完整的工具调用块（Gemini 每次返回完整的函数调用参数）
+func (gt *GeminiStreamTransformer) emitToolUse(writer gin.ResponseWriter, call *GeminiFunctionCall) {
+	gt.usage.MarkFirstContent()
+	gt.closeOpenBlock(writer)
+
+	args := call.Args
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	argsJSON, _ := json.Marshal(args)
+	toolUseID := fmt.Sprintf("toolu_%s", generateRandomID())
+
+	gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+		"type":  "content_block_start",
+		"index": gt.blockIndex,
+		"content_block": map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolUseID,
+			"name":  call.Name,
+			"input": map[string]interface{}{},
+		},
+	})
+	gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": gt.blockIndex,
+		"delta": map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": string(argsJSON),
+		},
+	})
+	gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": gt.blockIndex,
+	})
+
+	gt.content = append(gt.content, ClaudeContentBlock{
+		Type:  "tool_use",
+		ID:    toolUseID,
+		Name:  call.Name,
+		Input: args,
+	})
+	gt.blockIndex++
+	gt.hasToolUse = true
+}
+
+// closeOpenBlock 关闭当前打开的文本块
+func (gt *GeminiStreamTransformer) closeOpenBlock(writer gin.ResponseWriter) {
+	if gt.openBlock == "" {
+		return
+	}
+	gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": gt.blockIndex,
+	})
+	gt.openBlock = ""
+	gt.blockIndex++
+}
+
+// stopReason 将Gemini的结束原因映射为Claude的停止原因，因安全策略等原因被拦截时为refusal
+func (gt *GeminiStreamTransformer) stopReason() string {
+	switch {
+	case gt.promptBlocked:
+		return "refusal"
+	case gt.finishReason == "SAFETY", gt.finishReason == "RECITATION", gt.finishReason == "BLOCKLIST",
+		gt.finishReason == "PROHIBITED_CONTENT", gt.finishReason == "SPII", gt.finishReason == "IMAGE_SAFETY":
+		return "refusal"
+	case gt.hasToolUse:
+		return "tool_use"
+	case gt.finishReason == "MAX_TOKENS":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+// finish 发送结束事件，非流式客户端则输出聚合后的完整响应
+func (gt *GeminiStreamTransformer) finish(writer gin.ResponseWriter) {
+	if !gt.stream {
+		claudeResponse := ClaudeResponse{
+			ID:         gt.messageID,
+			Type:       "message",
+			Role:       "assistant",
+			Model:      gt.model,
+			Content:    gt.content,
+			StopReason: gt.stopReason(),
+			Usage: ClaudeUsage{
+				InputTokens:          gt.usage.InputTokens,
+				OutputTokens:         gt.usage.OutputTokens,
+				CacheReadInputTokens: gt.usage.CacheReadInputTokens,
+			},
+		}
+		if claudeResponse.Content == nil {
+			claudeResponse.Content = []ClaudeContentBlock{}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		jsonBytes, _ := json.Marshal(claudeResponse)
+		writer.Write(jsonBytes)
+		return
+	}
+
+	if !gt.initialized {
+		gt.processChunk(writer, GeminiResponse{})
+	}
+	gt.closeOpenBlock(writer)
+
+	gt.sendEvent(writer, "message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   gt.stopReason(),
+			"stop_sequence": nil,
+		},
+		"usage": map[string]int{
+			"input_tokens":            gt.usage.InputTokens,
+			"output_tokens":           gt.usage.OutputTokens,
+			"cache_read_input_tokens": gt.usage.CacheReadInputTokens,
+		},
+	})
+
+	gt.sendEvent(writer, "message_stop", map[string]interface{}{
+		"type": "message_stop",
+	})
+}
+
+// TestHandleGeminiRequest 测试Gemini账号连通性，返回状态码和错误信息
+func TestHandleGeminiRequest(account *model.Account) (int, string) {
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal([]byte(common.GetTestRequestBody(100)), &claudeReq); err != nil {
+		return http.StatusBadRequest, "Failed to parse request JSON: " + err.Error()
+	}
+
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, defaultGeminiModel)
+	geminiBody, err := json.Marshal(convertClaudeToGemini(claudeReq))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to marshal Gemini request: " + err.Error()
+	}
+
+	baseURL := strings.TrimRight(account.RequestURL, "/")
+	if baseURL == "" {
+		baseURL = defaultGeminiBaseURL
+	}
+	requestURL := fmt.Sprintf("%s/v1beta/models/%s:generateContent", baseURL, mappedModelName)
+
+	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(geminiBody))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", account.SecretKey)
+
+	client := createHTTPClient(account)
+	if client == nil {
+		return http.StatusInternalServerError, "Failed to create HTTP client"
+	}
+	client.Timeout = 30 * time.Second
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, "Request failed: " + err.Error()
+	}
+	defer common.CloseIO(resp.Body)
+
+	// 读取错误响应内容
+	if resp.StatusCode >= 400 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(bodyBytes)
+	}
+
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// convertGeminiChunks 将Gemini响应chunk按非流式方式转换为Claude响应
+func convertGeminiChunks(chunks ...GeminiResponse) gjson.Result {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	transformer := createGeminiStreamTransformer("gemini-2.5-pro", false)
+	for _, chunk := range chunks {
+		transformer.processChunk(c.Writer, chunk)
+	}
+	transformer.finish(c.Writer)
+	return gjson.ParseBytes(recorder.Body.Bytes())
+}
+
+func TestGeminiStopReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk GeminiResponse
+		want  string
+	}{
+		{"stop", GeminiResponse{Candidates: []GeminiCandidate{{FinishReason: "STOP"}}}, "end_turn"},
+		{"max tokens", GeminiResponse{Candidates: []GeminiCandidate{{FinishReason: "MAX_TOKENS"}}}, "max_tokens"},
+		{"safety", GeminiResponse{Candidates: []GeminiCandidate{{FinishReason: "SAFETY"}}}, "refusal"},
+		{"recitation", GeminiResponse{Candidates: []GeminiCandidate{{FinishReason: "RECITATION"}}}, "refusal"},
+		{"blocklist", GeminiResponse{Candidates: []GeminiCandidate{{FinishReason: "BLOCKLIST"}}}, "refusal"},
+		{"prompt blocked", GeminiResponse{PromptFeedback: &GeminiPromptFeedback{BlockReason: "OTHER"}}, "refusal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertGeminiChunks(tt.chunk).Get("stop_reason").String(); got != tt.want {
+				t.Errorf("stop_reason = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeminiNonStreamCacheUsage(t *testing.T) {
+	result := convertGeminiChunks(GeminiResponse{
+		Candidates: []GeminiCandidate{{Content: GeminiContent{Parts: []GeminiPart{{Text: "hi"}}}, FinishReason: "STOP"}},
+		UsageMetadata: &GeminiUsageMetadata{
+			PromptTokenCount:        1000,
+			CachedContentTokenCount: 800,
+			CandidatesTokenCount:    10,
+		},
+	})
+
+	if got := result.Get("usage.input_tokens").Int(); got != 200 {
+		t.Errorf("input_tokens = %d; want 200", got)
+	}
+	if got := result.Get("usage.cache_read_input_tokens").Int(); got != 800 {
+		t.Errorf("cache_read_input_tokens = %d; want 800", got)
+	}
+}
+
+func TestGeminiStreamTiming(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	body := `data: {"candidates":[{"content":{"parts":[{"text":"hi"}]}}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":1}}` + "\n\n"
+
+	usage := processGeminiStreamResponse(c.Writer, strings.NewReader(body), createGeminiStreamTransformer("gemini-2.5-pro", true))
+	if usage == nil {
+		t.Fatal("usage is nil")
+	}
+	if usage.FirstByteAt.IsZero() || usage.FirstContentAt.IsZero() {
+		t.Fatalf("timing not recorded: first byte %v, first content %v", usage.FirstByteAt, usage.FirstContentAt)
+	}
+}
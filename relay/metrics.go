@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上下文中记录请求模型名称的键，由控制器在解析请求体后写入
+const requestModelKey = "model_name"
+
+// TrackStreamInFlight 流式请求开始时增加进行中的流式请求数，返回的函数在请求结束时调用
+func TrackStreamInFlight(c *gin.Context, account *model.Account) func() {
+	if !isClientStream(c) {
+		return func() {}
+	}
+
+	accountID := strconv.FormatUint(uint64(account.ID), 10)
+	gauge := common.RelayStreamsInFlight.WithLabelValues(account.PlatformType, accountID)
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+	}
+}
+
+// recordRelayMetrics 记录一次账号尝试的请求数和耗时
+func recordRelayMetrics(c *gin.Context, account *model.Account, result *RelayResult, duration time.Duration) {
+	status := "0"
+	if result != nil {
+		status = strconv.Itoa(result.StatusCode)
+	}
+
+	accountID := strconv.FormatUint(uint64(account.ID), 10)
+	modelName := c.GetString(requestModelKey)
+	common.RelayRequestsTotal.WithLabelValues(account.PlatformType, accountID, metricsGroupID(c), modelName, status).Inc()
+	common.RelayRequestDuration.WithLabelValues(account.PlatformType, accountID, modelName).Observe(duration.Seconds())
+}
+
+// recordUsageMetrics 根据成功请求的日志记录tokens、费用和首字耗时
+func recordUsageMetrics(c *gin.Context, account *model.Account, entry *model.Log) {
+	accountID := strconv.FormatUint(uint64(account.ID), 10)
+	groupID := metricsGroupID(c)
+
+	tokens := map[string]int{
+		"input":          entry.InputTokens,
+		"output":         entry.OutputTokens,
+		"cache_read":     entry.CacheReadInputTokens,
+		"cache_creation": entry.CacheCreationInputTokens,
+	}
+	for tokenType, count := range tokens {
+		if count > 0 {
+			common.RelayTokensTotal.WithLabelValues(account.PlatformType, accountID, groupID, entry.ModelName, tokenType).Add(float64(count))
+		}
+	}
+	if entry.TotalCost > 0 {
+		common.RelayCostTotal.WithLabelValues(account.PlatformType, accountID, groupID, entry.ModelName).Add(entry.TotalCost)
+	}
+
+	if entry.FirstTokenTime > 0 {
+		common.RelayFirstTokenDuration.WithLabelValues(account.PlatformType, accountID, entry.ModelName).Observe(float64(entry.FirstTokenTime) / 1000)
+	}
+}
+
+// recordOAuthRefreshMetrics 记录OAuth token刷新结果
+func recordOAuthRefreshMetrics(account *model.Account, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	common.OAuthRefreshTotal.WithLabelValues(strconv.FormatUint(uint64(account.ID), 10), result).Inc()
+}
+
+// metricsGroupID 请求所属API Key的分组ID
+func metricsGroupID(c *gin.Context) string {
+	if groupID, exists := c.Get("group_id"); exists {
+		return fmt.Sprint(groupID)
+	}
+	return ""
+}
@@ -30,6 +30,7 @@ type ClaudeTool struct {
 type ClaudeContentBlock struct {
 	Type      string                 `json:"type"`
 	Text      string                 `json:"text,omitempty"`
+	Thinking  string                 `json:"thinking,omitempty"`
 	Source    *ClaudeContentSource   `json:"source,omitempty"`
 	ID        string                 `json:"id,omitempty"`
 	Name      string                 `json:"name,omitempty"`
@@ -66,9 +67,15 @@ type ClaudeRequest struct {
 	TopK          *int                   `json:"top_k,omitempty"`
 	Tools         []ClaudeTool           `json:"tools,omitempty"`
 	ToolChoice    *ClaudeToolChoice      `json:"tool_choice,omitempty"`
+	Thinking      *ClaudeThinking        `json:"thinking,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata,omitempty"`
 }
 
+type ClaudeThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
 // OpenAI API 类型定义
 type OpenAIMessage struct {
 	Role       string           `json:"role"`
@@ -150,8 +157,9 @@ type ClaudeResponse struct {
 }
 
 type ClaudeUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
 }
 
 type OpenAITargetConfig struct {
@@ -160,7 +168,8 @@ type OpenAITargetConfig struct {
 }
 
 // HandleOpenAIRequest 处理 OpenAI 请求的中转
-func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []byte) {
+// canRetry 为 true 时，向客户端写出任何数据之前发生的可重试错误由调用方切换账号处理
+func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []byte, canRetry bool) *RelayResult {
 	// 记录请求开始时间用于计算耗时
 	startTime := time.Now()
 
@@ -180,18 +189,21 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 				"message": "Failed to parse request JSON: " + err.Error(),
 			},
 		})
-		return
+		return &RelayResult{StatusCode: http.StatusBadRequest, Error: err.Error()}
 	}
 
 	// 直接使用账号配置的请求地址和默认模型
 	if account.RequestURL == "" {
+		if canFailover(c, canRetry) {
+			return retryableResult(http.StatusBadRequest, "account request URL is not configured")
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": map[string]interface{}{
 				"type":    "configuration_error",
 				"message": "账号未配置请求地址",
 			},
 		})
-		return
+		return &RelayResult{StatusCode: http.StatusBadRequest, Error: "account request URL is not configured"}
 	}
 
 	targetConfig := &OpenAITargetConfig{
@@ -202,8 +214,13 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	// 应用模型映射
 	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, targetConfig.ModelName)
 
-	// 转换Claude请求为OpenAI格式
-	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
+	// 转换Claude请求为OpenAI格式（按账号配置选择 chat/completions 或 responses 接口）
+	var openaiReq interface{} = convertClaudeToOpenAI(claudeReq, mappedModelName)
+	openaiURL := targetConfig.BaseURL + "/chat/completions"
+	if isResponsesAPI(account) {
+		openaiReq = convertClaudeToResponses(claudeReq, mappedModelName)
+		openaiURL = targetConfig.BaseURL + "/responses"
+	}
 
 	// 序列化OpenAI请求
 	openaiBody, err := json.Marshal(openaiReq)
@@ -214,11 +231,10 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 				"message": "Failed to marshal OpenAI request: " + err.Error(),
 			},
 		})
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
 	req, err := http.NewRequestWithContext(ctx, "POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -227,7 +243,7 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 				"message": "Failed to create request: " + err.Error(),
 			},
 		})
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 
 	// 设置请求头
@@ -248,13 +264,16 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	if account.ProxyURI != "" {
 		proxyURL, err := url.Parse(account.ProxyURI)
 		if err != nil {
+			if canFailover(c, canRetry) {
+				return retryableResult(http.StatusInternalServerError, "invalid proxy URI: %v", err)
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": map[string]interface{}{
 					"type":    "proxy_configuration_error",
 					"message": "Invalid proxy URI: " + err.Error(),
 				},
 			})
-			return
+			return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 		}
 		transport.Proxy = http.ProxyURL(proxyURL)
 	}
@@ -265,30 +284,42 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	}
 
 	// 发送请求
+	upstreamSpan := startUpstreamSpan(c, account)
+	defer upstreamSpan.End()
 	resp, err := client.Do(req)
+	traceUpstreamResponse(upstreamSpan, resp, err)
 	if err != nil {
 		log.Printf("OpenAI API request failed: %v", err)
+		if canFailover(c, canRetry) && isRetryableRequestError(err) {
+			return retryableResult(http.StatusBadGateway, "request failed: %v", err)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": map[string]interface{}{
 				"type":    "network_error",
 				"message": "Failed to execute request: " + err.Error(),
 			},
 		})
-		return
+		return &RelayResult{StatusCode: http.StatusInternalServerError, Error: err.Error()}
 	}
 	defer common.CloseIO(resp.Body)
+	recordUpstreamRequestID(c, resp)
 
 	// 检查响应状态
 	accountService := service.NewAccountService()
 	if resp.StatusCode >= 400 {
 		accountService.UpdateAccountStatus(account, resp.StatusCode, nil)
 		bodyBytes, _ := io.ReadAll(resp.Body)
+		if canFailover(c, canRetry) && isRetryableStatus(resp.StatusCode, false) {
+			return retryableResult(resp.StatusCode, "%s", string(bodyBytes))
+		}
 		c.Data(resp.StatusCode, "application/json", bodyBytes)
-		return
+		return &RelayResult{StatusCode: resp.StatusCode, Error: string(bodyBytes)}
 	}
 
 	// 统一使用流式响应处理（传递原始Claude模型名称，用于日志记录）
 	handleStreamingResponse(c, resp, claudeReq.Model, claudeReq.Stream, account, apiKey, startTime)
+
+	return &RelayResult{StatusCode: resp.StatusCode}
 }
 
 // extractSystemMessage 从system字段中提取系统消息文本
@@ -325,33 +356,12 @@ func extractSystemMessage(systemField interface{}) string {
 }
 
 // applyModelMapping 应用模型映射配置
-// 格式: claude-haiku-20250303:gpt-4o-mini,claude-sonnet:gpt-4o
+// 格式: claude-haiku-20250303:gpt-4o-mini,claude-sonnet:gpt-4o,claude-opus-*:o3,!claude-3-*
+// 支持通配符、/正则/ 和 ! 排除规则，规则写法见 common.MatchModelPattern
 // 如果没有找到映射，返回默认的目标模型名称
 func applyModelMapping(claudeModel, modelMapping, defaultTargetModel string) string {
-	if modelMapping == "" {
-		return defaultTargetModel
-	}
-
-	// 解析映射配置
-	mappings := strings.Split(modelMapping, ",")
-	for _, mapping := range mappings {
-		mapping = strings.TrimSpace(mapping)
-		if mapping == "" {
-			continue
-		}
-
-		parts := strings.Split(mapping, ":")
-		if len(parts) != 2 {
-			continue
-		}
-
-		sourceModel := strings.TrimSpace(parts[0])
-		targetModel := strings.TrimSpace(parts[1])
-
-		// 支持模糊匹配，只要包含关键字就匹配
-		if strings.Contains(claudeModel, sourceModel) || claudeModel == sourceModel {
-			return targetModel
-		}
+	if targetModel, ok := common.MatchModelMapping(modelMapping, claudeModel); ok {
+		return targetModel
 	}
 
 	// 如果没有找到映射，返回默认目标模型
@@ -641,15 +651,24 @@ func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) Clau
 
 // handleStreamingResponse 处理流式响应
 func handleStreamingResponse(c *gin.Context, resp *http.Response, model string, isClientStream bool, account *model.Account, apiKey *model.ApiKey, startTime time.Time) {
-	// 设置流式响应头
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Writer.Flush()
+	// 设置响应头，非流式客户端在处理结束后返回完整JSON
+	if isClientStream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Writer.Flush()
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
 
 	// 创建流式转换器并处理OpenAI流式响应
-	transformer := createStreamTransformer(model)
-	usageTokens := processOpenAIStreamResponse(c.Writer, resp.Body, transformer, isClientStream)
+	var usageTokens *common.TokenUsage
+	if isResponsesAPI(account) {
+		usageTokens = processResponsesStreamResponse(c.Writer, resp.Body, createResponsesStreamTransformer(model, isClientStream))
+	} else {
+		transformer := createStreamTransformer(model)
+		usageTokens = processOpenAIStreamResponse(c.Writer, resp.Body, transformer, isClientStream)
+	}
 
 	// 如果没有usage信息，创建0值的TokenUsage用于日志记录
 	if usageTokens == nil {
@@ -669,16 +688,17 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
 	}
 
-	// 保存日志记录
+	// 结算预占额度并保存日志记录
+	settleBudgetReservation(c, resp.StatusCode, usageTokens)
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
-		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream)
-			if err != nil {
-				log.Printf("保存日志失败: %v", err)
-			}
-		}()
+		if entry, err := logService.EnqueueLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream, applyStreamTiming(buildRequestLogMeta(c, resp.StatusCode, len(GetRelayAttempts(c))), usageTokens, startTime)); err != nil {
+			log.Printf("保存日志失败: %v", err)
+		} else {
+			c.Set(requestLogIDKey, entry.ID)
+			recordUsageMetrics(c, account, entry)
+		}
 	}
 }
 
@@ -690,8 +710,10 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 	var responseContent strings.Builder
 	var toolCalls []OpenAIToolCall
 	var finishReason string
+	timing := &common.TokenUsage{}
 
 	for scanner.Scan() {
+		timing.MarkFirstByte()
 		line := strings.TrimSpace(scanner.Text())
 
 		// 跳过空行和非data行
@@ -736,11 +758,15 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 				if delta, ok := choice["delta"].(map[string]interface{}); ok {
 					// 收集文本内容
 					if content, ok := delta["content"].(string); ok {
+						if content != "" {
+							timing.MarkFirstContent()
+						}
 						responseContent.WriteString(content)
 					}
 
 					// 收集工具调用增量数据
 					if toolCallsData, ok := delta["tool_calls"].([]interface{}); ok {
+						timing.MarkFirstContent()
 						for _, tc := range toolCallsData {
 							if tcMap, ok := tc.(map[string]interface{}); ok {
 								index := int(tcMap["index"].(float64))
@@ -843,9 +869,11 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 	// 返回token使用统计
 	if totalPromptTokens > 0 || totalCompletionTokens > 0 {
 		return &common.TokenUsage{
-			InputTokens:  totalPromptTokens,
-			OutputTokens: totalCompletionTokens,
-			Model:        transformer.model,
+			InputTokens:    totalPromptTokens,
+			OutputTokens:   totalCompletionTokens,
+			Model:          transformer.model,
+			FirstByteAt:    timing.FirstByteAt,
+			FirstContentAt: timing.FirstContentAt,
 		}
 	}
 
@@ -1085,7 +1113,14 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, targetConfig.ModelName)
 
 	// 转换Claude请求为OpenAI格式
-	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
+	var openaiReq interface{} = convertClaudeToOpenAI(claudeReq, mappedModelName)
+	openaiURL := targetConfig.BaseURL + "/chat/completions"
+	if isResponsesAPI(account) {
+		responsesReq := convertClaudeToResponses(claudeReq, mappedModelName)
+		responsesReq.Stream = false
+		openaiReq = responsesReq
+		openaiURL = targetConfig.BaseURL + "/responses"
+	}
 
 	// 序列化OpenAI请求
 	openaiBody, err := json.Marshal(openaiReq)
@@ -1094,7 +1129,6 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
 	req, err := http.NewRequest("POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
@@ -0,0 +1,665 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// OpenAI 请求未指定 max_tokens 时使用的默认值（Claude 要求必填）
+	defaultChatMaxTokens = 4096
+)
+
+// OpenAIChatRequest 入站的 OpenAI Chat Completions 请求
+type OpenAIChatRequest struct {
+	Model               string               `json:"model"`
+	Messages            []OpenAIMessage      `json:"messages"`
+	MaxTokens           *int                 `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int                 `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64             `json:"temperature,omitempty"`
+	TopP                *float64             `json:"top_p,omitempty"`
+	Stop                interface{}          `json:"stop,omitempty"`
+	Stream              bool                 `json:"stream,omitempty"`
+	StreamOptions       *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Tools               []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice          interface{}          `json:"tool_choice,omitempty"`
+	User                string               `json:"user,omitempty"`
+}
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ConvertOpenAIChatToClaude 将入站的 OpenAI Chat Completions 请求转换为 Claude Messages 请求
+func ConvertOpenAIChatToClaude(body []byte) ([]byte, *OpenAIChatRequest, error) {
+	var chatReq OpenAIChatRequest
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		return nil, nil, err
+	}
+	if chatReq.Model == "" {
+		return nil, nil, fmt.Errorf("missing model")
+	}
+	if len(chatReq.Messages) == 0 {
+		return nil, nil, fmt.Errorf("messages must not be empty")
+	}
+
+	claudeReq := ClaudeRequest{
+		Model:         chatReq.Model,
+		MaxTokens:     defaultChatMaxTokens,
+		Stream:        chatReq.Stream,
+		Temperature:   chatReq.Temperature,
+		TopP:          chatReq.TopP,
+		StopSequences: convertOpenAIStop(chatReq.Stop),
+	}
+	if chatReq.MaxCompletionTokens != nil {
+		claudeReq.MaxTokens = *chatReq.MaxCompletionTokens
+	} else if chatReq.MaxTokens != nil {
+		claudeReq.MaxTokens = *chatReq.MaxTokens
+	}
+	if chatReq.User != "" {
+		claudeReq.Metadata = map[string]interface{}{"user_id": chatReq.User}
+	}
+
+	var systemParts []string
+	for _, message := range chatReq.Messages {
+		switch message.Role {
+		case "system", "developer":
+			if text := extractOpenAIText(message.Content); text != "" {
+				systemParts = append(systemParts, text)
+			}
+		case "user":
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "user", convertOpenAIUserContent(message.Content))
+		case "assistant":
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "assistant", convertOpenAIAssistantContent(message))
+		case "tool":
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "user", []interface{}{
+				map[string]interface{}{
+					"type":        "tool_result",
+					"tool_use_id": message.ToolCallID,
+					"content":     extractOpenAIText(message.Content),
+				},
+			})
+		}
+	}
+	if len(systemParts) > 0 {
+		claudeReq.System = strings.Join(systemParts, "\n\n")
+	}
+
+	// 转换工具
+	for _, tool := range chatReq.Tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		inputSchema := tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		claudeReq.Tools = append(claudeReq.Tools, ClaudeTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+	claudeReq.ToolChoice = convertOpenAIToolChoice(chatReq.ToolChoice)
+
+	claudeBody, err := json.Marshal(claudeReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claudeBody, &chatReq, nil
+}
+
+// appendClaudeMessage 追加Claude消息，连续相同角色的消息合并为一条
+func appendClaudeMessage(messages []ClaudeMessage, role string, blocks []interface{}) []ClaudeMessage {
+	if len(blocks) == 0 {
+		return messages
+	}
+	if n := len(messages); n > 0 && messages[n-1].Role == role {
+		messages[n-1].Content = append(messages[n-1].Content.([]interface{}), blocks...)
+		return messages
+	}
+	return append(messages, ClaudeMessage{Role: role, Content: blocks})
+}
+
+// extractOpenAIText 提取OpenAI消息中的文本内容（支持字符串和数组格式）
+func extractOpenAIText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var textParts []string
+		for _, part := range v {
+			if partMap, ok := part.(map[string]interface{}); ok && partMap["type"] == "text" {
+				if text, ok := partMap["text"].(string); ok {
+					textParts = append(textParts, text)
+				}
+			}
+		}
+		return strings.Join(textParts, "\n")
+	default:
+		return ""
+	}
+}
+
+// convertOpenAIUserContent 将OpenAI用户消息内容转换为Claude内容块
+func convertOpenAIUserContent(content interface{}) []interface{} {
+	if text, ok := content.(string); ok {
+		if text == "" {
+			return nil
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": text}}
+	}
+
+	parts, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var blocks []interface{}
+	for _, part := range parts {
+		partMap, ok := part.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch partMap["type"] {
+		case "text":
+			if text, ok := partMap["text"].(string); ok && text != "" {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+			}
+		case "image_url":
+			imageURL, _ := partMap["image_url"].(map[string]interface{})
+			if rawURL, ok := imageURL["url"].(string); ok {
+				blocks = append(blocks, convertOpenAIImageURL(rawURL))
+			}
+		}
+	}
+	return blocks
+}
+
+// convertOpenAIImageURL 将图片地址转换为Claude图片块，data URL 转为 base64 来源
+func convertOpenAIImageURL(rawURL string) map[string]interface{} {
+	if strings.HasPrefix(rawURL, "data:") {
+		if header, data, found := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ","); found {
+			return map[string]interface{}{
+				"type": "image",
+				"source": map[string]interface{}{
+					"type":       "base64",
+					"media_type": strings.TrimSuffix(header, ";base64"),
+					"data":       data,
+				},
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"type": "image",
+		"source": map[string]interface{}{
+			"type": "url",
+			"url":  rawURL,
+		},
+	}
+}
+
+// convertOpenAIAssistantContent 将OpenAI助手消息（含工具调用）转换为Claude内容块
+func convertOpenAIAssistantContent(message OpenAIMessage) []interface{} {
+	var blocks []interface{}
+	if text := extractOpenAIText(message.Content); text != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+	}
+
+	for _, toolCall := range message.ToolCalls {
+		input := make(map[string]interface{})
+		if toolCall.Function.Arguments != "" {
+			_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &input)
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolCall.ID,
+			"name":  toolCall.Function.Name,
+			"input": input,
+		})
+	}
+	return blocks
+}
+
+// convertOpenAIStop 转换停止序列（支持字符串和数组格式）
+func convertOpenAIStop(stop interface{}) []string {
+	switch v := stop.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		var sequences []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				sequences = append(sequences, s)
+			}
+		}
+		return sequences
+	default:
+		return nil
+	}
+}
+
+// convertOpenAIToolChoice 转换工具选择
+func convertOpenAIToolChoice(toolChoice interface{}) *ClaudeToolChoice {
+	switch v := toolChoice.(type) {
+	case string:
+		switch v {
+		case "auto":
+			return &ClaudeToolChoice{Type: "auto"}
+		case "required":
+			return &ClaudeToolChoice{Type: "any"}
+		case "none":
+			return &ClaudeToolChoice{Type: "none"}
+		}
+	case map[string]interface{}:
+		if function, ok := v["function"].(map[string]interface{}); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return &ClaudeToolChoice{Type: "tool", Name: name}
+			}
+		}
+	}
+	return nil
+}
+
+// convertClaudeStopReason 将Claude停止原因映射为OpenAI的finish_reason
+func convertClaudeStopReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// OpenAIError 构造OpenAI格式的错误响应
+func OpenAIError(message, errType string, code interface{}) gin.H {
+	return gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+		},
+	}
+}
+
+// openAIErrorType 根据状态码确定错误类型，用于没有携带错误类型的错误响应
+func openAIErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	default:
+		return "api_error"
+	}
+}
+
+// ConvertErrorToOpenAI 将Claude格式的上游错误或本服务的错误响应转换为OpenAI格式
+// 支持 {"type":"error","error":{"type","message"}}、{"error":"...","code":...}、{"message":"...","code":...} 以及非JSON内容
+func ConvertErrorToOpenAI(statusCode int, data []byte) []byte {
+	result := gjson.ParseBytes(data)
+	errType := openAIErrorType(statusCode)
+	message := strings.TrimSpace(string(data))
+	var code interface{}
+
+	if errObj := result.Get("error"); errObj.IsObject() {
+		if t := errObj.Get("type").String(); t != "" {
+			errType = t
+		}
+		if m := errObj.Get("message"); m.Exists() {
+			message = m.String()
+		}
+		if c := errObj.Get("code"); c.Exists() {
+			code = c.Value()
+		}
+	} else if result.IsObject() {
+		if errObj.Exists() {
+			message = errObj.String()
+		} else if m := result.Get("message"); m.Exists() {
+			message = m.String()
+		}
+		if c := result.Get("code"); c.Exists() {
+			code = c.Value()
+		}
+	}
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+
+	jsonBytes, _ := json.Marshal(OpenAIError(message, errType, code))
+	return jsonBytes
+}
+
+// OpenAIChatResponseWriter 将中转处理器写出的Claude格式响应转换为OpenAI Chat Completions格式
+// 流式响应逐个SSE事件转换，非流式响应和错误响应缓存后在 Finish 中一次性转换
+type OpenAIChatResponseWriter struct {
+	gin.ResponseWriter
+
+	model        string
+	includeUsage bool
+
+	mode    int // 0: 未确定, 1: 流式转换, 2: 非流式缓存, 3: 错误响应缓存
+	written bool
+	buffer  bytes.Buffer
+
+	// 流式转换状态
+	chatID       string
+	created      int64
+	toolIndex    int
+	blockToolIdx map[int]int // Claude内容块索引 -> OpenAI tool_calls 索引
+	promptTokens int
+	outputTokens int
+	finishReason string
+	doneSent     bool
+}
+
+const (
+	chatWriterModeUnknown = iota
+	chatWriterModeStream
+	chatWriterModeBuffer
+	chatWriterModeError
+)
+
+// NewOpenAIChatResponseWriter 创建OpenAI格式响应转换写入器
+func NewOpenAIChatResponseWriter(writer gin.ResponseWriter, chatReq *OpenAIChatRequest) *OpenAIChatResponseWriter {
+	return &OpenAIChatResponseWriter{
+		ResponseWriter: writer,
+		model:          chatReq.Model,
+		includeUsage:   chatReq.StreamOptions != nil && chatReq.StreamOptions.IncludeUsage,
+		chatID:         fmt.Sprintf("chatcmpl-%s", generateRandomID()),
+		created:        time.Now().Unix(),
+		toolIndex:      -1,
+		blockToolIdx:   make(map[int]int),
+	}
+}
+
+// Written 只要处理器写出过数据即视为已写出，避免已转换的响应再切换账号
+func (w *OpenAIChatResponseWriter) Written() bool {
+	return w.written || w.ResponseWriter.Written()
+}
+
+// WriteString 实现 gin.ResponseWriter
+func (w *OpenAIChatResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Write 根据响应类型转换或缓存Claude格式的数据
+func (w *OpenAIChatResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+
+	if w.mode == chatWriterModeUnknown {
+		switch {
+		case w.Status() >= 400:
+			w.mode = chatWriterModeError
+		case strings.Contains(w.Header().Get("Content-Type"), "text/event-stream"):
+			w.mode = chatWriterModeStream
+		default:
+			w.mode = chatWriterModeBuffer
+		}
+	}
+
+	switch w.mode {
+	case chatWriterModeStream:
+		w.buffer.Write(data)
+		w.processEvents(false)
+		return len(data), nil
+	default:
+		w.buffer.Write(data)
+		return len(data), nil
+	}
+}
+
+// Flush 非流式响应和错误响应缓存期间不向客户端刷新
+func (w *OpenAIChatResponseWriter) Flush() {
+	if w.mode == chatWriterModeBuffer || w.mode == chatWriterModeError {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Finish 在中转结束后调用，输出缓存的非流式响应或补齐流式结束标记
+func (w *OpenAIChatResponseWriter) Finish() {
+	switch w.mode {
+	case chatWriterModeStream:
+		w.processEvents(true)
+		if !w.doneSent {
+			w.writeDone()
+		}
+	case chatWriterModeBuffer:
+		w.writeCompletion(w.buffer.Bytes())
+	case chatWriterModeError:
+		w.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.Write(ConvertErrorToOpenAI(w.Status(), w.buffer.Bytes()))
+	}
+}
+
+// processEvents 处理缓冲区中完整的SSE事件，final 为 true 时处理剩余的全部数据
+func (w *OpenAIChatResponseWriter) processEvents(final bool) {
+	for {
+		data := w.buffer.Bytes()
+		end := bytes.Index(data, []byte("\n\n"))
+		if end < 0 {
+			if !final || len(bytes.TrimSpace(data)) == 0 {
+				return
+			}
+			end = len(data)
+		}
+
+		event := string(data[:end])
+		w.buffer.Next(min(end+2, len(data)))
+
+		for _, line := range strings.Split(event, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "data:") {
+				w.convertStreamEvent([]byte(strings.TrimSpace(line[5:])))
+			}
+		}
+		w.ResponseWriter.Flush()
+	}
+}
+
+// convertStreamEvent 将单个Claude流式事件转换为OpenAI chunk
+func (w *OpenAIChatResponseWriter) convertStreamEvent(data []byte) {
+	event := gjson.ParseBytes(data)
+
+	switch event.Get("type").String() {
+	case "message_start":
+		usage := event.Get("message.usage")
+		w.promptTokens = int(usage.Get("input_tokens").Int() + usage.Get("cache_read_input_tokens").Int() + usage.Get("cache_creation_input_tokens").Int())
+		w.outputTokens = int(usage.Get("output_tokens").Int())
+		w.writeChunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+
+	case "content_block_start":
+		block := event.Get("content_block")
+		if block.Get("type").String() != "tool_use" {
+			return
+		}
+		w.toolIndex++
+		w.blockToolIdx[int(event.Get("index").Int())] = w.toolIndex
+		w.writeChunk(map[string]interface{}{
+			"tool_calls": []interface{}{
+				map[string]interface{}{
+					"index": w.toolIndex,
+					"id":    block.Get("id").String(),
+					"type":  "function",
+					"function": map[string]interface{}{
+						"name":      block.Get("name").String(),
+						"arguments": "",
+					},
+				},
+			},
+		}, nil)
+
+	case "content_block_delta":
+		delta := event.Get("delta")
+		switch delta.Get("type").String() {
+		case "text_delta":
+			w.writeChunk(map[string]interface{}{"content": delta.Get("text").String()}, nil)
+		case "input_json_delta":
+			toolIndex, ok := w.blockToolIdx[int(event.Get("index").Int())]
+			if !ok {
+				return
+			}
+			w.writeChunk(map[string]interface{}{
+				"tool_calls": []interface{}{
+					map[string]interface{}{
+						"index": toolIndex,
+						"function": map[string]interface{}{
+							"arguments": delta.Get("partial_json").String(),
+						},
+					},
+				},
+			}, nil)
+		}
+
+	case "message_delta":
+		if stopReason := event.Get("delta.stop_reason").String(); stopReason != "" {
+			w.finishReason = convertClaudeStopReason(stopReason)
+		}
+		if outputTokens := event.Get("usage.output_tokens"); outputTokens.Exists() {
+			w.outputTokens = int(outputTokens.Int())
+		}
+		if inputTokens := event.Get("usage.input_tokens").Int(); inputTokens > 0 {
+			w.promptTokens = int(inputTokens + event.Get("usage.cache_read_input_tokens").Int() + event.Get("usage.cache_creation_input_tokens").Int())
+		}
+
+	case "message_stop":
+		finishReason := w.finishReason
+		if finishReason == "" {
+			finishReason = "stop"
+		}
+		w.writeChunk(map[string]interface{}{}, finishReason)
+		if w.includeUsage {
+			w.writeSSEData(map[string]interface{}{
+				"id":      w.chatID,
+				"object":  "chat.completion.chunk",
+				"created": w.created,
+				"model":   w.model,
+				"choices": []interface{}{},
+				"usage":   w.usage(),
+			})
+		}
+		w.writeDone()
+
+	case "error":
+		w.writeSSEData(OpenAIError(event.Get("error.message").String(), event.Get("error.type").String(), nil))
+	}
+}
+
+// usage 构造OpenAI格式的用量信息
+func (w *OpenAIChatResponseWriter) usage() OpenAIUsage {
+	return OpenAIUsage{
+		PromptTokens:     w.promptTokens,
+		CompletionTokens: w.outputTokens,
+		TotalTokens:      w.promptTokens + w.outputTokens,
+	}
+}
+
+// writeChunk 输出一个 chat.completion.chunk
+func (w *OpenAIChatResponseWriter) writeChunk(delta map[string]interface{}, finishReason interface{}) {
+	w.writeSSEData(map[string]interface{}{
+		"id":      w.chatID,
+		"object":  "chat.completion.chunk",
+		"created": w.created,
+		"model":   w.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			},
+		},
+	})
+}
+
+// writeSSEData 输出一行 SSE data
+func (w *OpenAIChatResponseWriter) writeSSEData(payload interface{}) {
+	jsonData, _ := json.Marshal(payload)
+	fmt.Fprintf(w.ResponseWriter, "data: %s\n\n", jsonData)
+}
+
+// writeDone 输出流式结束标记
+func (w *OpenAIChatResponseWriter) writeDone() {
+	fmt.Fprint(w.ResponseWriter, "data: [DONE]\n\n")
+	w.ResponseWriter.Flush()
+	w.doneSent = true
+}
+
+// writeCompletion 将Claude非流式响应转换为 chat.completion 输出
+func (w *OpenAIChatResponseWriter) writeCompletion(data []byte) {
+	var claudeResp ClaudeResponse
+	if err := json.Unmarshal(data, &claudeResp); err != nil || claudeResp.Type != "message" {
+		w.ResponseWriter.Write(data)
+		return
+	}
+
+	message := OpenAIMessage{Role: "assistant"}
+	var textParts []string
+	for _, block := range claudeResp.Content {
+		switch block.Type {
+		case "text":
+			textParts = append(textParts, block.Text)
+		case "tool_use":
+			input := block.Input
+			if input == nil {
+				input = make(map[string]interface{})
+			}
+			arguments, _ := json.Marshal(input)
+			message.ToolCalls = append(message.ToolCalls, OpenAIToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: OpenAIFunctionCall{
+					Name:      block.Name,
+					Arguments: string(arguments),
+				},
+			})
+		}
+	}
+	if len(textParts) > 0 || len(message.ToolCalls) == 0 {
+		message.Content = strings.Join(textParts, "")
+	}
+
+	usage := gjson.GetBytes(data, "usage")
+	w.promptTokens = int(usage.Get("input_tokens").Int() + usage.Get("cache_read_input_tokens").Int() + usage.Get("cache_creation_input_tokens").Int())
+	w.outputTokens = int(usage.Get("output_tokens").Int())
+
+	openaiResp := OpenAIResponse{
+		ID:      w.chatID,
+		Object:  "chat.completion",
+		Created: w.created,
+		Model:   w.model,
+		Choices: []OpenAIChoice{
+			{
+				Index:        0,
+				Message:      message,
+				FinishReason: convertClaudeStopReason(claudeResp.StopReason),
+			},
+		},
+		Usage: w.usage(),
+	}
+
+	jsonBytes, _ := json.Marshal(openaiResp)
+	w.ResponseWriter.Write(jsonBytes)
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestConvertErrorToOpenAI(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		message    string
+		errType    string
+		code       string
+	}{
+		{
+			name:       "claude upstream error",
+			statusCode: http.StatusTooManyRequests,
+			body:       `{"type":"error","error":{"type":"rate_limit_error","message":"Number of requests has exceeded your rate limit"}}`,
+			message:    "Number of requests has exceeded your rate limit",
+			errType:    "rate_limit_error",
+			code:       "null",
+		},
+		{
+			name:       "relay error with string error",
+			statusCode: http.StatusUnauthorized,
+			body:       `{"error":"无效的API Key","code":40001}`,
+			message:    "无效的API Key",
+			errType:    "authentication_error",
+			code:       "40001",
+		},
+		{
+			name:       "relay error with message",
+			statusCode: http.StatusForbidden,
+			body:       `{"message":"没有可用的账号","code":40005}`,
+			message:    "没有可用的账号",
+			errType:    "permission_error",
+			code:       "40005",
+		},
+		{
+			name:       "non json body",
+			statusCode: http.StatusBadGateway,
+			body:       "upstream connect error",
+			message:    "upstream connect error",
+			errType:    "api_error",
+			code:       "null",
+		},
+		{
+			name:       "empty body",
+			statusCode: http.StatusInternalServerError,
+			body:       "",
+			message:    "Internal Server Error",
+			errType:    "api_error",
+			code:       "null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := gjson.ParseBytes(ConvertErrorToOpenAI(tt.statusCode, []byte(tt.body)))
+			if got := result.Get("error.message").String(); got != tt.message {
+				t.Errorf("message = %q; want %q", got, tt.message)
+			}
+			if got := result.Get("error.type").String(); got != tt.errType {
+				t.Errorf("type = %q; want %q", got, tt.errType)
+			}
+			if got := result.Get("error.code").Raw; got != tt.code {
+				t.Errorf("code = %s; want %s", got, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package relay
+
+import (
+	"bufio"
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Responses 接口单个SSE事件的最大长度
+	responsesMaxEventSize = 10 * 1024 * 1024
+)
+
+// OpenAI Responses API 类型定义
+type ResponsesRequest struct {
+	Model           string              `json:"model"`
+	Instructions    string              `json:"instructions,omitempty"`
+	Input           []interface{}       `json:"input"`
+	MaxOutputTokens int                 `json:"max_output_tokens,omitempty"`
+	Temperature     *float64            `json:"temperature,omitempty"`
+	TopP            *float64            `json:"top_p,omitempty"`
+	Stream          bool                `json:"stream"`
+	Store           bool                `json:"store"`
+	Tools           []ResponsesTool     `json:"tools,omitempty"`
+	ToolChoice      interface{}         `json:"tool_choice,omitempty"`
+	Reasoning       *ResponsesReasoning `json:"reasoning,omitempty"`
+}
+
+type ResponsesTool struct {
+	Type        string      `json:"type"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters"`
+}
+
+type ResponsesReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// isResponsesAPI 判断OpenAI账号是否使用 Responses 接口
+func isResponsesAPI(account *model.Account) bool {
+	return account.OpenAIApiType == constant.OpenAIApiTypeResponses
+}
+
+// convertClaudeToResponses 将Claude请求转换为 Responses 接口格式
+func convertClaudeToResponses(claudeReq ClaudeRequest, modelName string) ResponsesRequest {
+	responsesReq := ResponsesRequest{
+		Model:           modelName,
+		Instructions:    extractSystemMessage(claudeReq.System),
+		Input:           []interface{}{},
+		MaxOutputTokens: claudeReq.MaxTokens,
+		Temperature:     claudeReq.Temperature,
+		TopP:            claudeReq.TopP,
+		Stream:          true,
+	}
+
+	for _, message := range claudeReq.Messages {
+		responsesReq.Input = append(responsesReq.Input, convertClaudeMessageToResponsesItems(message)...)
+	}
+
+	// 转换工具
+	for _, tool := range claudeReq.Tools {
+		responsesReq.Tools = append(responsesReq.Tools, ResponsesTool{
+			Type:        "function",
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  recursivelyCleanSchema(tool.InputSchema),
+		})
+	}
+
+	// 转换工具选择
+	if claudeReq.ToolChoice != nil {
+		switch claudeReq.ToolChoice.Type {
+		case "auto":
+			responsesReq.ToolChoice = "auto"
+		case "any":
+			responsesReq.ToolChoice = "required"
+		case "none":
+			responsesReq.ToolChoice = "none"
+		case "tool":
+			responsesReq.ToolChoice = map[string]interface{}{
+				"type": "function",
+				"name": claudeReq.ToolChoice.Name,
+			}
+		}
+	}
+
+	// 开启思考时按预算映射推理强度，并请求推理摘要
+	if claudeReq.Thinking != nil && claudeReq.Thinking.Type == "enabled" {
+		effort := "high"
+		if claudeReq.Thinking.BudgetTokens < 4096 {
+			effort = "low"
+		} else if claudeReq.Thinking.BudgetTokens < 16384 {
+			effort = "medium"
+		}
+		responsesReq.Reasoning = &ResponsesReasoning{Effort: effort, Summary: "auto"}
+	}
+
+	return responsesReq
+}
+
+// convertClaudeMessageToResponsesItems 将单条Claude消息转换为 Responses 输入项
+// 文本和图片合并为消息项，tool_use 和 tool_result 分别转换为 function_call 和 function_call_output 项
+func convertClaudeMessageToResponsesItems(message ClaudeMessage) []interface{} {
+	textType := "input_text"
+	if message.Role == "assistant" {
+		textType = "output_text"
+	}
+
+	if text, ok := message.Content.(string); ok {
+		return []interface{}{
+			map[string]interface{}{
+				"role":    message.Role,
+				"content": []interface{}{map[string]interface{}{"type": textType, "text": text}},
+			},
+		}
+	}
+
+	contentBlocks, ok := message.Content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var items []interface{}
+	var content []interface{}
+
+	// 保证消息内容与函数调用的先后顺序不变
+	flushContent := func() {
+		if len(content) > 0 {
+			items = append(items, map[string]interface{}{"role": message.Role, "content": content})
+			content = nil
+		}
+	}
+
+	for _, block := range contentBlocks {
+		blockMap, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch blockMap["type"] {
+		case "text":
+			if text, ok := blockMap["text"].(string); ok && text != "" {
+				content = append(content, map[string]interface{}{"type": textType, "text": text})
+			}
+		case "image":
+			if imageURL := claudeImageToDataURL(blockMap); imageURL != "" {
+				content = append(content, map[string]interface{}{"type": "input_image", "image_url": imageURL})
+			}
+		case "tool_use":
+			flushContent()
+			arguments, _ := json.Marshal(blockMap["input"])
+			items = append(items, map[string]interface{}{
+				"type":      "function_call",
+				"call_id":   blockMap["id"],
+				"name":      blockMap["name"],
+				"arguments": string(arguments),
+			})
+		case "tool_result":
+			flushContent()
+			output, _ := extractToolResultContent(blockMap["content"])
+			items = append(items, map[string]interface{}{
+				"type":    "function_call_output",
+				"call_id": blockMap["tool_use_id"],
+				"output":  output,
+			})
+		}
+	}
+	flushContent()
+
+	return items
+}
+
+// claudeImageToDataURL 将Claude图片块转换为图片地址（base64来源转为 data URL）
+func claudeImageToDataURL(blockMap map[string]interface{}) string {
+	source, ok := blockMap["source"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	switch source["type"] {
+	case "base64":
+		return fmt.Sprintf("data:%v;base64,%v", source["media_type"], source["data"])
+	case "url":
+		imageURL, _ := source["url"].(string)
+		return imageURL
+	default:
+		return ""
+	}
+}
+
+// processResponsesStreamResponse 处理 Responses 接口的流式响应并转换为Claude格式
+func processResponsesStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *ResponsesStreamTransformer) *common.TokenUsage {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), responsesMaxEventSize)
+
+	for scanner.Scan() {
+		transformer.usage.MarkFirstByte()
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(line[5:])
+		if data == "[DONE]" {
+			break
+		}
+		transformer.processEvent(writer, gjson.Parse(data))
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Responses stream read failed: %v", err)
+	}
+
+	transformer.finish(writer)
+
+	if transformer.usage.InputTokens > 0 || transformer.usage.OutputTokens > 0 {
+		return transformer.usage
+	}
+	return nil
+}
+
+// ResponsesStreamTransformer 将 Responses 流式事件转换为Claude SSE事件，同时聚合完整响应
+type ResponsesStreamTransformer struct {
+	stream       bool
+	initialized  bool
+	messageID    string
+	model        string
+	blockIndex   int // 下一个内容块的索引
+	openBlock    *responsesOpenBlock
+	hasToolUse   bool
+	incomplete   string // 响应未完成的原因
+	content      []ClaudeContentBlock
+	toolArgs     strings.Builder // 当前工具调用已接收的参数
+	usage        *common.TokenUsage
+	errorMessage string
+}
+
+// responsesOpenBlock 当前打开的内容块
+type responsesOpenBlock struct {
+	outputIndex int64
+	blockType   string
+}
+
+// createResponsesStreamTransformer 创建 Responses 流式转换器
+func createResponsesStreamTransformer(model string, stream bool) *ResponsesStreamTransformer {
+	return &ResponsesStreamTransformer{
+		stream:    stream,
+		messageID: fmt.Sprintf("msg_%s", generateRandomID()),
+		model:     model,
+		usage:     &common.TokenUsage{Model: model},
+	}
+}
+
+// sendEvent 发送SSE事件（非流式客户端不发送）
+func (rt *ResponsesStreamTransformer) sendEvent(writer gin.ResponseWriter, eventType string, data interface{}) {
+	if !rt.stream {
+		return
+	}
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+	writer.Flush()
+}
+
+// processEvent 处理单个 Responses 流式事件
+func (rt *ResponsesStreamTransformer) processEvent(writer gin.ResponseWriter, event gjson.Result) {
+	if !rt.initialized {
+		rt.sendEvent(writer, "message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":          rt.messageID,
+				"type":        "message",
+				"role":        "assistant",
+				"model":       rt.model,
+				"content":     []interface{}{},
+				"stop_reason": nil,
+				"usage": map[string]int{
+					"input_tokens":  0,
+					"output_tokens": 0,
+				},
+			},
+		})
+		rt.initialized = true
+	}
+
+	outputIndex := event.Get("output_index").Int()
+
+	switch event.Get("type").String() {
+	case "response.output_item.added":
+		item := event.Get("item")
+		if item.Get("type").String() == "function_call" {
+			rt.startBlock(writer, outputIndex, "tool_use", map[string]interface{}{
+				"type":  "tool_use",
+				"id":    item.Get("call_id").String(),
+				"name":  item.Get("name").String(),
+				"input": map[string]interface{}{},
+			})
+			rt.content = append(rt.content, ClaudeContentBlock{
+				Type: "tool_use",
+				ID:   item.Get("call_id").String(),
+				Name: item.Get("name").String(),
+			})
+			rt.toolArgs.Reset()
+			rt.hasToolUse = true
+		}
+
+	case "response.output_text.delta":
+		rt.usage.MarkFirstContent()
+		rt.ensureBlock(writer, outputIndex, "text")
+		delta := event.Get("delta").String()
+		rt.sendDelta(writer, map[string]interface{}{"type": "text_delta", "text": delta})
+		rt.content[len(rt.content)-1].Text += delta
+
+	case "response.reasoning_summary_text.delta":
+		rt.usage.MarkFirstContent()
+		rt.ensureBlock(writer, outputIndex, "thinking")
+		delta := event.Get("delta").String()
+		rt.sendDelta(writer, map[string]interface{}{"type": "thinking_delta", "thinking": delta})
+		rt.content[len(rt.content)-1].Thinking += delta
+
+	case "response.function_call_arguments.delta":
+		if rt.openBlock == nil || rt.openBlock.blockType != "tool_use" {
+			return
+		}
+		rt.usage.MarkFirstContent()
+		delta := event.Get("delta").String()
+		rt.sendDelta(writer, map[string]interface{}{"type": "input_json_delta", "partial_json": delta})
+		rt.toolArgs.WriteString(delta)
+
+	case "response.output_item.done":
+		if rt.openBlock != nil && rt.openBlock.outputIndex == outputIndex {
+			rt.closeOpenBlock(writer)
+		}
+
+	case "response.completed", "response.incomplete":
+		rt.closeOpenBlock(writer)
+		response := event.Get("response")
+		rt.incomplete = response.Get("incomplete_details.reason").String()
+
+		usage := response.Get("usage")
+		cachedTokens := int(usage.Get("input_tokens_details.cached_tokens").Int())
+		rt.usage.InputTokens = int(usage.Get("input_tokens").Int()) - cachedTokens
+		rt.usage.CacheReadInputTokens = cachedTokens
+		rt.usage.OutputTokens = int(usage.Get("output_tokens").Int())
+
+	case "response.failed":
+		rt.errorMessage = event.Get("response.error.message").String()
+
+	case "error":
+		rt.errorMessage = event.Get("message").String()
+	}
+}
+
+// startBlock 开启新的内容块
+func (rt *ResponsesStreamTransformer) startBlock(writer gin.ResponseWriter, outputIndex int64, blockType string, contentBlock map[string]interface{}) {
+	rt.closeOpenBlock(writer)
+	rt.sendEvent(writer, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         rt.blockIndex,
+		"content_block": contentBlock,
+	})
+	rt.openBlock = &responsesOpenBlock{outputIndex: outputIndex, blockType: blockType}
+}
+
+// ensureBlock 确保当前打开的是对应输出项的指定类型内容块
+func (rt *ResponsesStreamTransformer) ensureBlock(writer gin.ResponseWriter, outputIndex int64, blockType string) {
+	if rt.openBlock != nil && rt.openBlock.outputIndex == outputIndex && rt.openBlock.blockType == blockType {
+		return
+	}
+
+	contentBlock := map[string]interface{}{"type": "text", "text": ""}
+	if blockType == "thinking" {
+		contentBlock = map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""}
+	}
+	rt.startBlock(writer, outputIndex, blockType, contentBlock)
+	rt.content = append(rt.content, ClaudeContentBlock{Type: blockType})
+}
+
+// sendDelta 发送当前内容块的增量
+func (rt *ResponsesStreamTransformer) sendDelta(writer gin.ResponseWriter, delta map[string]interface{}) {
+	rt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": rt.blockIndex,
+		"delta": delta,
+	})
+}
+
+// closeOpenBlock 关闭当前打开的内容块，工具调用块在此时解析完整参数
+func (rt *ResponsesStreamTransformer) closeOpenBlock(writer gin.ResponseWriter) {
+	if rt.openBlock == nil {
+		return
+	}
+
+	if rt.openBlock.blockType == "tool_use" {
+		input := make(map[string]interface{})
+		if rt.toolArgs.Len() > 0 {
+			_ = json.Unmarshal([]byte(rt.toolArgs.String()), &input)
+		}
+		rt.content[len(rt.content)-1].Input = input
+	}
+
+	rt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": rt.blockIndex,
+	})
+	rt.openBlock = nil
+	rt.blockIndex++
+}
+
+// stopReason 将 Responses 的完成状态映射为Claude的停止原因
+func (rt *ResponsesStreamTransformer) stopReason() string {
+	if rt.hasToolUse {
+		return "tool_use"
+	}
+	if rt.incomplete == "max_output_tokens" {
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+// finish 发送结束事件，非流式客户端则输出聚合后的完整响应
+func (rt *ResponsesStreamTransformer) finish(writer gin.ResponseWriter) {
+	if rt.errorMessage != "" {
+		log.Printf("❌ Responses 接口返回错误: %s", rt.errorMessage)
+	}
+
+	if !rt.stream {
+		claudeResponse := ClaudeResponse{
+			ID:         rt.messageID,
+			Type:       "message",
+			Role:       "assistant",
+			Model:      rt.model,
+			Content:    rt.content,
+			StopReason: rt.stopReason(),
+			Usage: ClaudeUsage{
+				InputTokens:  rt.usage.InputTokens,
+				OutputTokens: rt.usage.OutputTokens,
+			},
+		}
+		if claudeResponse.Content == nil {
+			claudeResponse.Content = []ClaudeContentBlock{}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		jsonBytes, _ := json.Marshal(claudeResponse)
+		writer.Write(jsonBytes)
+		return
+	}
+
+	if !rt.initialized {
+		rt.processEvent(writer, gjson.Result{})
+	}
+	rt.closeOpenBlock(writer)
+
+	if rt.errorMessage != "" {
+		rt.sendEvent(writer, "error", map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    "api_error",
+				"message": rt.errorMessage,
+			},
+		})
+		return
+	}
+
+	rt.sendEvent(writer, "message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   rt.stopReason(),
+			"stop_sequence": nil,
+		},
+		"usage": map[string]int{
+			"input_tokens":            rt.usage.InputTokens,
+			"output_tokens":           rt.usage.OutputTokens,
+			"cache_read_input_tokens": rt.usage.CacheReadInputTokens,
+		},
+	})
+
+	rt.sendEvent(writer, "message_stop", map[string]interface{}{
+		"type": "message_stop",
+	})
+}
@@ -0,0 +1,246 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// normalizeJSON 重新序列化JSON，消除键顺序和空白的差异
+func normalizeJSON(t *testing.T, data []byte) string {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("invalid json %s: %v", data, err)
+	}
+	normalized, _ := json.Marshal(value)
+	return string(normalized)
+}
+
+func TestConvertClaudeMessageToResponsesItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "string content",
+			message: `{"role":"user","content":"hello"}`,
+			want:    `[{"role":"user","content":[{"type":"input_text","text":"hello"}]}]`,
+		},
+		{
+			name: "assistant text then tool_use",
+			message: `{"role":"assistant","content":[
+				{"type":"text","text":"checking"},
+				{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}}]}`,
+			want: `[
+				{"role":"assistant","content":[{"type":"output_text","text":"checking"}]},
+				{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"}]`,
+		},
+		{
+			name: "tool_result before text",
+			message: `{"role":"user","content":[
+				{"type":"tool_result","tool_use_id":"call_1","content":"sunny"},
+				{"type":"text","text":"and tomorrow?"}]}`,
+			want: `[
+				{"type":"function_call_output","call_id":"call_1","output":"sunny"},
+				{"role":"user","content":[{"type":"input_text","text":"and tomorrow?"}]}]`,
+		},
+		{
+			name: "text around multiple tool_use keeps order",
+			message: `{"role":"assistant","content":[
+				{"type":"text","text":"first"},
+				{"type":"tool_use","id":"call_1","name":"a","input":{}},
+				{"type":"tool_use","id":"call_2","name":"b","input":{"x":1}},
+				{"type":"text","text":"last"}]}`,
+			want: `[
+				{"role":"assistant","content":[{"type":"output_text","text":"first"}]},
+				{"type":"function_call","call_id":"call_1","name":"a","arguments":"{}"},
+				{"type":"function_call","call_id":"call_2","name":"b","arguments":"{\"x\":1}"},
+				{"role":"assistant","content":[{"type":"output_text","text":"last"}]}]`,
+		},
+		{
+			name: "multiple tool_result with block content",
+			message: `{"role":"user","content":[
+				{"type":"tool_result","tool_use_id":"call_1","content":[{"type":"text","text":"one"},{"type":"text","text":"two"}]},
+				{"type":"tool_result","tool_use_id":"call_2","content":"three"}]}`,
+			want: `[
+				{"type":"function_call_output","call_id":"call_1","output":"one\ntwo"},
+				{"type":"function_call_output","call_id":"call_2","output":"three"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message ClaudeMessage
+			if err := json.Unmarshal([]byte(tt.message), &message); err != nil {
+				t.Fatal(err)
+			}
+			items, _ := json.Marshal(convertClaudeMessageToResponsesItems(message))
+			if got, want := normalizeJSON(t, items), normalizeJSON(t, []byte(tt.want)); got != want {
+				t.Errorf("items = %s; want %s", got, want)
+			}
+		})
+	}
+}
+
+// describeClaudeSSE 将Claude SSE输出概括为事件列表，内容块事件附带块类型或增量类型
+func describeClaudeSSE(body string) []string {
+	var events []string
+	for _, chunk := range strings.Split(body, "\n\n") {
+		var eventType, data string
+		for _, line := range strings.Split(chunk, "\n") {
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if eventType == "" {
+			continue
+		}
+
+		event := gjson.Parse(data)
+		switch eventType {
+		case "content_block_start":
+			eventType += ":" + event.Get("index").String() + ":" + event.Get("content_block.type").String()
+		case "content_block_delta":
+			eventType += ":" + event.Get("index").String() + ":" + event.Get("delta.type").String()
+		case "content_block_stop":
+			eventType += ":" + event.Get("index").String()
+		case "message_delta":
+			eventType += ":" + event.Get("delta.stop_reason").String()
+		}
+		events = append(events, eventType)
+	}
+	return events
+}
+
+func TestResponsesStreamTransformerProcessEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   []string
+	}{
+		{
+			name: "text",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":0,"item":{"type":"message"}}`,
+				`{"type":"response.output_text.delta","output_index":0,"delta":"Hel"}`,
+				`{"type":"response.output_text.delta","output_index":0,"delta":"lo"}`,
+				`{"type":"response.output_item.done","output_index":0}`,
+				`{"type":"response.completed","response":{"usage":{"input_tokens":10,"output_tokens":2}}}`,
+			},
+			want: []string{
+				"message_start",
+				"content_block_start:0:text",
+				"content_block_delta:0:text_delta",
+				"content_block_delta:0:text_delta",
+				"content_block_stop:0",
+				"message_delta:end_turn",
+				"message_stop",
+			},
+		},
+		{
+			name: "reasoning then function call",
+			events: []string{
+				`{"type":"response.reasoning_summary_text.delta","output_index":0,"delta":"think"}`,
+				`{"type":"response.output_item.done","output_index":0}`,
+				`{"type":"response.output_item.added","output_index":1,"item":{"type":"function_call","call_id":"call_1","name":"get_weather"}}`,
+				`{"type":"response.function_call_arguments.delta","output_index":1,"delta":"{\"city\":"}`,
+				`{"type":"response.function_call_arguments.delta","output_index":1,"delta":"\"Paris\"}"}`,
+				`{"type":"response.output_item.done","output_index":1}`,
+				`{"type":"response.completed","response":{"usage":{"input_tokens":10,"output_tokens":5}}}`,
+			},
+			want: []string{
+				"message_start",
+				"content_block_start:0:thinking",
+				"content_block_delta:0:thinking_delta",
+				"content_block_stop:0",
+				"content_block_start:1:tool_use",
+				"content_block_delta:1:input_json_delta",
+				"content_block_delta:1:input_json_delta",
+				"content_block_stop:1",
+				"message_delta:tool_use",
+				"message_stop",
+			},
+		},
+		{
+			name: "incomplete closes open block",
+			events: []string{
+				`{"type":"response.output_text.delta","output_index":0,"delta":"partial"}`,
+				`{"type":"response.incomplete","response":{"incomplete_details":{"reason":"max_output_tokens"},"usage":{"input_tokens":10,"output_tokens":100}}}`,
+			},
+			want: []string{
+				"message_start",
+				"content_block_start:0:text",
+				"content_block_delta:0:text_delta",
+				"content_block_stop:0",
+				"message_delta:max_tokens",
+				"message_stop",
+			},
+		},
+		{
+			name: "failed",
+			events: []string{
+				`{"type":"response.failed","response":{"error":{"message":"server error"}}}`,
+			},
+			want: []string{
+				"message_start",
+				"error",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			transformer := createResponsesStreamTransformer("gpt-5", true)
+			for _, event := range tt.events {
+				transformer.processEvent(c.Writer, gjson.Parse(event))
+			}
+			transformer.finish(c.Writer)
+
+			got := describeClaudeSSE(recorder.Body.String())
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestResponsesStreamTransformerAggregatesNonStream(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	transformer := createResponsesStreamTransformer("gpt-5", false)
+	for _, event := range []string{
+		`{"type":"response.output_text.delta","output_index":0,"delta":"Let me check"}`,
+		`{"type":"response.output_item.done","output_index":0}`,
+		`{"type":"response.output_item.added","output_index":1,"item":{"type":"function_call","call_id":"call_1","name":"get_weather"}}`,
+		`{"type":"response.function_call_arguments.delta","output_index":1,"delta":"{\"city\":\"Paris\"}"}`,
+		`{"type":"response.output_item.done","output_index":1}`,
+		`{"type":"response.completed","response":{"usage":{"input_tokens":100,"input_tokens_details":{"cached_tokens":80},"output_tokens":5}}}`,
+	} {
+		transformer.processEvent(c.Writer, gjson.Parse(event))
+	}
+	transformer.finish(c.Writer)
+
+	result := gjson.ParseBytes(recorder.Body.Bytes())
+	if got := result.Get("content.0.text").String(); got != "Let me check" {
+		t.Errorf("content.0.text = %q", got)
+	}
+	if got := result.Get("content.1.input.city").String(); got != "Paris" {
+		t.Errorf("content.1.input.city = %q", got)
+	}
+	if got := result.Get("stop_reason").String(); got != "tool_use" {
+		t.Errorf("stop_reason = %q; want tool_use", got)
+	}
+	if got := result.Get("usage.input_tokens").Int(); got != 20 {
+		t.Errorf("usage.input_tokens = %d; want 20", got)
+	}
+}
@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"log"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// 上下文中记录上游request-id的键
+	upstreamRequestIDKey = "upstream_request_id"
+
+	// 上下文中记录本次请求日志ID的键
+	requestLogIDKey = "request_log_id"
+
+	// 日志中错误信息的最大长度
+	maxLogErrorMessageLength = 2000
+)
+
+// recordUpstreamRequestID 记录上游返回的request-id，每次尝试都会覆盖上一次的值
+func recordUpstreamRequestID(c *gin.Context, resp *http.Response) {
+	c.Set(upstreamRequestIDKey, upstreamRequestID(resp))
+}
+
+// upstreamRequestID 获取上游响应头中的request-id
+func upstreamRequestID(resp *http.Response) string {
+	requestID := resp.Header.Get("request-id")
+	if requestID == "" {
+		requestID = resp.Header.Get("x-request-id")
+	}
+	return requestID
+}
+
+// buildRequestLogMeta 构建请求日志的附加信息
+func buildRequestLogMeta(c *gin.Context, statusCode, retryCount int) *model.LogRequestMeta {
+	meta := &model.LogRequestMeta{
+		StatusCode:        statusCode,
+		UpstreamRequestID: c.GetString(upstreamRequestIDKey),
+		RetryCount:        retryCount,
+		ClientIP:          c.ClientIP(),
+		TraceContext:      trace.SpanContextFromContext(c.Request.Context()),
+	}
+	if value, exists := c.Get("api_key"); exists {
+		meta.UsedPreviousKey = value.(*model.ApiKey).UsedPreviousKey
+	}
+	return meta
+}
+
+// applyStreamTiming 根据流式响应的时间点计算首字节耗时、首个内容增量耗时和输出速度
+// 输出速度按首个内容增量到响应结束的时间计算，排除排队和预填充的耗时
+func applyStreamTiming(meta *model.LogRequestMeta, usage *common.TokenUsage, startTime time.Time) *model.LogRequestMeta {
+	if usage == nil {
+		return meta
+	}
+	if !usage.FirstByteAt.IsZero() {
+		meta.FirstByteTime = usage.FirstByteAt.Sub(startTime).Milliseconds()
+	}
+	if !usage.FirstContentAt.IsZero() {
+		meta.FirstTokenTime = usage.FirstContentAt.Sub(startTime).Milliseconds()
+		if elapsed := time.Since(usage.FirstContentAt).Seconds(); elapsed > 0 && usage.OutputTokens > 0 {
+			meta.OutputTokensPerSecond = math.Round(float64(usage.OutputTokens)/elapsed*100) / 100
+		}
+	}
+	return meta
+}
+
+// SaveFailedRequestLog 保存最终失败的请求日志，需要在记录本次尝试之后调用
+func SaveFailedRequestLog(c *gin.Context, account *model.Account, result *RelayResult, startTime time.Time, modelName string) {
+	value, exists := c.Get("api_key")
+	if !exists || result == nil {
+		return
+	}
+	apiKey := value.(*model.ApiKey)
+
+	attempts := GetRelayAttempts(c)
+	meta := buildRequestLogMeta(c, result.StatusCode, max(len(attempts)-1, 0))
+	if len(attempts) > 0 {
+		meta.UpstreamRequestID = attempts[len(attempts)-1].UpstreamRequestID
+	}
+	meta.ErrorType, meta.ErrorMessage = parseRelayError(result.Error)
+
+	usage := &common.TokenUsage{Model: modelName}
+	duration := time.Since(startTime).Milliseconds()
+	logService := service.NewLogService()
+	if entry, err := logService.EnqueueLogFromTokenUsage(usage, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream(c), meta); err != nil {
+		log.Printf("保存失败请求日志失败: %v", err)
+	} else {
+		c.Set(requestLogIDKey, entry.ID)
+	}
+}
+
+// parseRelayError 从上游错误响应中提取错误类型和信息
+// 兼容 Claude({"error":{"type","message"}})、OpenAI({"error":{"type","code","message"}})、Gemini({"error":{"status","message"}}) 格式
+func parseRelayError(errMessage string) (string, string) {
+	errType := "relay_error"
+	message := errMessage
+
+	if gjson.Valid(errMessage) {
+		for _, path := range []string{"error.type", "error.status", "error.code", "type"} {
+			if value := gjson.Get(errMessage, path); value.Exists() && value.String() != "" && value.String() != "error" {
+				errType = value.String()
+				break
+			}
+		}
+		if value := gjson.Get(errMessage, "error.message"); value.Exists() {
+			message = value.String()
+		} else if value := gjson.Get(errMessage, "message"); value.Exists() {
+			message = value.String()
+		}
+	}
+
+	return errType, truncateLogMessage(message)
+}
+
+// truncateLogMessage 截断过长的错误信息，保证不截断多字节字符
+func truncateLogMessage(message string) string {
+	if len(message) <= maxLogErrorMessageLength {
+		return message
+	}
+	message = message[:maxLogErrorMessageLength]
+	for !utf8.ValidString(message) {
+		message = message[:len(message)-1]
+	}
+	return message + "..."
+}
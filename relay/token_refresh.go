@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// token刷新锁的最长持有时间，需大于刷新请求的超时时间
+	tokenRefreshLockTTL = 60 * time.Second
+	// 等待其他请求或实例完成刷新的最长时间
+	tokenRefreshLockWait = 35 * time.Second
+)
+
+// 读取、刷新和保存账号token的函数，测试时替换为内存实现
+var (
+	loadAccountOAuthTokens   = model.GetAccountOAuthTokens
+	requestOAuthTokenRefresh = refreshToken
+	saveAccountOAuthTokens   = model.UpdateAccountOAuthTokens
+)
+
+// tokenNeedsRefresh token是否已过期或距离过期不足refreshBefore
+func tokenNeedsRefresh(account *model.Account, refreshBefore time.Duration) bool {
+	expiresAt := int64(account.ExpiresAt)
+	return expiresAt > 0 && time.Now().Unix() >= expiresAt-int64(refreshBefore.Seconds())
+}
+
+// RefreshAccountToken 在账号级分布式锁内刷新OAuth token，供请求路径和定时刷新任务共用
+// refresh token只能使用一次，加锁保证同一账号同一时刻只有一个请求或实例在刷新；
+// 获得锁后重新读取token，已被其他持有者刷新时直接使用，不再重复刷新
+func RefreshAccountToken(ctx context.Context, account *model.Account, refreshBefore time.Duration) error {
+	lock, err := common.AcquireLock(ctx, fmt.Sprintf("oauth_refresh_lock:%d", account.ID), tokenRefreshLockTTL, tokenRefreshLockWait)
+	if err != nil {
+		return fmt.Errorf("获取token刷新锁失败: %v", err)
+	}
+	defer lock.Unlock()
+
+	if latest, err := loadAccountOAuthTokens(account.ID); err == nil {
+		account.AccessToken = latest.AccessToken
+		account.RefreshToken = latest.RefreshToken
+		account.ExpiresAt = latest.ExpiresAt
+		account.CurrentStatus = latest.CurrentStatus
+		if !tokenNeedsRefresh(account, refreshBefore) {
+			return nil
+		}
+	}
+
+	if account.RefreshToken == "" {
+		return errors.New("账号缺少刷新token，无法自动刷新")
+	}
+
+	_, refreshSpan := common.Tracer().Start(ctx, "oauth.refresh_token", trace.WithSpanKind(trace.SpanKindClient))
+	refreshSpan.SetAttributes(attribute.Int("account.id", int(account.ID)))
+	newAccessToken, newRefreshToken, newExpiresAt, err := requestOAuthTokenRefresh(account)
+	recordOAuthRefreshMetrics(account, err)
+	if err != nil {
+		refreshSpan.SetStatus(codes.Error, err.Error())
+	}
+	refreshSpan.End()
+
+	if err != nil {
+		markTokenRefreshFailed(account, err)
+		return err
+	}
+
+	account.AccessToken = newAccessToken
+	if newRefreshToken != "" {
+		account.RefreshToken = newRefreshToken
+	}
+	account.ExpiresAt = int(newExpiresAt)
+	if account.CurrentStatus == model.AccountStatusRefreshFailed {
+		account.CurrentStatus = accountStatusActive
+	}
+
+	if err := saveAccountOAuthTokens(account.ID, newAccessToken, newRefreshToken, account.ExpiresAt); err != nil {
+		// 不返回错误，内存中的token已经更新
+		log.Printf("更新账号token信息到数据库失败: %v", err)
+	}
+
+	log.Printf("账号 %s token刷新成功", account.Name)
+	return nil
+}
+
+// markTokenRefreshFailed 发送刷新失败告警，token已过期时将账号标记为刷新失败状态
+// token未过期时仍可继续使用，由后续请求或定时任务重试刷新
+func markTokenRefreshFailed(account *model.Account, refreshErr error) {
+	service.EmitAccountAlert(account, service.AlertAccountOAuthRefreshErr, refreshErr.Error())
+
+	if time.Now().Unix() < int64(account.ExpiresAt) || account.CurrentStatus == model.AccountStatusRefreshFailed {
+		return
+	}
+
+	log.Printf("token已过期且刷新失败，标记账号 %s 为刷新失败状态", account.Name)
+	account.CurrentStatus = model.AccountStatusRefreshFailed
+	if err := model.UpdateAccountCurrentStatus(account.ID, account.CurrentStatus); err != nil {
+		log.Printf("更新账号刷新失败状态失败: %v", err)
+	}
+}
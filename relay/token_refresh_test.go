@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeTokenStore 内存中的账号token，替代数据库
+type fakeTokenStore struct {
+	mu      sync.Mutex
+	account model.Account
+}
+
+func (s *fakeTokenStore) load(id uint) (*model.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account := s.account
+	return &account, nil
+}
+
+func (s *fakeTokenStore) save(id uint, accessToken, refreshToken string, expiresAt int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.account.AccessToken = accessToken
+	if refreshToken != "" {
+		s.account.RefreshToken = refreshToken
+	}
+	s.account.ExpiresAt = expiresAt
+	return nil
+}
+
+// setupTokenRefreshTest 使用内存Redis和内存token存储，refresh为模拟的刷新请求
+func setupTokenRefreshTest(t *testing.T, account model.Account, refresh func(*model.Account) (string, string, int64, error)) *fakeTokenStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	previousRDB := common.RDB
+	common.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	store := &fakeTokenStore{account: account}
+	previousLoad, previousRefresh, previousSave := loadAccountOAuthTokens, requestOAuthTokenRefresh, saveAccountOAuthTokens
+	loadAccountOAuthTokens, requestOAuthTokenRefresh, saveAccountOAuthTokens = store.load, refresh, store.save
+
+	t.Cleanup(func() {
+		common.RDB.Close()
+		common.RDB = previousRDB
+		loadAccountOAuthTokens, requestOAuthTokenRefresh, saveAccountOAuthTokens = previousLoad, previousRefresh, previousSave
+	})
+	return store
+}
+
+func expiredTestAccount() model.Account {
+	account := model.Account{
+		Name:          "test",
+		AccessToken:   "old-access",
+		RefreshToken:  "old-refresh",
+		ExpiresAt:     int(time.Now().Add(-time.Minute).Unix()),
+		CurrentStatus: accountStatusActive,
+	}
+	account.ID = 1
+	return account
+}
+
+func TestRefreshAccountTokenRefreshesOnceConcurrently(t *testing.T) {
+	var calls int32
+	store := setupTokenRefreshTest(t, expiredTestAccount(), func(account *model.Account) (string, string, int64, error) {
+		atomic.AddInt32(&calls, 1)
+		if account.RefreshToken != "old-refresh" {
+			t.Errorf("refresh used token %q; want the unused refresh token", account.RefreshToken)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return "new-access", "new-refresh", time.Now().Add(time.Hour).Unix(), nil
+	})
+
+	// 模拟多个请求或实例同时发现token过期，各自持有账号的旧副本
+	accounts := make([]model.Account, 4)
+	var wg sync.WaitGroup
+	for i := range accounts {
+		accounts[i] = expiredTestAccount()
+		wg.Add(1)
+		go func(account *model.Account) {
+			defer wg.Done()
+			if err := RefreshAccountToken(context.Background(), account, 0); err != nil {
+				t.Errorf("RefreshAccountToken: %v", err)
+			}
+		}(&accounts[i])
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("refresh called %d times; want 1", calls)
+	}
+	for _, account := range accounts {
+		if account.AccessToken != "new-access" || account.RefreshToken != "new-refresh" {
+			t.Fatalf("account tokens = %q/%q; want refreshed tokens", account.AccessToken, account.RefreshToken)
+		}
+	}
+	if store.account.AccessToken != "new-access" {
+		t.Fatalf("stored access token = %q; want new-access", store.account.AccessToken)
+	}
+}
+
+func TestRefreshAccountTokenUsesTokenRefreshedElsewhere(t *testing.T) {
+	refreshed := expiredTestAccount()
+	refreshed.AccessToken = "other-access"
+	refreshed.RefreshToken = "other-refresh"
+	refreshed.ExpiresAt = int(time.Now().Add(time.Hour).Unix())
+
+	setupTokenRefreshTest(t, refreshed, func(*model.Account) (string, string, int64, error) {
+		t.Error("refresh called although the stored token is still valid")
+		return "", "", 0, nil
+	})
+
+	// 本地副本已过期，但其他实例已完成刷新
+	account := expiredTestAccount()
+	if err := RefreshAccountToken(context.Background(), &account, 0); err != nil {
+		t.Fatalf("RefreshAccountToken: %v", err)
+	}
+	if account.AccessToken != "other-access" || account.RefreshToken != "other-refresh" {
+		t.Fatalf("account tokens = %q/%q; want tokens from store", account.AccessToken, account.RefreshToken)
+	}
+}
+
+func TestRefreshAccountTokenWaitsForLockHolder(t *testing.T) {
+	setupTokenRefreshTest(t, expiredTestAccount(), func(*model.Account) (string, string, int64, error) {
+		return "new-access", "new-refresh", time.Now().Add(time.Hour).Unix(), nil
+	})
+
+	lock, err := common.TryLock(context.Background(), "oauth_refresh_lock:1", time.Minute)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLock = %v, %v; want lock", lock, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	account := expiredTestAccount()
+	if err := RefreshAccountToken(ctx, &account, 0); err == nil {
+		t.Fatal("RefreshAccountToken succeeded while another holder kept the lock")
+	}
+	if account.AccessToken != "old-access" {
+		t.Fatalf("account access token = %q; want unchanged", account.AccessToken)
+	}
+}
@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startUpstreamSpan 开始上游请求的span，由调用方在处理函数返回时结束，包含流式响应的转发时间
+func startUpstreamSpan(c *gin.Context, account *model.Account) trace.Span {
+	_, span := common.Tracer().Start(c.Request.Context(), "relay.upstream "+account.PlatformType, trace.WithSpanKind(trace.SpanKindClient))
+	useProxy := account.EnableProxy && account.ProxyURI != ""
+	span.SetAttributes(
+		attribute.Int("account.id", int(account.ID)),
+		attribute.String("account.name", account.Name),
+		attribute.String("account.platform", account.PlatformType),
+		attribute.Bool("proxy.enabled", useProxy),
+	)
+	if useProxy {
+		// 只记录代理地址，不记录认证信息
+		if proxyURL, err := url.Parse(account.ProxyURI); err == nil {
+			span.SetAttributes(attribute.String("proxy.host", proxyURL.Host))
+		}
+	}
+	return span
+}
+
+// traceUpstreamResponse 记录上游响应的状态码和request-id
+func traceUpstreamResponse(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("http.status_code", resp.StatusCode),
+		attribute.String("upstream.request_id", upstreamRequestID(resp)),
+	)
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+}
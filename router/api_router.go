@@ -20,6 +20,9 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 		})
 	})
 
+	// Prometheus 监控指标
+	server.GET("/metrics", controller.GetMetrics)
+
 	// Claude Code 路由
 	claude := server.Group("/claude-code")
 	claude.Use(middleware.ClaudeCodeAuth())
@@ -28,6 +31,8 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 		claude.POST("/v1/messages", controller.GetMessages)
 		// 使用量统计接口
 		claude.POST("/v1/messages/count_tokens", controller.GetCountTokens)
+		// OpenAI 兼容的对话接口
+		claude.POST("/v1/chat/completions", controller.ChatCompletions)
 	}
 
 	// API路由组
@@ -80,6 +85,7 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 				account.GET("/list", controller.GetAccountList)                                  // 获取账号列表
 				account.POST("/create", controller.CreateAccount)                                // 创建账号
 				account.GET("/detail/:id", controller.GetAccount)                                // 获取账号详情
+				account.GET("/reveal/:id", controller.RevealAccountSecrets)                      // 查看账号完整密钥（仅所属用户）
 				account.PUT("/update/:id", controller.UpdateAccount)                             // 更新账号
 				account.DELETE("/delete/:id", controller.DeleteAccount)                          // 删除账号
 				account.PUT("/update-active-status/:id", controller.UpdateAccountActiveStatus)   // 更新账号激活状态
@@ -97,12 +103,14 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 			// API Key 相关
 			apikey := authenticated.Group("/api-keys")
 			{
-				apikey.GET("/list", controller.GetApiKeys)                      // 获取API Key列表
-				apikey.POST("/create", controller.CreateApiKey)                 // 创建API Key
-				apikey.GET("/detail/:id", controller.GetApiKey)                 // 获取API Key详情
-				apikey.PUT("/update/:id", controller.UpdateApiKey)              // 更新API Key
-				apikey.PUT("/update-status/:id", controller.UpdateApiKeyStatus) // 更新API Key状态
-				apikey.DELETE("/delete/:id", controller.DeleteApiKey)           // 删除API Key
+				apikey.GET("/list", controller.GetApiKeys)                           // 获取API Key列表
+				apikey.POST("/create", controller.CreateApiKey)                      // 创建API Key
+				apikey.GET("/detail/:id", controller.GetApiKey)                      // 获取API Key详情
+				apikey.PUT("/update/:id", controller.UpdateApiKey)                   // 更新API Key
+				apikey.PUT("/update-status/:id", controller.UpdateApiKeyStatus)      // 更新API Key状态
+				apikey.DELETE("/delete/:id", controller.DeleteApiKey)                // 删除API Key
+				apikey.POST("/rotate/:id", controller.RotateApiKey)                  // 轮换API Key
+				apikey.POST("/revoke-previous/:id", controller.RevokePreviousApiKey) // 使轮换前的旧密钥立即失效
 			}
 
 			// 日志相关（用户接口）
@@ -141,6 +149,9 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 				// 定时任务测试接口（管理员专用）
 				admin.POST("/test/reset-stats", controller.ManualResetStats) // 手动重置统计数据
 				admin.POST("/test/clean-logs", controller.ManualCleanLogs)   // 手动清理过期日志
+
+				// 使用当前主密钥重新加密账号密钥（开启加密或轮换主密钥后执行）
+				admin.POST("/accounts/reencrypt-secrets", controller.ReencryptAccountSecrets)
 			}
 		}
 	}
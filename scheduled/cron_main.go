@@ -6,6 +6,7 @@ import (
 	"claude-code-relay/model"
 	"claude-code-relay/relay"
 	"claude-code-relay/service"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -33,33 +34,40 @@ func NewCronService() *CronService {
 // Start 启动定时任务
 func (s *CronService) Start() {
 	// 每天凌晨0点清理统计数据
-	_, err := s.cron.AddFunc("0 0 0 * * *", s.resetDailyStats)
+	_, err := s.cron.AddFunc("0 0 0 * * *", instrumentJob("reset_daily_stats", time.Hour, s.resetDailyStats))
 	if err != nil {
 		log.Printf("Failed to add daily reset cron job: %v", err)
 		return
 	}
 
 	// 每天凌晨1点清理过期日志
-	_, err = s.cron.AddFunc("0 0 1 * * *", s.cleanExpiredLogs)
+	_, err = s.cron.AddFunc("0 0 1 * * *", instrumentJob("clean_expired_logs", time.Hour, s.cleanExpiredLogs))
 	if err != nil {
 		log.Printf("Failed to add log cleanup cron job: %v", err)
 		return
 	}
 
 	// 每30分钟执行一次账号异常恢复测试
-	_, err = s.cron.AddFunc("0 */30 * * * *", s.recoverAbnormalAccounts)
+	_, err = s.cron.AddFunc("0 */30 * * * *", instrumentJob("recover_abnormal_accounts", 25*time.Minute, s.recoverAbnormalAccounts))
 	if err != nil {
 		log.Printf("Failed to add account recovery cron job: %v", err)
 		return
 	}
 
 	// 每10分钟检查限流过期账号
-	_, err = s.cron.AddFunc("0 */10 * * * *", s.checkRateLimitExpiredAccounts)
+	_, err = s.cron.AddFunc("0 */10 * * * *", instrumentJob("check_rate_limit_expired_accounts", 8*time.Minute, s.checkRateLimitExpiredAccounts))
 	if err != nil {
 		log.Printf("Failed to add rate limit check cron job: %v", err)
 		return
 	}
 
+	// 每5分钟提前刷新即将过期的OAuth token
+	_, err = s.cron.AddFunc("0 */5 * * * *", instrumentJob("refresh_oauth_tokens", 4*time.Minute, s.refreshOAuthTokens))
+	if err != nil {
+		log.Printf("Failed to add oauth token refresh cron job: %v", err)
+		return
+	}
+
 	// 启动定时任务
 	s.cron.Start()
 	common.SysLog("Cron service started successfully")
@@ -74,6 +82,36 @@ func (s *CronService) Stop() {
 	}
 }
 
+// instrumentJob 包装定时任务，记录执行次数和耗时，任务panic时记录错误而不影响服务
+// 多实例部署时同一任务的同一次调度只在获得任务锁的实例上执行，其他实例跳过。
+// 任务锁不在执行结束后主动释放，而是在lockTTL后过期，避免时钟略慢的实例在同一调度周期内重复执行，
+// 因此lockTTL需小于任务的调度间隔
+func instrumentJob(name string, lockTTL time.Duration, job func()) func() {
+	return func() {
+		lock, err := common.TryLock(context.Background(), "cron_job_lock:"+name, lockTTL)
+		if err != nil {
+			// Redis异常时宁可重复执行也不漏执行，各任务均可重复执行
+			common.SysError(fmt.Sprintf("Failed to acquire lock for cron job %s, running anyway: %v", name, err))
+		} else if lock == nil {
+			common.CronJobRunsTotal.WithLabelValues(name, "skipped").Inc()
+			return
+		}
+
+		startTime := time.Now()
+		result := "success"
+		defer func() {
+			if r := recover(); r != nil {
+				result = "panic"
+				common.SysError(fmt.Sprintf("Cron job %s panicked: %v", name, r))
+			}
+			common.CronJobRunsTotal.WithLabelValues(name, result).Inc()
+			common.CronJobDuration.WithLabelValues(name).Observe(time.Since(startTime).Seconds())
+		}()
+
+		job()
+	}
+}
+
 // resetDailyStats 重置每日统计数据
 func (s *CronService) resetDailyStats() {
 	startTime := time.Now()
@@ -184,6 +222,15 @@ func (s *CronService) cleanExpiredLogs() {
 		common.SysLog("Cleaned expired logs successfully, deleted " + strconv.FormatInt(deletedCount, 10) + " records (older than " + strconv.Itoa(retentionMonths) + " months)")
 	}
 
+	// 请求/响应抓取内容体积较大，单独按天数保留
+	captureRetentionDays := getLogCaptureRetentionDays()
+	deletedCount, err = model.DeleteExpiredLogCaptures(captureRetentionDays)
+	if err != nil {
+		common.SysError("Failed to clean expired log captures: " + err.Error())
+	} else {
+		common.SysLog("Cleaned expired log captures successfully, deleted " + strconv.FormatInt(deletedCount, 10) + " records (older than " + strconv.Itoa(captureRetentionDays) + " days)")
+	}
+
 	duration := time.Since(startTime)
 	common.SysLog("Expired logs cleanup task completed in " + duration.String())
 }
@@ -204,6 +251,22 @@ func getLogRetentionMonths() int {
 	return months
 }
 
+// getLogCaptureRetentionDays 获取请求/响应抓取内容保留天数
+func getLogCaptureRetentionDays() int {
+	daysStr := os.Getenv("LOG_CAPTURE_RETENTION_DAYS")
+	if daysStr == "" {
+		return 7 // 默认保留7天
+	}
+
+	days, err := strconv.Atoi(daysStr)
+	if err != nil || days <= 0 {
+		log.Printf("Invalid LOG_CAPTURE_RETENTION_DAYS value: %s, using default value 7", daysStr)
+		return 7
+	}
+
+	return days
+}
+
 // recoverAbnormalAccounts 恢复异常账号测试
 func (s *CronService) recoverAbnormalAccounts() {
 	startTime := time.Now()
@@ -253,6 +316,8 @@ func (s *CronService) testAndRecoverAccount(account *model.Account) bool {
 		statusCode, err = relay.TestHandleClaudeConsoleRequest(account)
 	case constant.PlatformOpenAI:
 		statusCode, err = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, err = relay.TestHandleGeminiRequest(account)
 	default:
 		common.SysError(fmt.Sprintf("Unsupported platform type for account %s (ID: %d): %s", account.Name, account.ID, account.PlatformType))
 		return false
@@ -266,12 +331,62 @@ func (s *CronService) testAndRecoverAccount(account *model.Account) bool {
 			common.SysError(fmt.Sprintf("Failed to recover account %s (ID: %d): %v", account.Name, account.ID, updateErr))
 			return false
 		}
+		account.CurrentStatus = 1
+		service.EmitAccountAlert(account, service.AlertAccountRecovered, "定时测试请求成功，账号已恢复为正常状态")
 		return true
 	}
 
 	return false
 }
 
+// refreshOAuthTokens 提前刷新即将过期的Claude OAuth token，避免在用户请求中同步刷新
+// 已处于刷新失败状态的账号也会重试，刷新成功后恢复为正常状态
+func (s *CronService) refreshOAuthTokens() {
+	refreshBefore := getOAuthRefreshAheadDuration()
+	deadline := time.Now().Add(refreshBefore).Unix()
+
+	var accounts []model.Account
+	err := model.DB.Where("platform_type = ? AND active_status = ? AND refresh_token <> '' AND expires_at > 0 AND expires_at < ?",
+		constant.PlatformClaude, 1, deadline).Find(&accounts).Error
+	if err != nil {
+		common.SysError("Failed to query accounts for oauth token refresh: " + err.Error())
+		return
+	}
+
+	if len(accounts) == 0 {
+		return
+	}
+
+	refreshedCount := 0
+	failedCount := 0
+	for i := range accounts {
+		if err := relay.RefreshAccountToken(context.Background(), &accounts[i], refreshBefore); err != nil {
+			failedCount++
+			common.SysError(fmt.Sprintf("Failed to refresh oauth token for account %s (ID: %d): %v", accounts[i].Name, accounts[i].ID, err))
+		} else {
+			refreshedCount++
+		}
+	}
+
+	common.SysLog(fmt.Sprintf("OAuth token refresh task completed. Refreshed: %d, Failed: %d", refreshedCount, failedCount))
+}
+
+// getOAuthRefreshAheadDuration 获取OAuth token提前刷新时间
+func getOAuthRefreshAheadDuration() time.Duration {
+	minutesStr := os.Getenv("OAUTH_REFRESH_AHEAD_MINUTES")
+	if minutesStr == "" {
+		return 30 * time.Minute // 默认提前30分钟
+	}
+
+	minutes, err := strconv.Atoi(minutesStr)
+	if err != nil || minutes <= 0 {
+		log.Printf("Invalid OAUTH_REFRESH_AHEAD_MINUTES value: %s, using default value 30", minutesStr)
+		return 30 * time.Minute
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
 // ManualCleanExpiredLogs 手动清理过期日志（用于测试或管理员操作）
 func (s *CronService) ManualCleanExpiredLogs() (int64, error) {
 	common.SysLog("Manual expired logs cleanup triggered")
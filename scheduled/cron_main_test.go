@@ -0,0 +1,74 @@
+package scheduled
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// setupTestRedis 使用内存Redis替换common.RDB，模拟多个实例共享同一个Redis
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	previous := common.RDB
+	common.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		common.RDB.Close()
+		common.RDB = previous
+	})
+	return mr
+}
+
+func TestInstrumentJobRunsOncePerSchedule(t *testing.T) {
+	setupTestRedis(t)
+
+	runs := 0
+	job := func() { runs++ }
+
+	// 两个实例在同一调度周期内触发同一任务
+	instrumentJob("test_job", time.Minute, job)()
+	instrumentJob("test_job", time.Minute, job)()
+
+	if runs != 1 {
+		t.Fatalf("job ran %d times; want 1", runs)
+	}
+}
+
+func TestInstrumentJobSkipsWhenLockHeld(t *testing.T) {
+	setupTestRedis(t)
+
+	lock, err := common.TryLock(context.Background(), "cron_job_lock:test_job", time.Minute)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLock = %v, %v; want lock", lock, err)
+	}
+
+	ran := false
+	instrumentJob("test_job", time.Minute, func() { ran = true })()
+	if ran {
+		t.Fatal("job ran while another instance held the lock")
+	}
+}
+
+func TestInstrumentJobRunsAfterLockExpires(t *testing.T) {
+	mr := setupTestRedis(t)
+
+	runs := 0
+	job := instrumentJob("test_job", time.Minute, func() { runs++ })
+	job()
+	mr.FastForward(2 * time.Minute)
+	job()
+
+	if runs != 2 {
+		t.Fatalf("job ran %d times; want 2", runs)
+	}
+}
+
+func TestInstrumentJobRecoversPanic(t *testing.T) {
+	setupTestRedis(t)
+
+	instrumentJob("test_job", time.Minute, func() { panic("boom") })()
+}
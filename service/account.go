@@ -2,10 +2,11 @@ package service
 
 import (
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"errors"
+	"fmt"
 	"log"
-	"time"
 )
 
 type AccountService struct{}
@@ -40,6 +41,10 @@ func (s *AccountService) GetAccountList(page, limit int, userID *uint) (*model.A
 
 // CreateAccount 创建账号
 func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID uint) (*model.Account, error) {
+	if err := validateAccountModelRules(req.ModelRestriction, req.ModelMapping); err != nil {
+		return nil, err
+	}
+
 	// 设置今日请求次数：获取同用户、同分组、同优先级可用账号的最大今日请求次数，然后减1
 	todayUsageCount := req.TodayUsageCount
 	if todayUsageCount == 0 && req.Priority > 0 {
@@ -65,6 +70,7 @@ func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID u
 		ProxyURI:         req.ProxyURI,
 		ModelMapping:     req.ModelMapping,
 		ModelRestriction: req.ModelRestriction,
+		OpenAIApiType:    req.OpenAIApiType,
 		ActiveStatus:     req.ActiveStatus,
 		IsMax:            req.IsMax,
 		AccessToken:      req.AccessToken,
@@ -74,6 +80,10 @@ func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID u
 		UserID:           userID,
 	}
 
+	if account.OpenAIApiType == "" {
+		account.OpenAIApiType = constant.OpenAIApiTypeChatCompletions
+	}
+
 	if err := model.CreateAccount(account); err != nil {
 		return nil, errors.New("创建账号失败")
 	}
@@ -81,6 +91,14 @@ func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID u
 	return account, nil
 }
 
+// validateAccountModelRules 校验账号的模型限制和模型映射规则
+func validateAccountModelRules(modelRestriction, modelMapping string) error {
+	if err := common.ValidateModelPatterns(modelRestriction); err != nil {
+		return err
+	}
+	return common.ValidateModelMapping(modelMapping)
+}
+
 // GetAccountByID 根据ID获取账号详情
 func (s *AccountService) GetAccountByID(id uint, userID *uint) (*model.Account, error) {
 	account, err := model.GetAccountByID(id)
@@ -96,8 +114,42 @@ func (s *AccountService) GetAccountByID(id uint, userID *uint) (*model.Account,
 	return account, nil
 }
 
+// RevealAccountSecrets 获取账号的完整密钥，只有账号所属用户可以查看，管理员也不例外
+func (s *AccountService) RevealAccountSecrets(id uint, userID uint) (*model.Account, error) {
+	account, err := s.GetAccountByID(id, &userID)
+	if err != nil {
+		return nil, err
+	}
+
+	common.SysLog(fmt.Sprintf("User %d revealed secrets of account %d", userID, id))
+	return account, nil
+}
+
+// ReencryptAccountSecrets 使用当前主密钥重新加密所有账号密钥，用于开启加密或主密钥轮换后迁移历史数据
+func (s *AccountService) ReencryptAccountSecrets() (int, error) {
+	enabled, err := common.IsSecretEncryptionEnabled()
+	if err != nil {
+		return 0, err
+	}
+	if !enabled {
+		return 0, errors.New("未配置主密钥 ACCOUNT_ENCRYPTION_KEYS，无法加密账号密钥")
+	}
+
+	updatedCount, err := model.ReencryptAccountSecrets()
+	if err != nil {
+		return updatedCount, err
+	}
+
+	common.SysLog(fmt.Sprintf("Re-encrypted secrets of %d accounts", updatedCount))
+	return updatedCount, nil
+}
+
 // UpdateAccount 更新账号
 func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest, userID *uint) (*model.Account, error) {
+	if err := validateAccountModelRules(req.ModelRestriction, req.ModelMapping); err != nil {
+		return nil, err
+	}
+
 	account, err := s.GetAccountByID(id, userID)
 	if err != nil {
 		return nil, err
@@ -116,30 +168,48 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 	account.ProxyURI = req.ProxyURI
 	account.ModelMapping = req.ModelMapping
 	account.ModelRestriction = req.ModelRestriction
+	if req.OpenAIApiType != "" {
+		account.OpenAIApiType = req.OpenAIApiType
+	}
 	account.ActiveStatus = req.ActiveStatus
 	account.IsMax = req.IsMax
 
-	if req.SecretKey != "" {
-		account.SecretKey = req.SecretKey
+	// 保存账号配置，使用统计、运行状态、密钥和token不在这里覆盖，下面按需单独更新
+	if err := model.UpdateAccount(account); err != nil {
+		return nil, errors.New("更新账号失败")
 	}
 
-	if req.AccessToken != "" {
-		account.AccessToken = req.AccessToken
+	if req.SecretKey != "" {
+		if err := model.UpdateAccountSecretKey(account.ID, req.SecretKey); err != nil {
+			return nil, errors.New("更新账号失败")
+		}
+		account.SecretKey = req.SecretKey
 	}
 
-	if req.RefreshToken != "" {
-		account.RefreshToken = req.RefreshToken
+	// token只通过 UpdateAccountOAuthTokens 写入，更新后刷新失败状态恢复为正常，由下次请求或定时任务刷新access token
+	if req.AccessToken != "" || req.RefreshToken != "" {
+		if err := model.UpdateAccountOAuthTokens(account.ID, req.AccessToken, req.RefreshToken, 0); err != nil {
+			return nil, errors.New("更新账号失败")
+		}
+		if req.AccessToken != "" {
+			account.AccessToken = req.AccessToken
+		}
+		if req.RefreshToken != "" {
+			account.RefreshToken = req.RefreshToken
+		}
+		if account.CurrentStatus == model.AccountStatusRefreshFailed {
+			account.CurrentStatus = 1
+		}
 	}
 
 	// 更新TodayUsageCount字段，如果请求中设置了该字段，则更新
 	if req.TodayUsageCount > 0 {
+		if err := model.UpdateAccountTodayUsageCount(account.ID, req.TodayUsageCount); err != nil {
+			return nil, errors.New("更新账号失败")
+		}
 		account.TodayUsageCount = req.TodayUsageCount
 	}
 
-	if err := model.UpdateAccount(account); err != nil {
-		return nil, errors.New("更新账号失败")
-	}
-
 	return account, nil
 }
 
@@ -184,6 +254,9 @@ func (s *AccountService) UpdateAccountActiveStatus(id uint, activeStatus int, us
 		if todayUsageCount < 0 {
 			todayUsageCount = 0
 		}
+		if err := model.UpdateAccountTodayUsageCount(account.ID, todayUsageCount); err != nil {
+			return errors.New("更新账号激活状态失败")
+		}
 		account.TodayUsageCount = todayUsageCount
 	}
 
@@ -209,7 +282,7 @@ func (s *AccountService) UpdateAccountCurrentStatus(id uint, currentStatus int,
 
 	account.CurrentStatus = currentStatus
 
-	if err := model.UpdateAccount(account); err != nil {
+	if err := model.UpdateAccountCurrentStatus(account.ID, account.CurrentStatus); err != nil {
 		return errors.New("更新账号当前状态失败")
 	}
 
@@ -217,84 +290,39 @@ func (s *AccountService) UpdateAccountCurrentStatus(id uint, currentStatus int,
 }
 
 // UpdateAccountStatus 根据响应状态码更新账号状态
+// 使用原子SQL更新，避免并发请求丢失计数或覆盖管理员对账号的修改
 func (s *AccountService) UpdateAccountStatus(account *model.Account, statusCode int, usage *common.TokenUsage) {
+	var err error
+
 	// 根据状态码设置CurrentStatus
 	switch {
 	case statusCode == 429:
 		// 限流状态
 		account.CurrentStatus = 3
+		err = model.UpdateAccountCurrentStatus(account.ID, account.CurrentStatus)
 	case statusCode > 400:
 		// 接口异常
+		previousStatus := account.CurrentStatus
 		account.CurrentStatus = 2
+		err = model.UpdateAccountCurrentStatus(account.ID, account.CurrentStatus)
+		if err == nil && previousStatus != 2 {
+			EmitAccountAlert(account, AlertAccountAbnormal, fmt.Sprintf("上游返回状态码 %d", statusCode))
+		}
 	case statusCode == 200 || statusCode == 201:
-		// 正常状态
+		// 正常状态，请求成功时累加今日使用次数、tokens和费用，并更新最后使用时间
 		account.CurrentStatus = 1
 
-		// 请求成功时更新最后使用时间和今日使用次数
-		now := time.Now()
-
-		// 判断最后使用时间是否为当天
-		if account.LastUsedTime != nil {
-			lastUsedDate := time.Time(*account.LastUsedTime).Format("2006-01-02")
-			todayDate := now.Format("2006-01-02")
-
-			if lastUsedDate == todayDate {
-				// 同一天，使用次数+1
-				account.TodayUsageCount++
-			} else {
-				// 不同天，重置为1
-				account.TodayUsageCount = 1
-			}
-		} else {
-			// 首次使用，设置为1
-			account.TodayUsageCount = 1
-		}
-
-		// 更新token使用量和费用（如果有的话）
+		currentCost := 0.0
 		if usage != nil {
-			// 计算本次请求的费用
-			costResult := common.CalculateCost(usage)
-			currentCost := costResult.Costs.Total
-
-			if account.LastUsedTime != nil {
-				lastUsedDate := time.Time(*account.LastUsedTime).Format("2006-01-02")
-				todayDate := now.Format("2006-01-02")
-
-				if lastUsedDate == todayDate {
-					// 同一天，累加各类tokens和费用
-					account.TodayInputTokens += usage.InputTokens
-					account.TodayOutputTokens += usage.OutputTokens
-					account.TodayCacheReadInputTokens += usage.CacheReadInputTokens
-					account.TodayCacheCreationInputTokens += usage.CacheCreationInputTokens
-					account.TodayTotalCost += currentCost
-				} else {
-					// 不同天，重置各类tokens和费用
-					account.TodayInputTokens = usage.InputTokens
-					account.TodayOutputTokens = usage.OutputTokens
-					account.TodayCacheReadInputTokens = usage.CacheReadInputTokens
-					account.TodayCacheCreationInputTokens = usage.CacheCreationInputTokens
-					account.TodayTotalCost = currentCost
-				}
-			} else {
-				// 首次使用，设置各类tokens和费用
-				account.TodayInputTokens = usage.InputTokens
-				account.TodayOutputTokens = usage.OutputTokens
-				account.TodayCacheReadInputTokens = usage.CacheReadInputTokens
-				account.TodayCacheCreationInputTokens = usage.CacheCreationInputTokens
-				account.TodayTotalCost = currentCost
-			}
+			currentCost = common.CalculateCost(usage).Costs.Total
 		}
-
-		// 更新最后使用时间
-		nowTime := model.Time(now)
-		account.LastUsedTime = &nowTime
+		err = model.IncrementAccountUsage(account.ID, usage, currentCost)
 	default:
 		// 其他状态码保持原状态
 		return
 	}
 
-	// 更新数据库
-	if err := model.UpdateAccount(account); err != nil {
+	if err != nil {
 		log.Printf("failed to update account status: %v", err)
 	}
 }
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 账号告警事件类型
+const (
+	AlertAccountRateLimited     = "account_rate_limited"      // 账号被限流
+	AlertAccountAbnormal        = "account_abnormal"          // 账号接口异常
+	AlertAccountRecovered       = "account_recovered"         // 异常账号恢复正常
+	AlertAccountOAuthRefreshErr = "account_oauth_refresh_err" // OAuth token刷新失败
+)
+
+const (
+	// 同一账号同一类型告警的默认去重时间窗口
+	defaultAlertDedupeWindow = 30 * time.Minute
+
+	// 单个渠道的最大投递次数（含首次）
+	alertMaxDeliveryAttempts = 3
+
+	alertWebhookTimeout = 10 * time.Second
+)
+
+// alertTitles 告警事件的标题
+var alertTitles = map[string]string{
+	AlertAccountRateLimited:     "账号被限流",
+	AlertAccountAbnormal:        "账号接口异常",
+	AlertAccountRecovered:       "账号已恢复",
+	AlertAccountOAuthRefreshErr: "账号OAuth刷新失败",
+}
+
+// AccountAlertEvent 账号状态变化的告警事件，通用Webhook以此结构的JSON投递
+type AccountAlertEvent struct {
+	Type          string    `json:"type"`
+	Title         string    `json:"title"`
+	AccountID     uint      `json:"account_id"`
+	AccountName   string    `json:"account_name"`
+	PlatformType  string    `json:"platform_type"`
+	UserID        uint      `json:"user_id"`
+	CurrentStatus int       `json:"current_status"`
+	Message       string    `json:"message"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// text 告警的文本内容，用于IM机器人和邮件
+func (e *AccountAlertEvent) text() string {
+	return fmt.Sprintf("【%s】\n账号: %s (ID: %d)\n平台: %s\n当前状态: %d\n详情: %s\n时间: %s",
+		e.Title, e.AccountName, e.AccountID, e.PlatformType, e.CurrentStatus, e.Message,
+		e.OccurredAt.Format("2006-01-02 15:04:05"))
+}
+
+// alertWebhook 告警Webhook，format决定请求体格式
+type alertWebhook struct {
+	format string // json、slack、dingtalk、feishu
+	url    string
+}
+
+// localAlertDedupe Redis不可用时的本地去重记录，值为去重窗口的结束时间
+var (
+	localAlertDedupe   = make(map[string]time.Time)
+	localAlertDedupeMu sync.Mutex
+)
+
+// EmitAccountAlert 发送账号告警，同一账号同一类型的告警在去重窗口内只发送一次
+// 投递在后台进行，不阻塞调用方
+func EmitAccountAlert(account *model.Account, eventType string, message string) {
+	if account == nil {
+		return
+	}
+
+	// 账号恢复后重新开始计算异常告警的去重窗口，恢复后再次异常时能及时告警
+	if eventType == AlertAccountRecovered {
+		resetAlertSlots(account.ID)
+	}
+
+	webhooks := getAlertWebhooks()
+	emailEnabled := isAlertEmailEnabled()
+	if len(webhooks) == 0 && !emailEnabled {
+		return
+	}
+
+	if !acquireAlertSlot(account.ID, eventType) {
+		return
+	}
+
+	event := &AccountAlertEvent{
+		Type:          eventType,
+		Title:         alertTitles[eventType],
+		AccountID:     account.ID,
+		AccountName:   account.Name,
+		PlatformType:  account.PlatformType,
+		UserID:        account.UserID,
+		CurrentStatus: account.CurrentStatus,
+		Message:       message,
+		OccurredAt:    time.Now(),
+	}
+
+	for _, webhook := range webhooks {
+		go deliverAlertWebhook(webhook, event)
+	}
+	if emailEnabled {
+		go deliverAlertEmail(event)
+	}
+}
+
+// acquireAlertSlot 占用告警去重窗口，窗口内已发送过同类告警时返回false
+func acquireAlertSlot(accountID uint, eventType string) bool {
+	window := defaultAlertDedupeWindow
+	if minutes := getEnvInt("ALERT_DEDUPE_MINUTES", 0); minutes > 0 {
+		window = time.Duration(minutes) * time.Minute
+	}
+	cacheKey := alertDedupeKey(accountID, eventType)
+
+	if common.RDB != nil {
+		ok, err := common.RDB.SetNX(context.Background(), cacheKey, 1, window).Result()
+		if err == nil {
+			return ok
+		}
+		common.SysError("Failed to check alert dedupe: " + err.Error())
+	}
+
+	localAlertDedupeMu.Lock()
+	defer localAlertDedupeMu.Unlock()
+
+	now := time.Now()
+	if until, exists := localAlertDedupe[cacheKey]; exists && now.Before(until) {
+		return false
+	}
+	localAlertDedupe[cacheKey] = now.Add(window)
+	return true
+}
+
+func alertDedupeKey(accountID uint, eventType string) string {
+	return fmt.Sprintf("account_alert:%d:%s", accountID, eventType)
+}
+
+// resetAlertSlots 清除账号异常类告警的去重记录
+func resetAlertSlots(accountID uint) {
+	keys := []string{
+		alertDedupeKey(accountID, AlertAccountAbnormal),
+		alertDedupeKey(accountID, AlertAccountRateLimited),
+		alertDedupeKey(accountID, AlertAccountOAuthRefreshErr),
+	}
+
+	if common.RDB != nil {
+		if err := common.RDB.Del(context.Background(), keys...).Err(); err != nil {
+			common.SysError("Failed to reset alert dedupe: " + err.Error())
+		}
+	}
+
+	localAlertDedupeMu.Lock()
+	defer localAlertDedupeMu.Unlock()
+	for _, key := range keys {
+		delete(localAlertDedupe, key)
+	}
+}
+
+// getAlertWebhooks 读取告警Webhook配置，每个变量支持逗号分隔的多个地址
+func getAlertWebhooks() []alertWebhook {
+	sources := []struct {
+		format string
+		env    string
+	}{
+		{"json", "ALERT_WEBHOOK_URLS"},
+		{"slack", "ALERT_SLACK_WEBHOOK_URLS"},
+		{"dingtalk", "ALERT_DINGTALK_WEBHOOK_URLS"},
+		{"feishu", "ALERT_FEISHU_WEBHOOK_URLS"},
+	}
+
+	var webhooks []alertWebhook
+	for _, source := range sources {
+		for _, url := range strings.Split(os.Getenv(source.env), ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				webhooks = append(webhooks, alertWebhook{format: source.format, url: url})
+			}
+		}
+	}
+	return webhooks
+}
+
+// isAlertEmailEnabled 是否通过邮件通知账号所属用户，配置了SMTP时默认开启，ALERT_EMAIL_ENABLED=false 可关闭
+func isAlertEmailEnabled() bool {
+	if enabled, err := strconv.ParseBool(os.Getenv("ALERT_EMAIL_ENABLED")); err == nil && !enabled {
+		return false
+	}
+	config := common.GetEmailConfig()
+	return config.SMTPServer != "" && config.SMTPAccount != "" && config.SMTPPassword != ""
+}
+
+// buildAlertWebhookBody 按Webhook格式构建请求体
+func buildAlertWebhookBody(format string, event *AccountAlertEvent) ([]byte, error) {
+	switch format {
+	case "slack":
+		return json.Marshal(map[string]interface{}{"text": event.text()})
+	case "dingtalk":
+		return json.Marshal(map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": event.text()},
+		})
+	case "feishu":
+		return json.Marshal(map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": event.text()},
+		})
+	default:
+		return json.Marshal(event)
+	}
+}
+
+// deliverAlertWebhook 投递Webhook，失败时按指数退避重试
+func deliverAlertWebhook(webhook alertWebhook, event *AccountAlertEvent) {
+	body, err := buildAlertWebhookBody(webhook.format, event)
+	if err != nil {
+		common.SysError("Failed to build alert webhook body: " + err.Error())
+		return
+	}
+
+	client := &http.Client{Timeout: alertWebhookTimeout}
+	err = retryAlertDelivery(func() error {
+		resp, err := client.Post(webhook.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer common.CloseIO(resp.Body)
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+		}
+		return nil
+	})
+	if err != nil {
+		common.SysError(fmt.Sprintf("Failed to deliver %s alert webhook for account %d: %v", webhook.format, event.AccountID, err))
+	}
+}
+
+// deliverAlertEmail 通过邮件通知账号所属用户
+func deliverAlertEmail(event *AccountAlertEvent) {
+	user, err := model.GetUserById(event.UserID)
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	err = retryAlertDelivery(func() error {
+		return common.SendSystemNotificationEmail(user.Email, event.Title, event.text())
+	})
+	if err != nil {
+		common.SysError(fmt.Sprintf("Failed to send alert email for account %d: %v", event.AccountID, err))
+	}
+}
+
+// retryAlertDelivery 执行投递，失败后等待1秒、2秒……重试
+func retryAlertDelivery(deliver func() error) error {
+	var err error
+	for attempt := 0; attempt < alertMaxDeliveryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
+		}
+		if err = deliver(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
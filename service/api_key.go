@@ -5,6 +5,8 @@ import (
 	"claude-code-relay/model"
 	"errors"
 	"log"
+	"os"
+	"strconv"
 	"time"
 
 	"gorm.io/gorm"
@@ -31,13 +33,31 @@ func CreateApiKey(userID uint, req *model.CreateApiKeyRequest) (*model.ApiKey, e
 		return nil, errors.New("过期时间不能早于当前时间")
 	}
 
+	if err := ValidateApiKeyScope(req.ModelRestriction, req.AllowedEndpoints, req.AllowedIPs); err != nil {
+		return nil, err
+	}
+
 	apiKey := &model.ApiKey{
-		Name:      req.Name,
-		Key:       req.Key,
-		ExpiresAt: req.ExpiresAt,
-		Status:    req.Status,
-		GroupID:   req.GroupID,
-		UserID:    userID,
+		Name:              req.Name,
+		Key:               req.Key,
+		ExpiresAt:         req.ExpiresAt,
+		Status:            req.Status,
+		GroupID:           req.GroupID,
+		UserID:            userID,
+		RpmLimit:          req.RpmLimit,
+		TpmLimit:          req.TpmLimit,
+		MaxConcurrency:    req.MaxConcurrency,
+		WeeklyBudget:      req.WeeklyBudget,
+		MonthlyBudget:     req.MonthlyBudget,
+		TotalBudget:       req.TotalBudget,
+		CaptureBodies:     req.CaptureBodies,
+		ModelRestriction:  req.ModelRestriction,
+		DailyLimit:        req.DailyLimit,
+		AllowedEndpoints:  req.AllowedEndpoints,
+		AllowedIPs:        req.AllowedIPs,
+		AllowedUserAgents: req.AllowedUserAgents,
+		MaxTokensLimit:    req.MaxTokensLimit,
+		MaxContextTokens:  req.MaxContextTokens,
 	}
 
 	if apiKey.Status == 0 {
@@ -100,12 +120,55 @@ func UpdateApiKey(id, userID uint, req *model.UpdateApiKeyRequest) (*model.ApiKe
 	if req.DailyLimit != nil {
 		apiKey.DailyLimit = *req.DailyLimit
 	}
+	if req.RpmLimit != nil {
+		apiKey.RpmLimit = *req.RpmLimit
+	}
+	if req.TpmLimit != nil {
+		apiKey.TpmLimit = *req.TpmLimit
+	}
+	if req.MaxConcurrency != nil {
+		apiKey.MaxConcurrency = *req.MaxConcurrency
+	}
+	if req.WeeklyBudget != nil {
+		apiKey.WeeklyBudget = *req.WeeklyBudget
+	}
+	if req.MonthlyBudget != nil {
+		apiKey.MonthlyBudget = *req.MonthlyBudget
+	}
+	if req.TotalBudget != nil {
+		apiKey.TotalBudget = *req.TotalBudget
+	}
+	if req.CaptureBodies != nil {
+		apiKey.CaptureBodies = *req.CaptureBodies
+	}
+	if req.AllowedEndpoints != nil {
+		apiKey.AllowedEndpoints = *req.AllowedEndpoints
+	}
+	if req.AllowedIPs != nil {
+		apiKey.AllowedIPs = *req.AllowedIPs
+	}
+	if req.AllowedUserAgents != nil {
+		apiKey.AllowedUserAgents = *req.AllowedUserAgents
+	}
+	if req.MaxTokensLimit != nil {
+		apiKey.MaxTokensLimit = *req.MaxTokensLimit
+	}
+	if req.MaxContextTokens != nil {
+		apiKey.MaxContextTokens = *req.MaxContextTokens
+	}
+
+	if err := ValidateApiKeyScope(apiKey.ModelRestriction, apiKey.AllowedEndpoints, apiKey.AllowedIPs); err != nil {
+		return nil, err
+	}
 
 	err = model.UpdateApiKey(apiKey)
 	if err != nil {
 		return nil, err
 	}
 
+	// 清理缓存，使限额等配置立即生效
+	model.ClearApiKeyCache(apiKey)
+
 	return apiKey, nil
 }
 
@@ -121,6 +184,75 @@ func DeleteApiKey(id, userID uint) error {
 	return model.DeleteApiKey(apiKey.ID)
 }
 
+const (
+	// 轮换API Key时旧密钥默认的宽限期
+	defaultApiKeyRotationGrace = 24 * time.Hour
+	// 旧密钥宽限期的上限
+	maxApiKeyRotationGrace = 30 * 24 * time.Hour
+)
+
+// getApiKeyRotationGrace 未指定宽限期时使用 API_KEY_ROTATION_GRACE_MINUTES(分钟)，默认24小时
+func getApiKeyRotationGrace() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("API_KEY_ROTATION_GRACE_MINUTES"))
+	if err != nil || minutes < 0 {
+		return defaultApiKeyRotationGrace
+	}
+	return min(time.Duration(minutes)*time.Minute, maxApiKeyRotationGrace)
+}
+
+// RotateApiKey 轮换API Key，返回带有新密钥的API Key
+// graceMinutes为nil时使用默认宽限期，为0时旧密钥立即失效
+func RotateApiKey(id, userID uint, graceMinutes *int) (*model.ApiKey, error) {
+	grace := getApiKeyRotationGrace()
+	if graceMinutes != nil {
+		if *graceMinutes < 0 {
+			return nil, errors.New("宽限期不能为负数")
+		}
+		grace = time.Duration(*graceMinutes) * time.Minute
+	}
+	if grace > maxApiKeyRotationGrace {
+		return nil, errors.New("宽限期不能超过30天")
+	}
+
+	apiKey, err := model.GetApiKeyById(id, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("API Key不存在")
+		}
+		return nil, err
+	}
+
+	if err := model.RotateApiKey(apiKey, grace); err != nil {
+		return nil, err
+	}
+
+	log.Printf("API Key %d 已轮换，旧密钥 %s 宽限期 %v", apiKey.ID, apiKey.PreviousKeyPrefix, grace)
+	return apiKey, nil
+}
+
+// RevokePreviousApiKey 使轮换前的旧密钥立即失效
+func RevokePreviousApiKey(id, userID uint) error {
+	apiKey, err := model.GetApiKeyById(id, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("API Key不存在")
+		}
+		return err
+	}
+	if apiKey.PreviousKeyHash == "" {
+		return errors.New("没有处于宽限期的旧密钥")
+	}
+
+	return model.RevokePreviousApiKey(apiKey)
+}
+
+// RecordPreviousApiKeyUsage 记录旧密钥的使用情况，失败时只记录日志
+func RecordPreviousApiKeyUsage(apiKey *model.ApiKey, clientIP, userAgent string) {
+	if err := model.RecordPreviousApiKeyUsage(apiKey.ID, clientIP, userAgent); err != nil {
+		log.Printf("failed to record previous api key usage: %v", err)
+	}
+}
+
 func GetApiKeys(page, limit int, userID uint, groupID *uint) (*model.ApiKeyListResult, error) {
 	if page <= 0 {
 		page = 1
@@ -160,7 +292,7 @@ func UpdateApiKeyStatusCom(id, userID uint, status int) error {
 	}
 
 	// 更新成功后清理相关缓存
-	model.ClearApiKeyCache(apiKey.Key)
+	model.ClearApiKeyCache(apiKey)
 	return nil
 }
 
@@ -188,73 +320,17 @@ func UpdateApiKeyStatus(apiKey *model.ApiKey, statusCode int, usage *common.Toke
 		return
 	}
 
-	// 重新从数据库获取最新的API Key数据（避免缓存问题）
-	freshApiKey, err := model.GetApiKeyByKeyForUpdate(apiKey.Key)
-	if err != nil {
-		log.Printf("failed to get fresh api key for update: %v", err)
-		return
-	}
-
-	now := time.Now()
-
-	// 判断最后使用时间是否为当天
-	if freshApiKey.LastUsedTime != nil {
-		lastUsedDate := time.Time(*freshApiKey.LastUsedTime).Format("2006-01-02")
-		todayDate := now.Format("2006-01-02")
-
-		if lastUsedDate == todayDate {
-			// 同一天，使用次数+1
-			freshApiKey.TodayUsageCount++
-		} else {
-			// 不同天，重置为1
-			freshApiKey.TodayUsageCount = 1
-		}
-	} else {
-		// 首次使用，设置为1
-		freshApiKey.TodayUsageCount = 1
-	}
+	// 计入每分钟tokens限流窗口
+	RecordApiKeyTokenUsage(apiKey, usage)
 
-	// 更新token使用量和费用（如果有的话）
+	// 计算本次请求的费用
+	currentCost := 0.0
 	if usage != nil {
-		// 计算本次请求的费用
-		costResult := common.CalculateCost(usage)
-		currentCost := costResult.Costs.Total
-
-		if freshApiKey.LastUsedTime != nil {
-			lastUsedDate := time.Time(*freshApiKey.LastUsedTime).Format("2006-01-02")
-			todayDate := now.Format("2006-01-02")
-
-			if lastUsedDate == todayDate {
-				// 同一天，累加各类tokens和费用
-				freshApiKey.TodayInputTokens += usage.InputTokens
-				freshApiKey.TodayOutputTokens += usage.OutputTokens
-				freshApiKey.TodayCacheReadInputTokens += usage.CacheReadInputTokens
-				freshApiKey.TodayCacheCreationInputTokens += usage.CacheCreationInputTokens
-				freshApiKey.TodayTotalCost += currentCost
-			} else {
-				// 不同天，重置各类tokens和费用
-				freshApiKey.TodayInputTokens = usage.InputTokens
-				freshApiKey.TodayOutputTokens = usage.OutputTokens
-				freshApiKey.TodayCacheReadInputTokens = usage.CacheReadInputTokens
-				freshApiKey.TodayCacheCreationInputTokens = usage.CacheCreationInputTokens
-				freshApiKey.TodayTotalCost = currentCost
-			}
-		} else {
-			// 首次使用，设置各类tokens和费用
-			freshApiKey.TodayInputTokens = usage.InputTokens
-			freshApiKey.TodayOutputTokens = usage.OutputTokens
-			freshApiKey.TodayCacheReadInputTokens = usage.CacheReadInputTokens
-			freshApiKey.TodayCacheCreationInputTokens = usage.CacheCreationInputTokens
-			freshApiKey.TodayTotalCost = currentCost
-		}
+		currentCost = common.CalculateCost(usage).Costs.Total
 	}
 
-	// 更新最后使用时间
-	nowTime := model.Time(now)
-	freshApiKey.LastUsedTime = &nowTime
-
-	// 更新数据库
-	if err := model.UpdateApiKey(freshApiKey); err != nil {
+	// 使用原子SQL累加今日统计和累计总费用，跨天重置在同一条语句中完成
+	if err := model.IncrementApiKeyUsage(apiKey.ID, usage, currentCost); err != nil {
 		log.Printf("failed to update api key status: %v", err)
 	}
 }
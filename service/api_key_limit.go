@@ -0,0 +1,160 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// 限流窗口
+	apiKeyRateLimitWindow = time.Minute
+
+	// 进行中请求计数的过期时间，防止进程异常退出后计数无法回收
+	apiKeyConcurrencyTTL = 30 * time.Minute
+)
+
+// ApiKeyRateLimitResult API Key限流检查结果
+type ApiKeyRateLimitResult struct {
+	Allowed           bool
+	Reason            string    // 被拒绝的原因
+	RetryAfter        int       // 建议的重试等待秒数
+	RequestsLimit     int       // 每分钟请求数限制，0表示不限制
+	RequestsRemaining int       // 当前窗口剩余请求数
+	TokensLimit       int       // 每分钟tokens限制，0表示不限制
+	TokensRemaining   int       // 当前窗口剩余tokens
+	Reset             time.Time // 当前窗口的重置时间
+}
+
+// apiKeyRateLimitWindowStart 当前限流窗口的起始时间
+func apiKeyRateLimitWindowStart(now time.Time) time.Time {
+	return now.Truncate(apiKeyRateLimitWindow)
+}
+
+func apiKeyRPMKey(apiKeyID uint, windowStart time.Time) string {
+	return fmt.Sprintf("api_key_rpm:%d:%d", apiKeyID, windowStart.Unix())
+}
+
+func apiKeyTPMKey(apiKeyID uint, windowStart time.Time) string {
+	return fmt.Sprintf("api_key_tpm:%d:%d", apiKeyID, windowStart.Unix())
+}
+
+// CheckApiKeyRateLimit 检查API Key的每分钟请求数和tokens限制，通过时计入本次请求
+// Redis不可用时不做限制
+func CheckApiKeyRateLimit(apiKey *model.ApiKey) *ApiKeyRateLimitResult {
+	now := time.Now()
+	windowStart := apiKeyRateLimitWindowStart(now)
+	result := &ApiKeyRateLimitResult{
+		Allowed:       true,
+		RequestsLimit: apiKey.RpmLimit,
+		TokensLimit:   apiKey.TpmLimit,
+		Reset:         windowStart.Add(apiKeyRateLimitWindow),
+	}
+
+	if common.RDB == nil || (apiKey.RpmLimit <= 0 && apiKey.TpmLimit <= 0) {
+		return result
+	}
+
+	ctx := context.Background()
+	retryAfter := int(result.Reset.Sub(now).Seconds()) + 1
+
+	// tokens在请求完成后才能统计，这里只检查当前窗口是否已用完
+	if apiKey.TpmLimit > 0 {
+		usedTokens, err := common.RDB.Get(ctx, apiKeyTPMKey(apiKey.ID, windowStart)).Int()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			common.SysError("Failed to get api key token usage: " + err.Error())
+			return result
+		}
+		result.TokensRemaining = max(apiKey.TpmLimit-usedTokens, 0)
+		if usedTokens >= apiKey.TpmLimit {
+			result.Allowed = false
+			result.Reason = "API Key每分钟tokens超过限制"
+			result.RetryAfter = retryAfter
+			return result
+		}
+	}
+
+	if apiKey.RpmLimit > 0 {
+		cacheKey := apiKeyRPMKey(apiKey.ID, windowStart)
+		pipe := common.RDB.Pipeline()
+		incr := pipe.Incr(ctx, cacheKey)
+		pipe.Expire(ctx, cacheKey, 2*apiKeyRateLimitWindow)
+		if _, err := pipe.Exec(ctx); err != nil {
+			common.SysError("Failed to increase api key request count: " + err.Error())
+			return result
+		}
+
+		count := int(incr.Val())
+		if count > apiKey.RpmLimit {
+			// 被拒绝的请求不占用配额
+			common.RDB.Decr(ctx, cacheKey)
+			result.Allowed = false
+			result.Reason = "API Key每分钟请求数超过限制"
+			result.RetryAfter = retryAfter
+			return result
+		}
+		result.RequestsRemaining = apiKey.RpmLimit - count
+	}
+
+	return result
+}
+
+// RecordApiKeyTokenUsage 将请求消耗的输入+输出tokens计入当前限流窗口
+func RecordApiKeyTokenUsage(apiKey *model.ApiKey, usage *common.TokenUsage) {
+	if common.RDB == nil || apiKey.TpmLimit <= 0 || usage == nil {
+		return
+	}
+
+	tokens := usage.InputTokens + usage.OutputTokens
+	if tokens <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	cacheKey := apiKeyTPMKey(apiKey.ID, apiKeyRateLimitWindowStart(time.Now()))
+	pipe := common.RDB.Pipeline()
+	pipe.IncrBy(ctx, cacheKey, int64(tokens))
+	pipe.Expire(ctx, cacheKey, 2*apiKeyRateLimitWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("Failed to record api key token usage: " + err.Error())
+	}
+}
+
+// AcquireApiKeyConcurrency 占用API Key的一个流式请求并发名额，超过最大并发流数时返回false
+// 返回的函数用于在请求结束时释放名额
+func AcquireApiKeyConcurrency(apiKey *model.ApiKey) (func(), bool) {
+	if common.RDB == nil || apiKey.MaxConcurrency <= 0 {
+		return func() {}, true
+	}
+
+	ctx := context.Background()
+	cacheKey := fmt.Sprintf("api_key_concurrency:%d", apiKey.ID)
+
+	pipe := common.RDB.Pipeline()
+	incr := pipe.Incr(ctx, cacheKey)
+	pipe.Expire(ctx, cacheKey, apiKeyConcurrencyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("Failed to increase api key concurrency: " + err.Error())
+		return func() {}, true
+	}
+
+	release := func() {
+		if count, err := common.RDB.Decr(ctx, cacheKey).Result(); err == nil && count <= 0 {
+			common.RDB.Del(ctx, cacheKey)
+		}
+	}
+
+	if int(incr.Val()) > apiKey.MaxConcurrency {
+		release()
+		return func() {}, false
+	}
+
+	var once sync.Once
+	return func() { once.Do(release) }, true
+}
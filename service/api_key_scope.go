@@ -0,0 +1,200 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// API Key可限制调用的中转接口
+const (
+	ApiKeyEndpointMessages        = "messages"
+	ApiKeyEndpointCountTokens     = "count_tokens"
+	ApiKeyEndpointChatCompletions = "chat_completions"
+)
+
+// relayEndpoints 中转路由与接口名称的对应关系，新增中转路由时需要在这里登记，未登记的路由在限制了接口时一律拒绝
+var relayEndpoints = map[string]string{
+	"/v1/messages":              ApiKeyEndpointMessages,
+	"/v1/messages/count_tokens": ApiKeyEndpointCountTokens,
+	"/v1/chat/completions":      ApiKeyEndpointChatCompletions,
+}
+
+// ErrInvalidApiKeyScope API Key的接口或IP白名单配置不合法
+var ErrInvalidApiKeyScope = errors.New("API Key权限配置错误")
+
+// ApiKeyScopeError API Key权限校验失败的原因
+type ApiKeyScopeError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+// Response Claude接口格式的错误响应
+func (e *ApiKeyScopeError) Response() gin.H {
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    e.Type,
+			"message": e.Message,
+		},
+	}
+}
+
+func permissionError(format string, args ...interface{}) *ApiKeyScopeError {
+	return &ApiKeyScopeError{StatusCode: http.StatusForbidden, Type: "permission_error", Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidRequestError(format string, args ...interface{}) *ApiKeyScopeError {
+	return &ApiKeyScopeError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: fmt.Sprintf(format, args...)}
+}
+
+// TrustedProxies 环境变量 TRUSTED_PROXIES 配置的可信代理，逗号或空格分隔
+var TrustedProxies = sync.OnceValue(func() []string {
+	return strings.Fields(strings.ReplaceAll(os.Getenv("TRUSTED_PROXIES"), ",", " "))
+})
+
+// RelayEndpointName 根据路由路径获取中转接口名称，未登记的路由返回空字符串
+func RelayEndpointName(routePath string) string {
+	for route, name := range relayEndpoints {
+		if strings.HasSuffix(routePath, route) {
+			return name
+		}
+	}
+	return ""
+}
+
+// splitScopeList 拆分逗号或换行分隔的配置项，忽略空项
+func splitScopeList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseAllowedIP 解析IP或CIDR，单个IP视为只包含自身的网段
+func parseAllowedIP(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ValidateApiKeyScope 保存API Key前校验模型限制、接口和IP白名单配置
+func ValidateApiKeyScope(modelRestriction, allowedEndpoints, allowedIPs string) error {
+	if err := common.ValidateModelPatterns(modelRestriction); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidApiKeyScope, err)
+	}
+
+	known := make(map[string]bool)
+	for _, name := range relayEndpoints {
+		known[name] = true
+	}
+	for _, endpoint := range splitScopeList(allowedEndpoints) {
+		if !known[endpoint] {
+			return fmt.Errorf("%w: 不支持的接口 %s", ErrInvalidApiKeyScope, endpoint)
+		}
+	}
+
+	ips := splitScopeList(allowedIPs)
+	if len(ips) > 0 && len(TrustedProxies()) == 0 {
+		return fmt.Errorf("%w: 使用IP白名单需要先配置可信代理 TRUSTED_PROXIES", ErrInvalidApiKeyScope)
+	}
+	for _, ip := range ips {
+		if _, err := parseAllowedIP(ip); err != nil {
+			return fmt.Errorf("%w: IP白名单格式错误 %s", ErrInvalidApiKeyScope, ip)
+		}
+	}
+	return nil
+}
+
+// CheckApiKeyAccess 检查API Key是否允许调用该接口，以及来源IP和User-Agent是否在允许范围内
+func CheckApiKeyAccess(apiKey *model.ApiKey, endpoint, clientIP, userAgent string) *ApiKeyScopeError {
+	if endpoints := splitScopeList(apiKey.AllowedEndpoints); len(endpoints) > 0 {
+		allowed := false
+		for _, item := range endpoints {
+			if endpoint != "" && item == endpoint {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return permissionError("This API key is not allowed to call this endpoint")
+		}
+	}
+
+	if ips := splitScopeList(apiKey.AllowedIPs); len(ips) > 0 {
+		// 未配置可信代理时无法确认客户端真实IP，设置了IP白名单的API Key一律拒绝
+		if len(TrustedProxies()) == 0 {
+			return permissionError("This API key has an IP allowlist, but the server has no trusted proxies configured")
+		}
+		allowed := false
+		if addr, err := netip.ParseAddr(clientIP); err == nil {
+			addr = addr.Unmap()
+			for _, item := range ips {
+				if prefix, err := parseAllowedIP(item); err == nil && prefix.Contains(addr) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if !allowed {
+			return permissionError("This API key is not allowed to be used from IP address %s", clientIP)
+		}
+	}
+
+	// User-Agent按前缀匹配，不区分大小写，例如 claude-cli/ 只允许Claude Code客户端
+	if patterns := splitScopeList(apiKey.AllowedUserAgents); len(patterns) > 0 {
+		allowed := false
+		for _, pattern := range patterns {
+			if strings.HasPrefix(strings.ToLower(userAgent), strings.ToLower(pattern)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return permissionError("This API key is not allowed to be used by this client")
+		}
+	}
+
+	return nil
+}
+
+// CheckApiKeyRequestLimits 检查请求的max_tokens和上下文大小是否超出API Key的限制
+// 上下文大小使用本地估算的输入tokens，与预占预算使用相同的估算方式
+func CheckApiKeyRequestLimits(apiKey *model.ApiKey, body []byte) *ApiKeyScopeError {
+	if apiKey.MaxTokensLimit > 0 {
+		if maxTokens := gjson.GetBytes(body, "max_tokens").Int(); maxTokens > int64(apiKey.MaxTokensLimit) {
+			return invalidRequestError("max_tokens: %d > %d, which is the maximum allowed for this API key", maxTokens, apiKey.MaxTokensLimit)
+		}
+	}
+
+	if apiKey.MaxContextTokens > 0 {
+		if inputTokens := EstimateInputTokens(body); inputTokens > apiKey.MaxContextTokens {
+			return invalidRequestError("prompt is too long: about %d tokens > %d maximum allowed for this API key", inputTokens, apiKey.MaxContextTokens)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"fmt"
+)
+
+// BudgetUsage 预算配置与已用费用（USD），预算为0表示不限制
+type BudgetUsage struct {
+	WeeklyBudget  float64 `json:"weekly_budget"`
+	WeeklyCost    float64 `json:"weekly_cost"`
+	MonthlyBudget float64 `json:"monthly_budget"`
+	MonthlyCost   float64 `json:"monthly_cost"`
+	TotalBudget   float64 `json:"total_budget"`
+	TotalCost     float64 `json:"total_cost"`
+}
+
+// hasBudget 是否配置了任意预算
+func hasBudget(weekly, monthly, total float64) bool {
+	return weekly > 0 || monthly > 0 || total > 0
+}
+
+// exceededReason 返回超出的预算描述，未超出返回空字符串
+func (b *BudgetUsage) exceededReason(subject string) string {
+	switch {
+	case b.TotalBudget > 0 && b.TotalCost >= b.TotalBudget:
+		return fmt.Sprintf("%s已达到总预算($%.2f)", subject, b.TotalBudget)
+	case b.MonthlyBudget > 0 && b.MonthlyCost >= b.MonthlyBudget:
+		return fmt.Sprintf("%s已达到最近30天预算($%.2f)", subject, b.MonthlyBudget)
+	case b.WeeklyBudget > 0 && b.WeeklyCost >= b.WeeklyBudget:
+		return fmt.Sprintf("%s已达到最近7天预算($%.2f)", subject, b.WeeklyBudget)
+	}
+	return ""
+}
+
+// GetApiKeyBudgetUsage 获取API Key的预算使用情况
+func GetApiKeyBudgetUsage(apiKey *model.ApiKey) (*BudgetUsage, error) {
+	spend, err := model.GetApiKeySpend(apiKey.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BudgetUsage{
+		WeeklyBudget:  apiKey.WeeklyBudget,
+		WeeklyCost:    spend.WeeklyCost,
+		MonthlyBudget: apiKey.MonthlyBudget,
+		MonthlyCost:   spend.MonthlyCost,
+		TotalBudget:   apiKey.TotalBudget,
+		TotalCost:     spend.TotalCost,
+	}, nil
+}
+
+// GetGroupBudgetUsage 获取分组的预算使用情况，分组不存在时返回nil
+func GetGroupBudgetUsage(groupID int) (*BudgetUsage, error) {
+	if groupID <= 0 {
+		return nil, nil
+	}
+
+	group := model.GetGroupBudget(groupID)
+	if group == nil {
+		return nil, nil
+	}
+
+	spend, err := model.GetGroupSpend(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BudgetUsage{
+		WeeklyBudget:  group.WeeklyBudget,
+		WeeklyCost:    spend.WeeklyCost,
+		MonthlyBudget: group.MonthlyBudget,
+		MonthlyCost:   spend.MonthlyCost,
+		TotalBudget:   group.TotalBudget,
+		TotalCost:     spend.TotalCost,
+	}, nil
+}
+
+// CheckSpendBudget 检查API Key及其分组的预算，超出时返回拒绝原因，未超出返回空字符串
+// 统计失败时不拦截请求
+func CheckSpendBudget(apiKey *model.ApiKey) string {
+	if hasBudget(apiKey.WeeklyBudget, apiKey.MonthlyBudget, apiKey.TotalBudget) {
+		usage, err := GetApiKeyBudgetUsage(apiKey)
+		if err != nil {
+			common.SysError("Failed to get api key budget usage: " + err.Error())
+		} else if reason := usage.exceededReason("API Key"); reason != "" {
+			return reason
+		}
+	}
+
+	if apiKey.GroupID > 0 {
+		group := model.GetGroupBudget(apiKey.GroupID)
+		if group == nil || !hasBudget(group.WeeklyBudget, group.MonthlyBudget, group.TotalBudget) {
+			return ""
+		}
+
+		usage, err := GetGroupBudgetUsage(apiKey.GroupID)
+		if err != nil {
+			common.SysError("Failed to get group budget usage: " + err.Error())
+		} else if usage != nil {
+			return usage.exceededReason("API Key所属分组")
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// 未指定max_tokens时按该输出tokens数预估
+	defaultReserveOutputTokens = 4096
+
+	// 图片/文档等二进制内容按固定tokens数预估，避免按base64长度高估
+	reserveMediaTokens = 1600
+
+	// 单笔预占的过期时间，防止进程异常退出后预占无法释放
+	budgetReservationTTL = 30 * time.Minute
+)
+
+// reserveBudgetScript 原子地检查并预占每日限额
+// 每笔预占单独记录在有序集合中，成员为 预占ID:金额，分数为过期时间，检查前先清理已过期的预占
+// KEYS[1] 当日已结算费用 KEYS[2] 当前预占集合
+// ARGV[1] 数据库中的当日费用 ARGV[2] 本次预占金额 ARGV[3] 每日限额 ARGV[4] 当前时间(毫秒) ARGV[5] 本次预占过期时间(毫秒) ARGV[6] 预占ID
+var reserveBudgetScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[4])
+local reserved = 0
+for _, member in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+	reserved = reserved + (tonumber(string.match(member, ':([^:]+)$')) or 0)
+end
+local settled = tonumber(redis.call('GET', KEYS[1]) or '0')
+local used = math.max(settled, tonumber(ARGV[1]))
+if used + reserved + tonumber(ARGV[2]) > tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[5], ARGV[6] .. ':' .. ARGV[2])
+redis.call('PEXPIREAT', KEYS[2], ARGV[5])
+return 1
+`)
+
+// BudgetReservation 一次请求在每日限额中预占的金额，请求结束时按实际费用结算
+type BudgetReservation struct {
+	apiKeyID uint
+	date     string
+	member   string // 预占集合中的成员
+	once     sync.Once
+}
+
+func apiKeyDailySpendKey(apiKeyID uint, date string) string {
+	return fmt.Sprintf("api_key_daily_spend:%d:%s", apiKeyID, date)
+}
+
+func apiKeyReservationsKey(apiKeyID uint) string {
+	return fmt.Sprintf("api_key_reservations:%d", apiKeyID)
+}
+
+// ReserveApiKeyBudget 按max_tokens和输入tokens预估本次请求的最大费用，并在每日限额中预占
+// 剩余额度不足时返回false；未配置每日限额或Redis不可用时返回nil预占并放行
+func ReserveApiKeyBudget(apiKey *model.ApiKey, body []byte) (*BudgetReservation, bool) {
+	if common.RDB == nil || apiKey.DailyLimit <= 0 {
+		return nil, true
+	}
+
+	now := time.Now()
+	date := now.Format("2006-01-02")
+
+	// 缓存中的当日费用可能滞后，与Redis中已结算的费用取较大值
+	todayCost := 0.0
+	if apiKey.LastUsedTime != nil && time.Time(*apiKey.LastUsedTime).Format("2006-01-02") == date {
+		todayCost = apiKey.TodayTotalCost
+	}
+
+	reservationID := common.GenerateRandomString(16)
+	amount := strconv.FormatFloat(EstimateRequestMaxCost(body), 'f', -1, 64)
+	reservation := &BudgetReservation{
+		apiKeyID: apiKey.ID,
+		date:     date,
+		member:   reservationID + ":" + amount,
+	}
+
+	ok, err := reserveBudgetScript.Run(context.Background(), common.RDB,
+		[]string{apiKeyDailySpendKey(apiKey.ID, date), apiKeyReservationsKey(apiKey.ID)},
+		strconv.FormatFloat(todayCost, 'f', -1, 64),
+		amount,
+		strconv.FormatFloat(apiKey.DailyLimit, 'f', -1, 64),
+		now.UnixMilli(),
+		now.Add(budgetReservationTTL).UnixMilli(),
+		reservationID,
+	).Int()
+	if err != nil {
+		common.SysError("Failed to reserve api key budget: " + err.Error())
+		return nil, true
+	}
+	if ok == 0 {
+		return nil, false
+	}
+
+	return reservation, true
+}
+
+// Settle 释放预占金额并计入实际费用，usage为nil表示请求失败不产生费用
+// 多次调用只释放一次预占，实际费用每次都会计入（失败重试后的成功请求）
+func (r *BudgetReservation) Settle(usage *common.TokenUsage) {
+	if r == nil || common.RDB == nil {
+		return
+	}
+
+	ctx := context.Background()
+	r.once.Do(func() {
+		if err := common.RDB.ZRem(ctx, apiKeyReservationsKey(r.apiKeyID), r.member).Err(); err != nil {
+			common.SysError("Failed to release api key budget reservation: " + err.Error())
+		}
+	})
+
+	if usage == nil {
+		return
+	}
+
+	cost := common.CalculateCost(usage).Costs.Total
+	if cost <= 0 {
+		return
+	}
+
+	cacheKey := apiKeyDailySpendKey(r.apiKeyID, r.date)
+	pipe := common.RDB.Pipeline()
+	pipe.IncrByFloat(ctx, cacheKey, cost)
+	pipe.Expire(ctx, cacheKey, 48*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("Failed to record api key daily spend: " + err.Error())
+	}
+}
+
+// Release 释放预占金额，不计入费用
+func (r *BudgetReservation) Release() {
+	r.Settle(nil)
+}
+
+// EstimateRequestMaxCost 预估Claude格式请求的最大费用（USD）
+func EstimateRequestMaxCost(body []byte) float64 {
+	outputTokens := int(gjson.GetBytes(body, "max_tokens").Int())
+	if outputTokens <= 0 {
+		outputTokens = defaultReserveOutputTokens
+	}
+
+	usage := &common.TokenUsage{
+		InputTokens:  EstimateInputTokens(body),
+		OutputTokens: outputTokens,
+		Model:        gjson.GetBytes(body, "model").String(),
+	}
+	return common.CalculateCost(usage).Costs.Total
+}
+
+// EstimateInputTokens 本地粗略估算请求的输入tokens
+// 按每3字节1个token计算（英文约4字符1个token，中文约1字1个token），宁可高估
+func EstimateInputTokens(body []byte) int {
+	size := len(gjson.GetBytes(body, "system").Raw) + len(gjson.GetBytes(body, "tools").Raw)
+	tokens := 0
+
+	gjson.GetBytes(body, "messages").ForEach(func(_, message gjson.Result) bool {
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			size += len(content.Str)
+			return true
+		}
+		content.ForEach(func(_, block gjson.Result) bool {
+			size, tokens = estimateBlockSize(block, size, tokens)
+			return true
+		})
+		return true
+	})
+
+	return tokens + size/3
+}
+
+// estimateBlockSize 累加内容块的文本字节数和二进制内容的tokens数
+func estimateBlockSize(block gjson.Result, size, tokens int) (int, int) {
+	switch block.Get("type").String() {
+	case "image", "document":
+		tokens += reserveMediaTokens
+	case "tool_result":
+		content := block.Get("content")
+		if content.Type == gjson.String {
+			size += len(content.Str)
+		} else {
+			content.ForEach(func(_, inner gjson.Result) bool {
+				size, tokens = estimateBlockSize(inner, size, tokens)
+				return true
+			})
+		}
+	case "tool_use":
+		size += len(block.Get("input").Raw)
+	default:
+		size += len(block.Get("text").Str) + len(block.Get("thinking").Str)
+	}
+	return size, tokens
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"errors"
 	"strconv"
@@ -23,10 +24,20 @@ func CreateGroup(req *model.CreateGroupRequest, userID uint) (*model.Group, erro
 	}
 
 	group := &model.Group{
-		Name:   req.Name,
-		Remark: req.Remark,
-		Status: req.Status,
-		UserID: userID,
+		Name:             req.Name,
+		Remark:           req.Remark,
+		Status:           req.Status,
+		ScheduleStrategy: req.ScheduleStrategy,
+		WeeklyBudget:     req.WeeklyBudget,
+		MonthlyBudget:    req.MonthlyBudget,
+		TotalBudget:      req.TotalBudget,
+		CaptureBodies:    req.CaptureBodies,
+		UserID:           userID,
+	}
+
+	// 如果没有指定调度策略，默认为优先级+权重
+	if group.ScheduleStrategy == "" {
+		group.ScheduleStrategy = constant.ScheduleStrategyPriorityWeighted
 	}
 
 	// 如果没有指定状态，默认为启用
@@ -85,6 +96,23 @@ func UpdateGroup(id string, req *model.UpdateGroupRequest, userID uint) (*model.
 		group.Status = *req.Status
 	}
 
+	if req.ScheduleStrategy != nil && *req.ScheduleStrategy != "" {
+		group.ScheduleStrategy = *req.ScheduleStrategy
+	}
+
+	if req.WeeklyBudget != nil {
+		group.WeeklyBudget = *req.WeeklyBudget
+	}
+	if req.MonthlyBudget != nil {
+		group.MonthlyBudget = *req.MonthlyBudget
+	}
+	if req.TotalBudget != nil {
+		group.TotalBudget = *req.TotalBudget
+	}
+	if req.CaptureBodies != nil {
+		group.CaptureBodies = *req.CaptureBodies
+	}
+
 	err = model.UpdateGroup(group)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"bufio"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultLogWriterBufferSize    = 10000
+	defaultLogWriterBatchSize     = 200
+	defaultLogWriterFlushInterval = 2 * time.Second
+	defaultLogSpillFile           = "./logs/request_logs.spill"
+
+	// 落盘日志的重放间隔
+	logSpillReplayInterval = 30 * time.Second
+)
+
+// logWriter 请求日志异步批量写入器
+// 日志先进入有界队列，按批量大小或时间间隔批量写入数据库；
+// 队列已满或数据库写入失败时追加到本地落盘文件，数据库恢复后重放
+type logWriter struct {
+	queue         chan *model.Log
+	batchSize     int
+	flushInterval time.Duration
+	spillFile     string
+	spillMu       sync.Mutex // 只保护落盘文件的追加写入和重放前的文件切换
+	stopping      atomic.Bool
+	done          chan struct{}
+	stopped       chan struct{}
+
+	// pending 已从队列取出但尚未写入数据库的日志，包括正在累积和正在写入的批次
+	// abandoned 为true表示停止超时，之后取出的日志直接落盘
+	pendingMu sync.Mutex
+	pending   []*model.Log
+	abandoned bool
+}
+
+var globalLogWriter atomic.Pointer[logWriter]
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// StartLogWriter 启动请求日志异步写入器
+// 可通过 LOG_WRITER_BUFFER_SIZE、LOG_WRITER_BATCH_SIZE、LOG_WRITER_FLUSH_INTERVAL(秒)、LOG_SPILL_FILE 配置
+func StartLogWriter() {
+	flushInterval := defaultLogWriterFlushInterval
+	if seconds := getEnvInt("LOG_WRITER_FLUSH_INTERVAL", 0); seconds > 0 {
+		flushInterval = time.Duration(seconds) * time.Second
+	}
+
+	spillFile := os.Getenv("LOG_SPILL_FILE")
+	if spillFile == "" {
+		spillFile = defaultLogSpillFile
+	}
+
+	w := &logWriter{
+		queue:         make(chan *model.Log, getEnvInt("LOG_WRITER_BUFFER_SIZE", defaultLogWriterBufferSize)),
+		batchSize:     getEnvInt("LOG_WRITER_BATCH_SIZE", defaultLogWriterBatchSize),
+		flushInterval: flushInterval,
+		spillFile:     spillFile,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if !globalLogWriter.CompareAndSwap(nil, w) {
+		return
+	}
+
+	go w.run()
+	common.SysLog("Log writer started")
+}
+
+// StopLogWriter 停止写入器并将队列中的日志写入数据库，超时未完成的日志写入落盘文件，下次启动时重放
+func StopLogWriter(timeout time.Duration) {
+	w := globalLogWriter.Load()
+	if w == nil || !w.stopping.CompareAndSwap(false, true) {
+		return
+	}
+
+	close(w.done)
+	select {
+	case <-w.stopped:
+		common.SysLog("Log writer drained")
+	case <-time.After(timeout):
+		common.SysError("Log writer drain timed out, spilling remaining logs")
+		w.spillRemaining()
+	}
+}
+
+// spillRemaining 停止超时后将未写入的批次和队列中剩余的日志同步落盘
+// 正在写入的批次可能随后写入成功，重放时会跳过已写入的日志
+func (w *logWriter) spillRemaining() {
+	w.pendingMu.Lock()
+	w.abandoned = true
+	remaining := append([]*model.Log(nil), w.pending...)
+	w.pending = nil
+	w.pendingMu.Unlock()
+
+	for {
+		select {
+		case entry := <-w.queue:
+			remaining = append(remaining, entry)
+		default:
+			if len(remaining) > 0 {
+				w.spill(remaining)
+				common.SysLog("Spilled " + strconv.Itoa(len(remaining)) + " request logs on shutdown")
+			}
+			return
+		}
+	}
+}
+
+// EnqueueLogFromTokenUsage 将请求日志放入异步写入队列，不阻塞请求，返回的日志ID可用于关联其他记录
+func (s *LogService) EnqueueLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool, meta *model.LogRequestMeta) (*model.Log, error) {
+	if usage == nil {
+		return nil, errors.New("TokenUsage不能为空")
+	}
+	if userID == 0 {
+		return nil, errors.New("用户ID不能为空")
+	}
+
+	entry := model.NewLogFromTokenUsage(usage, userID, apiKeyID, accountID, duration, isStream, meta)
+
+	ctx := trace.ContextWithSpanContext(context.Background(), entry.TraceContext)
+	_, span := common.Tracer().Start(ctx, "log.enqueue", trace.WithSpanKind(trace.SpanKindInternal))
+	defer span.End()
+	span.SetAttributes(attribute.String("log.id", entry.ID))
+
+	w := globalLogWriter.Load()
+	if w == nil {
+		// 写入器未启动时直接写入数据库
+		go func() {
+			if err := model.CreateLogsInBatches([]*model.Log{entry}, 1); err != nil {
+				common.SysError("创建日志记录失败: " + err.Error())
+			}
+		}()
+		return entry, nil
+	}
+
+	// 已停止或队列已满时直接落盘，下次启动时重放
+	if w.stopping.Load() {
+		span.SetAttributes(attribute.Bool("log.spilled", true))
+		w.spill([]*model.Log{entry})
+		return entry, nil
+	}
+	select {
+	case w.queue <- entry:
+	default:
+		span.SetAttributes(attribute.Bool("log.spilled", true))
+		w.spill([]*model.Log{entry})
+	}
+	return entry, nil
+}
+
+func (w *logWriter) run() {
+	defer close(w.stopped)
+
+	// 启动时先重放上次未写入的日志
+	w.replaySpill()
+
+	flushTicker := time.NewTicker(w.flushInterval)
+	defer flushTicker.Stop()
+	replayTicker := time.NewTicker(logSpillReplayInterval)
+	defer replayTicker.Stop()
+
+	batch := make([]*model.Log, 0, w.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			w.flush(batch)
+			w.pendingMu.Lock()
+			batch = make([]*model.Log, 0, w.batchSize)
+			w.pending = nil
+			w.pendingMu.Unlock()
+		}
+	}
+	add := func(entry *model.Log) {
+		w.pendingMu.Lock()
+		if w.abandoned {
+			w.pendingMu.Unlock()
+			w.spill([]*model.Log{entry})
+			return
+		}
+		batch = append(batch, entry)
+		w.pending = batch
+		w.pendingMu.Unlock()
+
+		if len(batch) >= w.batchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case entry := <-w.queue:
+			add(entry)
+		case <-flushTicker.C:
+			flush()
+		case <-replayTicker.C:
+			w.replaySpill()
+		case <-w.done:
+			// 取完队列中剩余的日志后退出
+			for {
+				select {
+				case entry := <-w.queue:
+					add(entry)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush 批量写入数据库，失败时落盘
+// 批量写入不属于单个请求，单独创建span并关联到批次中各请求的链路
+func (w *logWriter) flush(batch []*model.Log) {
+	links := make([]trace.Link, 0, len(batch))
+	for _, entry := range batch {
+		if entry.TraceContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: entry.TraceContext})
+		}
+	}
+	_, span := common.Tracer().Start(context.Background(), "log.flush", trace.WithSpanKind(trace.SpanKindInternal), trace.WithNewRoot(), trace.WithLinks(links...))
+	defer span.End()
+	span.SetAttributes(attribute.Int("log.batch_size", len(batch)))
+
+	if err := model.CreateLogsInBatches(batch, w.batchSize); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		common.SysError("批量写入日志失败，写入落盘文件: " + err.Error())
+		w.spill(batch)
+	}
+}
+
+// spill 将日志以JSON Lines格式追加到落盘文件
+func (w *logWriter) spill(logs []*model.Log) {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(w.spillFile), 0755); err != nil {
+		common.SysError("创建日志落盘目录失败: " + err.Error())
+		return
+	}
+
+	file, err := os.OpenFile(w.spillFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		common.SysError("打开日志落盘文件失败: " + err.Error())
+		return
+	}
+	defer common.CloseIO(file)
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range logs {
+		if err := encoder.Encode(entry); err != nil {
+			common.SysError("写入日志落盘文件失败: " + err.Error())
+			return
+		}
+	}
+}
+
+// replaySpill 将落盘文件中的日志重新写入数据库，全部成功后删除文件
+// 重放前先将落盘文件改名，写入数据库期间新的落盘日志追加到新文件，不会阻塞请求；
+// 上次重放失败时继续重放改名后的文件
+func (w *logWriter) replaySpill() {
+	replayFile := w.spillFile + ".replay"
+	if _, err := os.Stat(replayFile); os.IsNotExist(err) {
+		w.spillMu.Lock()
+		err = os.Rename(w.spillFile, replayFile)
+		w.spillMu.Unlock()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				common.SysError("切换日志落盘文件失败: " + err.Error())
+			}
+			return
+		}
+	}
+
+	file, err := os.Open(replayFile)
+	if err != nil {
+		common.SysError("打开日志落盘文件失败: " + err.Error())
+		return
+	}
+
+	var logs []*model.Log
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry model.Log
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			common.SysError("解析落盘日志失败: " + err.Error())
+			continue
+		}
+		logs = append(logs, &entry)
+	}
+	scanErr := scanner.Err()
+	common.CloseIO(file)
+	if scanErr != nil {
+		common.SysError("读取日志落盘文件失败: " + scanErr.Error())
+		return
+	}
+
+	// 跳过已写入数据库的日志，部分写入后重放不会重复
+	unsaved, err := model.FilterUnsavedLogs(logs, w.batchSize)
+	if err != nil {
+		common.SysError("重放落盘日志失败: " + err.Error())
+		return
+	}
+	if err := model.CreateLogsInBatches(unsaved, w.batchSize); err != nil {
+		common.SysError("重放落盘日志失败: " + err.Error())
+		return
+	}
+
+	if err := os.Remove(replayFile); err != nil {
+		common.SysError("删除日志落盘文件失败: " + err.Error())
+		return
+	}
+	if len(logs) > 0 {
+		common.SysLog("Replayed " + strconv.Itoa(len(logs)) + " spilled request logs")
+	}
+}
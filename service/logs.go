@@ -46,6 +46,15 @@ func (s *LogService) CreateLogFromTokenUsage(usage *common.TokenUsage, userID, a
 	return log, nil
 }
 
+// GetLogCapture 获取日志的请求/响应抓取内容，没有抓取记录时返回nil
+func (s *LogService) GetLogCapture(logID string) *model.LogCaptureDetail {
+	capture, err := model.GetLogCaptureDetail(logID)
+	if err != nil {
+		return nil
+	}
+	return capture
+}
+
 // GetLogById 根据ID获取日志
 func (s *LogService) GetLogById(id string) (*model.Log, error) {
 	if id == "" {
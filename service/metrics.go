@@ -0,0 +1,23 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"strconv"
+)
+
+// RefreshAccountStatusMetrics 按数据库中的账号状态重建账号状态指标，在每次采集时调用
+func RefreshAccountStatusMetrics() error {
+	var accounts []model.Account
+	err := model.DB.Select("id", "name", "platform_type", "current_status").Find(&accounts).Error
+	if err != nil {
+		return err
+	}
+
+	// 已删除的账号不再输出
+	common.AccountStatus.Reset()
+	for _, account := range accounts {
+		common.AccountStatus.WithLabelValues(account.PlatformType, strconv.FormatUint(uint64(account.ID), 10), account.Name).Set(float64(account.CurrentStatus))
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 进行中请求计数的过期时间，防止进程异常退出后计数无法回收
+	accountInFlightTTL = 30 * time.Minute
+)
+
+// AccountScheduler 账号调度器，对候选账号排序，排在首位的账号即本次选中的账号
+type AccountScheduler interface {
+	Schedule(groupID int, accounts []model.Account) []model.Account
+}
+
+// accountSchedulers 已注册的调度策略
+var accountSchedulers = map[string]AccountScheduler{
+	constant.ScheduleStrategyPriorityWeighted: &priorityWeightedScheduler{},
+	constant.ScheduleStrategyLeastConnections: &leastConnectionsScheduler{},
+	constant.ScheduleStrategyLeastCost:        &leastCostScheduler{},
+	constant.ScheduleStrategyRoundRobin:       &roundRobinScheduler{},
+}
+
+// RegisterAccountScheduler 注册自定义调度策略（仅在初始化阶段调用）
+func RegisterAccountScheduler(strategy string, scheduler AccountScheduler) {
+	accountSchedulers[strategy] = scheduler
+}
+
+// ScheduleAccounts 按分组配置的调度策略对可用账号排序
+// 未配置或配置了未知策略时使用优先级+权重随机策略
+func ScheduleAccounts(groupID int, accounts []model.Account) []model.Account {
+	if len(accounts) <= 1 {
+		return accounts
+	}
+
+	strategy := constant.ScheduleStrategyPriorityWeighted
+	if groupID > 0 {
+		if groupStrategy := model.GetGroupScheduleStrategy(groupID); groupStrategy != "" {
+			strategy = groupStrategy
+		}
+	}
+
+	scheduler, exists := accountSchedulers[strategy]
+	if !exists {
+		scheduler = accountSchedulers[constant.ScheduleStrategyPriorityWeighted]
+	}
+
+	return scheduler.Schedule(groupID, accounts)
+}
+
+// splitByPriority 按优先级将账号分层（数字越小越靠前），所有策略都只在同一优先级内部调度
+func splitByPriority(accounts []model.Account) [][]model.Account {
+	sorted := make([]model.Account, len(accounts))
+	copy(sorted, accounts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	var tiers [][]model.Account
+	for i, account := range sorted {
+		if i == 0 || account.Priority != sorted[i-1].Priority {
+			tiers = append(tiers, []model.Account{})
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], account)
+	}
+	return tiers
+}
+
+// joinTiers 合并各优先级层的排序结果
+func joinTiers(tiers [][]model.Account) []model.Account {
+	var result []model.Account
+	for _, tier := range tiers {
+		result = append(result, tier...)
+	}
+	return result
+}
+
+// priorityWeightedScheduler 优先级最高的账号中按权重随机选择
+type priorityWeightedScheduler struct{}
+
+func (s *priorityWeightedScheduler) Schedule(groupID int, accounts []model.Account) []model.Account {
+	tiers := splitByPriority(accounts)
+	for i := range tiers {
+		tiers[i] = weightedShuffle(tiers[i])
+	}
+	return joinTiers(tiers)
+}
+
+// weightedShuffle 按权重进行不放回随机抽样，权重越大越靠前的概率越高
+func weightedShuffle(accounts []model.Account) []model.Account {
+	remaining := make([]model.Account, len(accounts))
+	copy(remaining, accounts)
+
+	result := make([]model.Account, 0, len(accounts))
+	for len(remaining) > 0 {
+		totalWeight := 0
+		for _, account := range remaining {
+			totalWeight += accountWeight(account)
+		}
+
+		picked := 0
+		r := rand.Intn(totalWeight)
+		for i, account := range remaining {
+			r -= accountWeight(account)
+			if r < 0 {
+				picked = i
+				break
+			}
+		}
+
+		result = append(result, remaining[picked])
+		remaining = append(remaining[:picked], remaining[picked+1:]...)
+	}
+	return result
+}
+
+// accountWeight 获取账号权重，未设置时按1处理
+func accountWeight(account model.Account) int {
+	if account.Weight <= 0 {
+		return 1
+	}
+	return account.Weight
+}
+
+// leastConnectionsScheduler 优先选择进行中请求最少的账号
+type leastConnectionsScheduler struct{}
+
+func (s *leastConnectionsScheduler) Schedule(groupID int, accounts []model.Account) []model.Account {
+	ids := make([]uint, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.ID
+	}
+	inFlight := GetAccountInFlightCounts(ids)
+
+	tiers := splitByPriority(accounts)
+	for _, tier := range tiers {
+		sort.SliceStable(tier, func(i, j int) bool {
+			return inFlight[tier[i].ID] < inFlight[tier[j].ID]
+		})
+	}
+	return joinTiers(tiers)
+}
+
+// leastCostScheduler 优先选择今日费用最少的账号
+type leastCostScheduler struct{}
+
+func (s *leastCostScheduler) Schedule(groupID int, accounts []model.Account) []model.Account {
+	tiers := splitByPriority(accounts)
+	for _, tier := range tiers {
+		sort.SliceStable(tier, func(i, j int) bool {
+			return tier[i].TodayTotalCost < tier[j].TodayTotalCost
+		})
+	}
+	return joinTiers(tiers)
+}
+
+// roundRobinScheduler 分组内按账号ID顺序轮询
+type roundRobinScheduler struct{}
+
+// localRoundRobinCounters Redis不可用时使用的本地轮询计数器
+var localRoundRobinCounters sync.Map
+
+func (s *roundRobinScheduler) Schedule(groupID int, accounts []model.Account) []model.Account {
+	offset := nextRoundRobinCounter(groupID)
+
+	tiers := splitByPriority(accounts)
+	for i, tier := range tiers {
+		sort.SliceStable(tier, func(a, b int) bool {
+			return tier[a].ID < tier[b].ID
+		})
+		start := int(offset % uint64(len(tier)))
+		rotated := make([]model.Account, 0, len(tier))
+		rotated = append(rotated, tier[start:]...)
+		tiers[i] = append(rotated, tier[:start]...)
+	}
+	return joinTiers(tiers)
+}
+
+// nextRoundRobinCounter 获取分组的下一个轮询序号
+func nextRoundRobinCounter(groupID int) uint64 {
+	if common.RDB != nil {
+		cacheKey := fmt.Sprintf("schedule_rr:%d", groupID)
+		if count, err := common.RDB.Incr(context.Background(), cacheKey).Result(); err == nil {
+			return uint64(count - 1)
+		}
+	}
+
+	counter, _ := localRoundRobinCounters.LoadOrStore(groupID, new(uint64))
+	return atomic.AddUint64(counter.(*uint64), 1) - 1
+}
+
+// AcquireAccountConnection 记录账号的一个进行中请求，返回的函数用于在请求结束时释放
+func AcquireAccountConnection(accountID uint) func() {
+	if common.RDB == nil {
+		return func() {}
+	}
+
+	ctx := context.Background()
+	cacheKey := fmt.Sprintf("account_inflight:%d", accountID)
+
+	pipe := common.RDB.Pipeline()
+	pipe.Incr(ctx, cacheKey)
+	pipe.Expire(ctx, cacheKey, accountInFlightTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("Failed to increase account in-flight count: " + err.Error())
+		return func() {}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if count, err := common.RDB.Decr(ctx, cacheKey).Result(); err == nil && count <= 0 {
+				common.RDB.Del(ctx, cacheKey)
+			}
+		})
+	}
+}
+
+// GetAccountInFlightCounts 批量获取账号的进行中请求数
+func GetAccountInFlightCounts(accountIDs []uint) map[uint]int64 {
+	counts := make(map[uint]int64, len(accountIDs))
+	if common.RDB == nil || len(accountIDs) == 0 {
+		return counts
+	}
+
+	keys := make([]string, len(accountIDs))
+	for i, id := range accountIDs {
+		keys[i] = fmt.Sprintf("account_inflight:%d", id)
+	}
+
+	values, err := common.RDB.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return counts
+	}
+
+	for i, value := range values {
+		if str, ok := value.(string); ok {
+			if count, err := strconv.ParseInt(str, 10, 64); err == nil {
+				counts[accountIDs[i]] = count
+			}
+		}
+	}
+	return counts
+}
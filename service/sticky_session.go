@@ -0,0 +1,96 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// 默认会话粘滞时间
+	defaultStickySessionTTL = time.Hour
+)
+
+// GetStickySessionTTL 获取会话粘滞时间，STICKY_SESSION_TTL(秒)设置为0时关闭会话粘滞
+func GetStickySessionTTL() time.Duration {
+	ttlStr := os.Getenv("STICKY_SESSION_TTL")
+	if ttlStr == "" {
+		return defaultStickySessionTTL
+	}
+
+	seconds, err := strconv.Atoi(ttlStr)
+	if err != nil || seconds < 0 {
+		return defaultStickySessionTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetSessionFingerprint 计算请求所属会话的指纹
+// 优先使用客户端传入的 metadata.user_id（Claude Code 中包含会话ID），否则使用 system 与首条用户消息
+func GetSessionFingerprint(body []byte) string {
+	source := gjson.GetBytes(body, "metadata.user_id").String()
+	if source == "" {
+		system := gjson.GetBytes(body, "system").Raw
+		firstUserMessage := gjson.GetBytes(body, `messages.#(role=="user").content`).Raw
+		if system == "" && firstUserMessage == "" {
+			return ""
+		}
+		source = system + "\n" + firstUserMessage
+	}
+
+	hash := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(hash[:16])
+}
+
+// stickySessionKey 会话绑定的缓存键，按分组隔离
+func stickySessionKey(groupID int, fingerprint string) string {
+	return fmt.Sprintf("sticky_session:%d:%s", groupID, fingerprint)
+}
+
+// ApplyStickySession 如果会话已绑定账号且该账号仍在候选列表中，将其移到首位
+// 绑定的账号不可用时保持原有调度顺序
+func ApplyStickySession(groupID int, fingerprint string, accounts []model.Account) []model.Account {
+	if fingerprint == "" || common.RDB == nil || len(accounts) <= 1 || GetStickySessionTTL() == 0 {
+		return accounts
+	}
+
+	accountID, err := common.RDB.Get(context.Background(), stickySessionKey(groupID, fingerprint)).Uint64()
+	if err != nil {
+		return accounts
+	}
+
+	for i, account := range accounts {
+		if account.ID == uint(accountID) {
+			if i == 0 {
+				return accounts
+			}
+			sorted := make([]model.Account, 0, len(accounts))
+			sorted = append(sorted, account)
+			sorted = append(sorted, accounts[:i]...)
+			return append(sorted, accounts[i+1:]...)
+		}
+	}
+
+	return accounts
+}
+
+// BindStickySession 将会话绑定到账号，每次成功请求都会刷新过期时间
+func BindStickySession(groupID int, fingerprint string, accountID uint) {
+	ttl := GetStickySessionTTL()
+	if fingerprint == "" || common.RDB == nil || ttl == 0 {
+		return
+	}
+
+	err := common.RDB.Set(context.Background(), stickySessionKey(groupID, fingerprint), accountID, ttl).Err()
+	if err != nil {
+		common.SysError("Failed to bind sticky session: " + err.Error())
+	}
+}
@@ -7,6 +7,7 @@ const Api = {
   Update: '/api/v1/accounts/update',
   Delete: '/api/v1/accounts/delete',
   GetDetail: '/api/v1/accounts/detail',
+  RevealSecrets: '/api/v1/accounts/reveal',
   UpdateActiveStatus: '/api/v1/accounts/update-active-status',
   UpdateCurrentStatus: '/api/v1/accounts/update-current-status',
   TestAccount: '/api/v1/accounts/test',
@@ -21,9 +22,9 @@ export interface Account {
   name: string;
   platform_type: string; // claude/claude_console/openai/gemini
   request_url: string;
-  secret_key: string; // 现在会返回密钥
-  access_token: string; // 现在会返回访问令牌
-  refresh_token: string; // 现在会返回刷新令牌
+  secret_key: string; // 已脱敏，完整密钥通过 revealAccountSecrets 获取
+  access_token: string; // 已脱敏
+  refresh_token: string; // 已脱敏
   expires_at: number;
   is_max: boolean;
   group_id: number;
@@ -39,9 +40,10 @@ export interface Account {
   proxy_uri: string;
   model_mapping: string;
   model_restriction: string;
+  openai_api_type: string; // chat_completions 或 responses
   last_used_time: string;
   rate_limit_end_time: string;
-  current_status: number; // 1:正常,2:接口异常,3:账号异常/限流
+  current_status: number; // 1:正常,2:接口异常,3:账号异常/限流,4:token刷新失败
   active_status: number; // 1:激活,2:禁用
   user_id: number;
   created_at: string;
@@ -72,6 +74,7 @@ export interface AccountCreateParams {
   proxy_uri?: string;
   model_mapping?: string;
   model_restriction?: string;
+  openai_api_type?: string;
   active_status?: number;
   is_max?: boolean;
   access_token?: string;
@@ -93,6 +96,7 @@ export interface AccountUpdateParams {
   proxy_uri?: string;
   model_mapping?: string;
   model_restriction?: string;
+  openai_api_type?: string;
   active_status?: number;
   is_max?: boolean;
   access_token?: string;
@@ -125,6 +129,13 @@ export interface UpdateAccountCurrentStatusParams {
   current_status: number;
 }
 
+// 账号完整密钥
+export interface AccountSecrets {
+  secret_key: string;
+  access_token: string;
+  refresh_token: string;
+}
+
 // 测试账号响应
 export interface TestAccountResponse {
   success: boolean;
@@ -183,6 +194,15 @@ export function getAccountDetail(id: number) {
   });
 }
 
+/**
+ * 查看账号完整密钥（仅账号所属用户）
+ */
+export function revealAccountSecrets(id: number) {
+  return request.get<AccountSecrets>({
+    url: `${Api.RevealSecrets}/${id}`,
+  });
+}
+
 /**
  * 创建账号
  */
@@ -7,13 +7,22 @@ const Api = {
   Update: '/api/v1/api-keys/update',
   UpdateStatus: '/api/v1/api-keys/update-status',
   Delete: '/api/v1/api-keys/delete',
+  Rotate: '/api/v1/api-keys/rotate',
+  RevokePrevious: '/api/v1/api-keys/revoke-previous',
 };
 
 // API Key
 export interface ApiKey {
   id: number;
   name: string;
-  key: string;
+  key_prefix: string; // 密钥前缀，完整密钥只在创建时返回一次
+  previous_key_prefix: string; // 轮换前旧密钥的前缀
+  previous_key_expires_at?: string; // 旧密钥宽限期截止时间，为空表示没有有效的旧密钥
+  previous_key_usage_count: number; // 轮换后旧密钥的使用次数
+  previous_key_last_used_at?: string; // 旧密钥最后使用时间
+  previous_key_last_ip: string; // 最后使用旧密钥的客户端IP
+  previous_key_last_user_agent: string; // 最后使用旧密钥的User-Agent
+  rotated_at?: string; // 最近一次轮换时间
   expires_at?: string;
   status: number; // 1: 启用 0: 禁用
   group_id: number;
@@ -26,6 +35,19 @@ export interface ApiKey {
   today_total_cost: number;
   model_restriction: string;
   daily_limit: number;
+  rpm_limit: number; // 每分钟请求数限制，0表示不限制
+  tpm_limit: number; // 每分钟tokens限制，0表示不限制
+  max_concurrency: number; // 最大并发流式请求数，0表示不限制
+  weekly_budget: number; // 最近7天预算(美元)，0表示不限制
+  monthly_budget: number; // 最近30天预算(美元)，0表示不限制
+  total_budget: number; // 总预算(美元)，0表示不限制
+  total_cost: number; // 累计使用总费用
+  capture_bodies: boolean; // 是否抓取请求/响应内容
+  allowed_endpoints: string; // 允许调用的接口，逗号分隔，为空表示不限制
+  allowed_ips: string; // 允许的来源IP或CIDR，逗号分隔，为空表示不限制
+  allowed_user_agents: string; // 允许的User-Agent前缀，逗号分隔，为空表示不限制
+  max_tokens_limit: number; // 单次请求max_tokens上限，0表示不限制
+  max_context_tokens: number; // 单次请求上下文tokens上限，0表示不限制
   last_used_time?: string;
   created_at: string;
   updated_at: string;
@@ -55,6 +77,18 @@ export interface CreateApiKeyRequest {
   group_id?: number;
   model_restriction?: string;
   daily_limit?: number;
+  rpm_limit?: number;
+  tpm_limit?: number;
+  max_concurrency?: number;
+  weekly_budget?: number;
+  monthly_budget?: number;
+  total_budget?: number;
+  capture_bodies?: boolean;
+  allowed_endpoints?: string;
+  allowed_ips?: string;
+  allowed_user_agents?: string;
+  max_tokens_limit?: number;
+  max_context_tokens?: number;
 }
 
 // 更新API Key
@@ -65,6 +99,31 @@ export interface UpdateApiKeyRequest {
   group_id?: number;
   model_restriction?: string;
   daily_limit?: number;
+  rpm_limit?: number;
+  tpm_limit?: number;
+  max_concurrency?: number;
+  weekly_budget?: number;
+  monthly_budget?: number;
+  total_budget?: number;
+  capture_bodies?: boolean;
+  allowed_endpoints?: string;
+  allowed_ips?: string;
+  allowed_user_agents?: string;
+  max_tokens_limit?: number;
+  max_context_tokens?: number;
+}
+
+// 轮换API Key
+export interface RotateApiKeyRequest {
+  grace_minutes?: number; // 旧密钥宽限期(分钟)，0表示立即失效，不传使用默认值
+}
+
+// 轮换API Key结果
+export interface RotateApiKeyResult {
+  key: string;
+  key_prefix: string;
+  previous_key_prefix: string;
+  previous_key_expires_at?: string;
 }
 
 // 更新API Key状态
@@ -117,3 +176,18 @@ export function deleteApiKey(id: number) {
     url: `${Api.Delete}/${id}`,
   });
 }
+
+// 轮换API Key，新密钥只返回一次
+export function rotateApiKey(id: number, data: RotateApiKeyRequest) {
+  return request.post<RotateApiKeyResult>({
+    url: `${Api.Rotate}/${id}`,
+    data,
+  });
+}
+
+// 使轮换前的旧密钥立即失效
+export function revokePreviousApiKey(id: number) {
+  return request.post({
+    url: `${Api.RevokePrevious}/${id}`,
+  });
+}
@@ -16,6 +16,11 @@ export interface Group {
   name: string;
   remark: string; // 对应后端的remark字段
   status: number; // 0: 禁用, 1: 启用
+  schedule_strategy: string; // 账号调度策略
+  weekly_budget: number; // 最近7天预算(美元)，0表示不限制
+  monthly_budget: number; // 最近30天预算(美元)，0表示不限制
+  total_budget: number; // 总预算(美元)，0表示不限制
+  capture_bodies: boolean; // 是否抓取分组下所有API Key的请求/响应内容
   user_id: number;
   created_at: string;
   updated_at: string;
@@ -28,6 +33,11 @@ export interface GroupCreateParams {
   name: string;
   remark?: string;
   status?: number;
+  schedule_strategy?: string;
+  weekly_budget?: number;
+  monthly_budget?: number;
+  total_budget?: number;
+  capture_bodies?: boolean;
 }
 
 export interface GroupUpdateParams extends GroupCreateParams {
@@ -26,7 +26,22 @@ export interface Log {
   total_cost: number;
   is_stream: boolean;
   duration: number;
+  first_byte_time: number; // 首字节耗时(毫秒)，非流式请求为0
+  first_token_time: number; // 首个内容增量耗时(毫秒)，非流式请求为0
+  output_tokens_per_second: number; // 输出速度(tokens/秒)
+  status_code: number; // 响应状态码
+  error_type: string; // 错误类型，成功请求为空
+  error_message: string; // 错误信息，成功请求为空
+  upstream_request_id: string; // 上游request-id
+  retry_count: number; // 切换账号重试次数
+  client_ip: string; // 客户端IP
   created_at: string;
+  capture?: {
+    request: string; // 请求体
+    response: string; // 还原后的响应
+    stop_reason: string;
+    truncated: boolean; // 内容超过上限被截断
+  };
   user?: {
     id: number;
     username: string;
@@ -49,6 +64,11 @@ export interface LogQueryParams {
   end_time?: string; // 格式: 2024-01-01 15:04:05
   min_cost?: number;
   max_cost?: number;
+  status_code?: number;
+  only_errors?: boolean; // 只看失败请求
+  error_type?: string;
+  upstream_request_id?: string;
+  client_ip?: string;
 }
 
 // 日志列表响应
@@ -93,6 +113,9 @@ export interface DetailedStatsResult {
   cache_write_cost: number; // 缓存写入费用
   cache_read_cost: number; // 缓存读取费用
   avg_duration: number; // 平均响应时间
+  avg_first_byte_time: number; // 平均首字节耗时(毫秒)
+  avg_first_token_time: number; // 平均首个内容增量耗时(毫秒)
+  avg_output_speed: number; // 平均输出速度(tokens/秒)
   stream_requests: number; // 流式请求数
   stream_percent: number; // 流式请求比例
 }
@@ -107,12 +130,29 @@ export interface TrendDataItem {
   cache_tokens: number; // 缓存tokens
   input_tokens: number; // 输入tokens
   output_tokens: number; // 输出tokens
+  avg_first_byte_time: number; // 平均首字节耗时(毫秒)
+  avg_first_token_time: number; // 平均首个内容增量耗时(毫秒)
+  avg_output_speed: number; // 平均输出速度(tokens/秒)
+}
+
+// 按账号或模型分组的延迟统计
+export interface LatencyStatsItem {
+  account_id?: number; // 账号ID，按账号分组时有值
+  account_name?: string; // 账号名称，按账号分组时有值
+  model_name?: string; // 模型名称，按模型分组时有值
+  requests: number; // 请求数
+  avg_duration: number; // 平均响应时间
+  avg_first_byte_time: number; // 平均首字节耗时(毫秒)
+  avg_first_token_time: number; // 平均首个内容增量耗时(毫秒)
+  avg_output_speed: number; // 平均输出速度(tokens/秒)
 }
 
 // 统计响应结果
 export interface StatsResponse {
   summary: DetailedStatsResult; // 汇总统计
   trend_data: TrendDataItem[]; // 趋势数据
+  account_latency?: LatencyStatsItem[]; // 按账号的延迟统计
+  model_latency?: LatencyStatsItem[]; // 按模型的延迟统计
 }
 
 /**